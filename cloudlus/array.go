@@ -0,0 +1,156 @@
+package cloudlus
+
+import (
+	"bytes"
+	"fmt"
+	"text/template"
+)
+
+// JobArray is a set of jobs that differ only in a few parameters.  One child
+// job is created from Template for each parameter set in Params.  Each
+// element of the template's Cmd and the contents of the input files named in
+// Templates are expanded as text/template templates with the parameter set
+// as data - e.g. "--seed={{.seed}}".
+type JobArray struct {
+	Id       JobId
+	Template *Job
+	Params   []map[string]string
+	// Templates names the template's input files whose contents are
+	// expanded for each parameter set.  Other input files are shared by all
+	// child jobs unchanged.
+	Templates []string
+}
+
+// NewJobArray creates a job array with a new random id that runs one
+// instance of template for each parameter set.
+func NewJobArray(template *Job, params []map[string]string, templates ...string) *JobArray {
+	return &JobArray{
+		Id:        NewJob().Id,
+		Template:  template,
+		Params:    params,
+		Templates: templates,
+	}
+}
+
+// ArrayStat summarizes the progress of a job array.
+type ArrayStat struct {
+	Id JobId
+	// Size is the number of child jobs in the array.
+	Size int
+	// Counts holds the number of child jobs with each status.
+	Counts map[string]int
+	// Failed lists the ids of failed child jobs.
+	Failed []JobId
+	// Done is true if all of the array's jobs have finished.
+	Done bool
+}
+
+// NewArrayStat summarizes the progress of the array with the given id from
+// its child jobs.
+func NewArrayStat(id JobId, jobs []*Job) *ArrayStat {
+	st := &ArrayStat{Id: id, Size: len(jobs), Counts: map[string]int{}, Failed: []JobId{}, Done: true}
+	for _, j := range jobs {
+		st.Counts[j.Status]++
+		if j.Status == StatusFailed {
+			st.Failed = append(st.Failed, j.Id)
+		}
+		st.Done = st.Done && j.Done()
+	}
+	return st
+}
+
+// Expand creates the array's child jobs.  getblob retrieves the contents of
+// templated input files that refer to blobs.
+func (a *JobArray) Expand(getblob func(hash string) ([]byte, error)) ([]*Job, error) {
+	if a.Template == nil || len(a.Template.Cmd) == 0 {
+		return nil, fmt.Errorf("job array %v has no command to run", a.Id)
+	} else if len(a.Params) == 0 {
+		return nil, fmt.Errorf("job array %v has no parameter sets", a.Id)
+	}
+
+	// parse all templates up front so errors are reported once
+	cmd := make([]*template.Template, len(a.Template.Cmd))
+	for i, arg := range a.Template.Cmd {
+		t, err := parseTemplate(fmt.Sprintf("argument %v", i), []byte(arg))
+		if err != nil {
+			return nil, err
+		}
+		cmd[i] = t
+	}
+
+	infiles := map[string]*template.Template{}
+	for _, name := range a.Templates {
+		var f *File
+		for i := range a.Template.Infiles {
+			if a.Template.Infiles[i].Name == name {
+				f = &a.Template.Infiles[i]
+			}
+		}
+		if f == nil {
+			return nil, fmt.Errorf("templated input file '%v' not found", name)
+		}
+
+		data := f.Data
+		if data == nil && f.Hash != "" {
+			var err error
+			if data, err = getblob(f.Hash); err != nil {
+				return nil, err
+			}
+		}
+		t, err := parseTemplate(name, data)
+		if err != nil {
+			return nil, err
+		}
+		infiles[name] = t
+	}
+
+	jobs := make([]*Job, len(a.Params))
+	for n, params := range a.Params {
+		j := *a.Template
+		j.Id = NewJob().Id
+		j.ArrayId = a.Id
+		j.ArrayIndex = n
+		j.Attempts = nil
+		j.Cmd = make([]string, len(cmd))
+		for i, t := range cmd {
+			data, err := execTemplate(t, params, n)
+			if err != nil {
+				return nil, err
+			}
+			j.Cmd[i] = string(data)
+		}
+
+		j.Infiles = append([]File{}, a.Template.Infiles...)
+		for i, f := range j.Infiles {
+			t, ok := infiles[f.Name]
+			if !ok {
+				continue
+			}
+			data, err := execTemplate(t, params, n)
+			if err != nil {
+				return nil, err
+			}
+			j.Infiles[i] = File{Name: f.Name, Data: data, Size: len(data)}
+		}
+		j.Outfiles = append([]File{}, a.Template.Outfiles...)
+		j.DependsOn = append([]JobId{}, a.Template.DependsOn...)
+		jobs[n] = &j
+	}
+	return jobs, nil
+}
+
+func parseTemplate(name string, text []byte) (*template.Template, error) {
+	t, err := template.New(name).Option("missingkey=error").Parse(string(text))
+	if err != nil {
+		return nil, fmt.Errorf("invalid template: %v", err)
+	}
+	return t, nil
+}
+
+func execTemplate(t *template.Template, params map[string]string, n int) ([]byte, error) {
+	var buf bytes.Buffer
+	if err := t.Execute(&buf, params); err != nil {
+		return nil, fmt.Errorf("parameter set %v: %v", n, err)
+	}
+	return buf.Bytes(), nil
+}
@@ -0,0 +1,53 @@
+package cloudlus
+
+import (
+	"fmt"
+	"testing"
+)
+
+func TestJobArrayExpand(t *testing.T) {
+	tmpl := NewJobCmd("cyclus", "--seed={{.seed}}", "{{.name}}.xml")
+	tmpl.AddInfile("{{.name}}.xml", []byte("<sim seed=\"{{.seed}}\"/>"))
+	tmpl.Infiles = append(tmpl.Infiles, File{Name: "shared.xml", Hash: "abc"})
+	tmpl.AddOutfile("out.sqlite")
+	params := []map[string]string{
+		{"seed": "1", "name": "a"},
+		{"seed": "2", "name": "b"},
+	}
+	a := NewJobArray(tmpl, params, "{{.name}}.xml")
+
+	getblob := func(hash string) ([]byte, error) { return nil, fmt.Errorf("unexpected blob fetch") }
+	jobs, err := a.Expand(getblob)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(jobs) != 2 {
+		t.Fatalf("wrong number of jobs: got %v, want 2", len(jobs))
+	}
+	for i, j := range jobs {
+		p := params[i]
+		if want := fmt.Sprintf("[cyclus --seed=%v %v.xml]", p["seed"], p["name"]); fmt.Sprint(j.Cmd) != want {
+			t.Errorf("job %v: wrong command: got %v, want %v", i, j.Cmd, want)
+		}
+		if want := fmt.Sprintf("<sim seed=\"%v\"/>", p["seed"]); string(j.Infiles[0].Data) != want {
+			t.Errorf("job %v: wrong templated infile: got '%s', want '%v'", i, j.Infiles[0].Data, want)
+		}
+		if j.Infiles[1].Hash != "abc" {
+			t.Errorf("job %v: shared infile changed: %+v", i, j.Infiles[1])
+		}
+		if j.ArrayId != a.Id || j.ArrayIndex != i || j.Id == tmpl.Id {
+			t.Errorf("job %v: wrong ids: id %v, array %v, index %v", i, j.Id, j.ArrayId, j.ArrayIndex)
+		}
+	}
+	if jobs[0].Id == jobs[1].Id {
+		t.Errorf("child jobs share an id")
+	}
+	if tmpl.Cmd[1] != "--seed={{.seed}}" {
+		t.Errorf("expanding modified the template: %v", tmpl.Cmd)
+	}
+
+	a.Params = append(a.Params, map[string]string{"seed": "3"})
+	if _, err := a.Expand(getblob); err == nil {
+		t.Errorf("missing parameters should be reported")
+	}
+}
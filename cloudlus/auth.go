@@ -0,0 +1,225 @@
+package cloudlus
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// Roles granted by API tokens.  Admin tokens can do everything.  Submitter
+// tokens can also do everything read-only tokens can.
+const (
+	// RoleAdmin manages tokens and workers and can reset the queue.
+	RoleAdmin = "admin"
+	// RoleSubmitter submits, cancels and retries jobs.
+	RoleSubmitter = "submitter"
+	// RoleWorker fetches and runs jobs and reports their results.
+	RoleWorker = "worker"
+	// RoleReadOnly views jobs, their output and the dashboard.
+	RoleReadOnly = "read-only"
+)
+
+// Roles lists all valid token roles.
+var Roles = []string{RoleAdmin, RoleSubmitter, RoleWorker, RoleReadOnly}
+
+// errBadToken is returned for requests without a valid API token.
+var errBadToken = errors.New("missing or invalid API token")
+
+// errNotOwner is returned for requests to cancel or retry jobs of others.
+var errNotOwner = errors.New("permission denied: job belongs to another owner")
+
+// Token is an API token granting a role to its owner.  Only the hash of the
+// secret presented by clients is stored.
+type Token struct {
+	// Id identifies the token in listings and in the jobs submitted with it.
+	Id string
+	// Hash is the hex-encoded SHA-256 hash of the token's secret.
+	Hash string
+	// Owner is recorded as the owner of all jobs submitted with the token.
+	// If empty, submitters choose the owner themselves.
+	Owner   string
+	Role    string
+	Created time.Time
+}
+
+// IssuedToken holds a newly created token along with its secret.
+type IssuedToken struct {
+	*Token
+	Secret string
+}
+
+// newToken creates a token with a new random secret granting role to owner.
+func newToken(owner, role string) (*IssuedToken, error) {
+	if !validRole(role) {
+		return nil, fmt.Errorf("invalid token role '%v' (want one of %v)", role, strings.Join(Roles, ", "))
+	}
+
+	buf := make([]byte, 32)
+	if _, err := rand.Read(buf); err != nil {
+		return nil, err
+	}
+	secret := hex.EncodeToString(buf)
+	hash := tokenHash(secret)
+	t := &Token{Id: hash[:16], Hash: hash, Owner: owner, Role: role, Created: time.Now()}
+	return &IssuedToken{Token: t, Secret: secret}, nil
+}
+
+func validRole(role string) bool {
+	for _, r := range Roles {
+		if r == role {
+			return true
+		}
+	}
+	return false
+}
+
+func tokenHash(secret string) string {
+	sum := sha256.Sum256([]byte(secret))
+	return hex.EncodeToString(sum[:])
+}
+
+// grants returns true if the token's role includes the permissions of role.
+func (t *Token) grants(role string) bool {
+	switch t.Role {
+	case RoleAdmin:
+		return true
+	case RoleSubmitter:
+		return role == RoleSubmitter || role == RoleReadOnly
+	}
+	return t.Role == role
+}
+
+// claim prepares j for submission by a client authorized by t.  Fields only
+// the server sets are reset and t is recorded as the token j was submitted
+// with.
+func (t *Token) claim(j *Job) {
+	j.sanitize()
+	if t == nil {
+		return
+	}
+	j.TokenId = t.Id
+	if t.Owner != "" {
+		j.Owner = t.Owner
+	}
+}
+
+// manages returns true if t may cancel and retry j.  Admin tokens manage all
+// jobs, tokens with an owner the jobs of that owner and other tokens the jobs
+// submitted with them.  All jobs can be managed without authentication (nil
+// t).
+func (t *Token) manages(j *Job) bool {
+	switch {
+	case t == nil || t.Role == RoleAdmin:
+		return true
+	case t.Owner != "":
+		return j.Owner == t.Owner
+	}
+	return j.TokenId == t.Id
+}
+
+// CreateToken creates and stores a new API token granting role to owner.
+func (s *Server) CreateToken(owner, role string) (*IssuedToken, error) {
+	it, err := newToken(owner, role)
+	if err != nil {
+		return nil, err
+	}
+	return it, s.alljobs.PutToken(it.Token)
+}
+
+// Tokens returns all API tokens.
+func (s *Server) Tokens() ([]*Token, error) { return s.alljobs.Tokens() }
+
+// RevokeToken deletes the API token with the given id.
+func (s *Server) RevokeToken(id string) error {
+	if _, err := s.alljobs.GetToken(id); err != nil {
+		return fmt.Errorf("unknown token %v", id)
+	}
+	return s.alljobs.DeleteToken(id)
+}
+
+// Authenticate returns the API token with the given secret.
+func (s *Server) Authenticate(secret string) (*Token, error) {
+	if secret == "" {
+		return nil, errBadToken
+	}
+	hash := tokenHash(secret)
+	t, err := s.alljobs.GetToken(hash[:16])
+	if err != nil || subtle.ConstantTimeCompare([]byte(t.Hash), []byte(hash)) != 1 {
+		return nil, errBadToken
+	}
+	return t, nil
+}
+
+// authorize returns the API token with the given secret if it grants any of
+// roles (or just exists if no roles are given).  If s.RequireAuth is false,
+// all requests are authorized and the returned token is nil.
+func (s *Server) authorize(secret string, roles ...string) (*Token, error) {
+	if !s.RequireAuth {
+		return nil, nil
+	}
+
+	t, err := s.Authenticate(secret)
+	if err != nil {
+		return nil, err
+	} else if len(roles) == 0 {
+		return t, nil
+	}
+	for _, role := range roles {
+		if t.grants(role) {
+			return t, nil
+		}
+	}
+	return nil, fmt.Errorf("permission denied: %v token %v needs role %v", t.Role, t.Id, strings.Join(roles, " or "))
+}
+
+type tokenCtxKey struct{}
+
+// guard wraps h to require a token granting read for GET and HEAD requests
+// and write for all other requests.  The authorized token is available to h
+// via reqtoken.
+func (s *Server) guard(read, write string, h http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		role := write
+		if r.Method == "GET" || r.Method == "HEAD" || r.Method == "" {
+			role = read
+		}
+
+		t, err := s.authorize(requestSecret(r), role)
+		if err == errBadToken {
+			// let browsers viewing the dashboard ask for the token
+			w.Header().Set("WWW-Authenticate", `Basic realm="cloudlus"`)
+			httperror(w, err.Error(), http.StatusUnauthorized)
+			return
+		} else if err != nil {
+			httperror(w, err.Error(), http.StatusForbidden)
+			return
+		}
+		h(w, r.WithContext(context.WithValue(r.Context(), tokenCtxKey{}, t)))
+	}
+}
+
+// reqtoken returns the token that authorized r (see guard).
+func reqtoken(r *http.Request) *Token {
+	t, _ := r.Context().Value(tokenCtxKey{}).(*Token)
+	return t
+}
+
+// requestSecret returns the token secret sent as a bearer token or as the
+// password of HTTP basic authentication.
+func requestSecret(r *http.Request) string {
+	if _, pass, ok := r.BasicAuth(); ok {
+		return pass
+	}
+	auth := r.Header.Get("Authorization")
+	if strings.HasPrefix(auth, "Bearer ") {
+		return strings.TrimPrefix(auth, "Bearer ")
+	}
+	return ""
+}
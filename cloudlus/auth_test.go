@@ -0,0 +1,225 @@
+package cloudlus
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestAuth(t *testing.T) {
+	db, _ := NewDB("", dblimit)
+	s := NewServer(testaddr, testaddr, db, nil, nil)
+	nolog(s)
+	s.RequireAuth = true
+	go s.dispatcher()
+	defer s.Close()
+
+	ts := httptest.NewServer(s.handler(ServiceSubmit, ServiceAdmin, ServiceDashboard))
+	defer ts.Close()
+	addr := strings.TrimPrefix(ts.URL, "http://")
+
+	secrets := map[string]string{}
+	for _, role := range Roles {
+		it, err := s.CreateToken(role+"-owner", role)
+		if err != nil {
+			t.Fatal(err)
+		}
+		secrets[role] = it.Secret
+	}
+	if _, err := s.CreateToken("", "superuser"); err == nil {
+		t.Errorf("invalid roles should be rejected")
+	}
+
+	tests := []struct {
+		method, path, role string
+		want               int
+	}{
+		{"GET", "/api/v1/jobs", "", http.StatusUnauthorized},
+		{"GET", "/api/v1/jobs", "bogus", http.StatusUnauthorized},
+		{"GET", "/api/v1/jobs", RoleReadOnly, http.StatusOK},
+		{"GET", "/api/v1/jobs", RoleWorker, http.StatusForbidden},
+		{"POST", "/api/v1/job-infile", RoleReadOnly, http.StatusForbidden},
+		{"POST", "/api/v1/job-infile", RoleSubmitter, http.StatusCreated},
+		{"POST", "/api/v1/reset-queue", RoleSubmitter, http.StatusForbidden},
+		{"POST", "/api/v1/reset-queue", RoleAdmin, http.StatusOK},
+		{"GET", "/api/v1/tokens", RoleSubmitter, http.StatusForbidden},
+		{"GET", "/api/v1/tokens", RoleAdmin, http.StatusOK},
+		{"GET", "/dashboard", RoleReadOnly, http.StatusOK},
+	}
+	for _, test := range tests {
+		req, _ := http.NewRequest(test.method, ts.URL+test.path, strings.NewReader("<simulation/>"))
+		if secret, ok := secrets[test.role]; ok {
+			req.Header.Set("Authorization", "Bearer "+secret)
+		} else if test.role != "" {
+			req.SetBasicAuth("", test.role)
+		}
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+		if resp.StatusCode != test.want {
+			t.Errorf("%v %v with %v token: got status %v, want %v", test.method, test.path, test.role, resp.StatusCode, test.want)
+		}
+	}
+
+	if _, err := Dial(addr); err == nil {
+		t.Errorf("rpc connection without a token should be rejected")
+	}
+
+	sub, err := DialToken(addr, secrets[RoleSubmitter])
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer sub.Close()
+	j := NewJobCmd("echo", "1")
+	j.Owner = "mallory"
+	if err := sub.Submit(j); err != nil {
+		t.Fatal(err)
+	}
+	if got, err := sub.Retrieve(j.Id); err != nil {
+		t.Fatal(err)
+	} else if got.Owner != RoleSubmitter+"-owner" || got.TokenId == "" {
+		t.Errorf("job not claimed by its token: owner %v, token %v", got.Owner, got.TokenId)
+	}
+	if err := sub.DrainAll(); err == nil {
+		t.Errorf("submitter tokens shouldn't be able to drain workers")
+	}
+
+	admin, err := DialToken(addr, secrets[RoleAdmin])
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer admin.Close()
+	ro, _ := s.Authenticate(secrets[RoleReadOnly])
+	if err := admin.RevokeToken(ro.Id); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := DialToken(addr, secrets[RoleReadOnly]); err == nil {
+		t.Errorf("revoked tokens should be rejected")
+	}
+	if toks, err := admin.Tokens(); err != nil || len(toks) != len(Roles)-1 {
+		t.Errorf("got %v tokens after revoking one (err=%v), want %v", len(toks), err, len(Roles)-1)
+	}
+}
+
+func TestAuth_Ownership(t *testing.T) {
+	db, _ := NewDB("", dblimit)
+	s := NewServer(testaddr, testaddr, db, nil, nil)
+	nolog(s)
+	s.RequireAuth = true
+	go s.dispatcher()
+	defer s.Close()
+
+	ts := httptest.NewServer(s.handler(ServiceSubmit))
+	defer ts.Close()
+	addr := strings.TrimPrefix(ts.URL, "http://")
+
+	clients := map[string]*Client{}
+	secrets := map[string]string{}
+	for _, owner := range []string{"alice", "bob", "admin"} {
+		role := RoleSubmitter
+		if owner == "admin" {
+			role = RoleAdmin
+		}
+		it, err := s.CreateToken(owner, role)
+		if err != nil {
+			t.Fatal(err)
+		}
+		c, err := DialToken(addr, it.Secret)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer c.Close()
+		clients[owner], secrets[owner] = c, it.Secret
+	}
+	alice, bob, admin := clients["alice"], clients["bob"], clients["admin"]
+
+	j := NewJobCmd("echo", "1")
+	if err := alice.Submit(j); err != nil {
+		t.Fatal(err)
+	}
+
+	// submitting a job with an existing id must not replace it
+	dup := NewJobCmd("echo", "2")
+	dup.Id = j.Id
+	if err := bob.Submit(dup); err == nil {
+		t.Errorf("rpc submission with an existing job id should be rejected")
+	}
+	data, _ := json.Marshal(dup)
+	req, _ := http.NewRequest("POST", ts.URL+"/api/v1/job", bytes.NewReader(data))
+	req.Header.Set("Authorization", "Bearer "+secrets["bob"])
+	if resp, err := http.DefaultClient.Do(req); err != nil {
+		t.Fatal(err)
+	} else if resp.Body.Close(); resp.StatusCode != http.StatusConflict {
+		t.Errorf("REST submission with an existing job id: got status %v, want %v", resp.StatusCode, http.StatusConflict)
+	}
+	if got := s.Run(dup); got != nil {
+		t.Errorf("Run of a job with an existing id should return nil")
+	}
+	if got, err := s.Get(j.Id); err != nil {
+		t.Fatal(err)
+	} else if got.Owner != "alice" || got.Cmd[1] != "1" {
+		t.Errorf("job overwritten by duplicate submission: owner %v, cmd %v", got.Owner, got.Cmd)
+	}
+
+	// only owners and admins may cancel and retry jobs
+	if err := bob.Cancel(j.Id); err == nil {
+		t.Errorf("other owners shouldn't be able to cancel jobs")
+	}
+	req, _ = http.NewRequest("DELETE", ts.URL+"/api/v1/job/"+j.Id.String(), nil)
+	req.Header.Set("Authorization", "Bearer "+secrets["bob"])
+	if resp, err := http.DefaultClient.Do(req); err != nil {
+		t.Fatal(err)
+	} else if resp.Body.Close(); resp.StatusCode != http.StatusForbidden {
+		t.Errorf("REST cancel by another owner: got status %v, want %v", resp.StatusCode, http.StatusForbidden)
+	}
+	if err := alice.Cancel(j.Id); err != nil {
+		t.Errorf("owners should be able to cancel their jobs: %v", err)
+	}
+	if err := bob.Retry(j.Id); err == nil {
+		t.Errorf("other owners shouldn't be able to retry jobs")
+	}
+	if err := admin.Retry(j.Id); err != nil {
+		t.Errorf("admins should be able to retry all jobs: %v", err)
+	}
+
+	a := NewJobArray(NewJobCmd("echo", "{{.x}}"), []map[string]string{{"x": "1"}, {"x": "2"}})
+	if _, err := alice.SubmitArray(a); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := alice.SubmitArray(a); err == nil {
+		t.Errorf("submission of an existing job array should be rejected")
+	}
+
+	// server-owned fields of submitted jobs are ignored - e.g. jobs can't be
+	// grafted onto the arrays of others
+	forged := NewJobCmd("echo", "3")
+	forged.ArrayId, forged.ArrayIndex = a.Id, 2
+	forged.Status = StatusComplete
+	forged.Attempts = []Attempt{{WorkerId: WorkerId{1}}}
+	forged.RetryBase = -10
+	if err := bob.Submit(forged); err != nil {
+		t.Fatal(err)
+	}
+	if got, err := s.Get(forged.Id); err != nil {
+		t.Fatal(err)
+	} else if got.ArrayId != (JobId{}) || got.Status != StatusQueued || len(got.Attempts) != 0 || got.RetryBase != 0 {
+		t.Errorf("server-owned fields of a submitted job were kept: %+v", got)
+	}
+
+	if _, err := bob.CancelArray(a.Id); err == nil {
+		t.Errorf("other owners shouldn't be able to cancel job arrays")
+	}
+	if st, err := alice.CancelArray(a.Id); err != nil {
+		t.Fatal(err)
+	} else if st.Counts[StatusCanceled] != 2 {
+		t.Errorf("got %v canceled array jobs, want 2", st.Counts[StatusCanceled])
+	}
+	if _, err := bob.RetryArray(a.Id); err == nil {
+		t.Errorf("other owners shouldn't be able to retry job arrays")
+	}
+}
@@ -0,0 +1,170 @@
+package cloudlus
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"math/big"
+	"net"
+	"time"
+)
+
+// CertKey is a certificate along with its private key.
+type CertKey struct {
+	Cert *x509.Certificate
+	Key  *ecdsa.PrivateKey
+}
+
+// NewCA creates a self-signed certificate authority for signing server and
+// worker certificates (see CertKey.Issue).
+func NewCA(name string, validFor time.Duration) (*CertKey, error) {
+	tmpl, key, err := certTemplate(name, validFor)
+	if err != nil {
+		return nil, err
+	}
+	tmpl.IsCA = true
+	tmpl.BasicConstraintsValid = true
+	tmpl.KeyUsage = x509.KeyUsageCertSign | x509.KeyUsageCRLSign | x509.KeyUsageDigitalSignature
+	return signCert(tmpl, tmpl, key, key)
+}
+
+// Issue creates a certificate signed by the certificate authority ca.
+// Certificates with hosts (DNS names or IP addresses) can be used by
+// servers.  All certificates can be used as client certificates - e.g. by
+// workers connecting to a server requiring them (see Server.WorkerCAs).
+func (ca *CertKey) Issue(name string, hosts []string, validFor time.Duration) (*CertKey, error) {
+	tmpl, key, err := certTemplate(name, validFor)
+	if err != nil {
+		return nil, err
+	}
+	tmpl.KeyUsage = x509.KeyUsageDigitalSignature
+	tmpl.ExtKeyUsage = []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth}
+	if len(hosts) > 0 {
+		tmpl.ExtKeyUsage = append(tmpl.ExtKeyUsage, x509.ExtKeyUsageServerAuth)
+	}
+	for _, h := range hosts {
+		if ip := net.ParseIP(h); ip != nil {
+			tmpl.IPAddresses = append(tmpl.IPAddresses, ip)
+		} else {
+			tmpl.DNSNames = append(tmpl.DNSNames, h)
+		}
+	}
+	return signCert(tmpl, ca.Cert, key, ca.Key)
+}
+
+func certTemplate(name string, validFor time.Duration) (*x509.Certificate, *ecdsa.PrivateKey, error) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return nil, nil, err
+	}
+	serial, err := rand.Int(rand.Reader, new(big.Int).Lsh(big.NewInt(1), 128))
+	if err != nil {
+		return nil, nil, err
+	}
+	now := time.Now()
+	tmpl := &x509.Certificate{
+		SerialNumber: serial,
+		Subject:      pkix.Name{Organization: []string{"cloudlus"}, CommonName: name},
+		NotBefore:    now.Add(-time.Hour),
+		NotAfter:     now.Add(validFor),
+	}
+	return tmpl, key, nil
+}
+
+func signCert(tmpl, parent *x509.Certificate, key, parentkey *ecdsa.PrivateKey) (*CertKey, error) {
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, parent, &key.PublicKey, parentkey)
+	if err != nil {
+		return nil, err
+	}
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		return nil, err
+	}
+	return &CertKey{Cert: cert, Key: key}, nil
+}
+
+// TLSCertificate returns ck for use in a tls.Config.
+func (ck *CertKey) TLSCertificate() tls.Certificate {
+	return tls.Certificate{Certificate: [][]byte{ck.Cert.Raw}, PrivateKey: ck.Key, Leaf: ck.Cert}
+}
+
+// WriteFiles writes the PEM-encoded certificate to certfile and its private
+// key to keyfile (readable only by the current user).
+func (ck *CertKey) WriteFiles(certfile, keyfile string) error {
+	der, err := x509.MarshalECPrivateKey(ck.Key)
+	if err != nil {
+		return err
+	}
+	keypem := pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: der})
+	if err := ioutil.WriteFile(keyfile, keypem, 0600); err != nil {
+		return err
+	}
+	certpem := pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: ck.Cert.Raw})
+	return ioutil.WriteFile(certfile, certpem, 0644)
+}
+
+// LoadCertKey reads a certificate and its private key written by
+// CertKey.WriteFiles.
+func LoadCertKey(certfile, keyfile string) (*CertKey, error) {
+	pair, err := tls.LoadX509KeyPair(certfile, keyfile)
+	if err != nil {
+		return nil, err
+	}
+	key, ok := pair.PrivateKey.(*ecdsa.PrivateKey)
+	if !ok {
+		return nil, fmt.Errorf("%v: only ECDSA keys are supported", keyfile)
+	}
+	cert, err := x509.ParseCertificate(pair.Certificate[0])
+	if err != nil {
+		return nil, err
+	}
+	return &CertKey{Cert: cert, Key: key}, nil
+}
+
+// LoadCertPool reads the PEM-encoded certificates in files.
+func LoadCertPool(files ...string) (*x509.CertPool, error) {
+	pool := x509.NewCertPool()
+	for _, fname := range files {
+		data, err := ioutil.ReadFile(fname)
+		if err != nil {
+			return nil, err
+		} else if !pool.AppendCertsFromPEM(data) {
+			return nil, fmt.Errorf("no PEM certificates found in %v", fname)
+		}
+	}
+	return pool, nil
+}
+
+// ClientTLS returns the TLS config for clients trusting the certificate
+// authority in the PEM file cafile to sign the server's certificate (or the
+// system's root certificates if cafile is empty).  If certfile and keyfile
+// are given, their certificate is presented to the server - e.g. by workers
+// connecting to a server requiring client certificates.
+func ClientTLS(cafile, certfile, keyfile string) (*tls.Config, error) {
+	config := &tls.Config{}
+	if cafile != "" {
+		pool, err := LoadCertPool(cafile)
+		if err != nil {
+			return nil, err
+		}
+		config.RootCAs = pool
+	}
+
+	if (certfile == "") != (keyfile == "") {
+		return nil, errors.New("client certificates need both a certificate and a key file")
+	} else if certfile != "" {
+		pair, err := tls.LoadX509KeyPair(certfile, keyfile)
+		if err != nil {
+			return nil, err
+		}
+		config.Certificates = []tls.Certificate{pair}
+	}
+	return config, nil
+}
@@ -0,0 +1,137 @@
+package cloudlus
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"io/ioutil"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestTLS(t *testing.T) {
+	ca, err := NewCA("test CA", time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+	servcert, _ := ca.Issue("server", []string{"127.0.0.1"}, time.Hour)
+	workcert, _ := ca.Issue("worker", nil, time.Hour)
+	other, _ := NewCA("other CA", time.Hour)
+	forged, _ := other.Issue("worker", nil, time.Hour)
+
+	roots := x509.NewCertPool()
+	roots.AddCert(ca.Cert)
+
+	db, _ := NewDB("", dblimit)
+	s := NewServer(testaddr, testaddr, db, nil, nil)
+	nolog(s)
+	s.TLS = &tls.Config{Certificates: []tls.Certificate{servcert.TLSCertificate()}}
+	s.WorkerCAs = roots
+	go s.dispatcher()
+	defer s.Close()
+
+	start := func(services ...string) string {
+		ts := httptest.NewUnstartedServer(s.handler(services...))
+		ts.TLS = s.tlsConfig(services...)
+		ts.StartTLS()
+		t.Cleanup(ts.Close)
+		return strings.TrimPrefix(ts.URL, "https://")
+	}
+	shared := start(ServiceSubmit, ServiceWorker)
+	workonly := start(ServiceWorker)
+
+	config := func(ck *CertKey) *tls.Config {
+		c := &tls.Config{RootCAs: roots}
+		if ck != nil {
+			c.Certificates = []tls.Certificate{ck.TLSCertificate()}
+		}
+		return c
+	}
+
+	if _, err := DialToken("https://"+shared, ""); err == nil {
+		t.Errorf("server certificate signed by an untrusted CA accepted")
+	}
+	if _, err := Dial(shared); err == nil {
+		t.Errorf("plain connection to a TLS listener succeeded")
+	}
+
+	sub, err := DialTLS(shared, "", config(nil))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer sub.Close()
+	j := NewJobCmd("echo", "1")
+	if err := sub.Submit(j); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := sub.Fetch(&Worker{Id: WorkerId{1}}); err == nil || !strings.Contains(err.Error(), "certificate") {
+		t.Errorf("job fetched without a worker certificate (err=%v)", err)
+	}
+	if err := sub.PushOutfile(WorkerId{1}, j.Id, strings.NewReader("junk")); err == nil || !strings.Contains(err.Error(), "certificate") {
+		t.Errorf("output uploaded without a worker certificate (err=%v)", err)
+	}
+
+	if c, err := DialTLS(shared, "", config(forged)); err == nil {
+		if _, err := c.Fetch(&Worker{Id: WorkerId{1}}); err == nil {
+			t.Errorf("job fetched with a certificate signed by an untrusted CA")
+		}
+		c.Close()
+	}
+	if c, err := DialTLS(workonly, "", config(nil)); err == nil {
+		if _, err := c.Fetch(&Worker{Id: WorkerId{1}}); err == nil {
+			t.Errorf("worker-only listener accepted a connection without a client certificate")
+		}
+		c.Close()
+	}
+
+	w, err := DialTLS(workonly, "", config(workcert))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer w.Close()
+	if got, err := w.Fetch(&Worker{Id: WorkerId{1}}); err != nil {
+		t.Fatal(err)
+	} else if got.Id != j.Id {
+		t.Errorf("worker fetched job %v, want %v", got.Id, j.Id)
+	}
+}
+
+func TestCertFiles(t *testing.T) {
+	dir, err := ioutil.TempDir("", "cloudlus-certs")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	ca, _ := NewCA("test CA", time.Hour)
+	ck, _ := ca.Issue("worker", nil, time.Hour)
+	cafile, certfile, keyfile := filepath.Join(dir, "ca.pem"), filepath.Join(dir, "w.pem"), filepath.Join(dir, "w-key.pem")
+	if err := ca.WriteFiles(cafile, filepath.Join(dir, "ca-key.pem")); err != nil {
+		t.Fatal(err)
+	} else if err := ck.WriteFiles(certfile, keyfile); err != nil {
+		t.Fatal(err)
+	}
+
+	if info, err := os.Stat(keyfile); err != nil || info.Mode().Perm() != 0600 {
+		t.Errorf("private key file not restricted to its owner: %v (err=%v)", info.Mode(), err)
+	}
+	got, err := LoadCertKey(certfile, keyfile)
+	if err != nil {
+		t.Fatal(err)
+	} else if got.Cert.Subject.CommonName != "worker" {
+		t.Errorf("loaded wrong certificate %v", got.Cert.Subject)
+	}
+
+	config, err := ClientTLS(cafile, certfile, keyfile)
+	if err != nil {
+		t.Fatal(err)
+	} else if len(config.Certificates) != 1 || config.RootCAs == nil {
+		t.Errorf("client TLS config incomplete: %+v", config)
+	}
+	if _, err := ClientTLS(cafile, certfile, ""); err == nil {
+		t.Errorf("client certificates without a key should be rejected")
+	}
+}
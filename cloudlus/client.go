@@ -1,34 +1,160 @@
 package cloudlus
 
 import (
+	"bufio"
 	"bytes"
+	"context"
+	"crypto/tls"
+	"errors"
+	"fmt"
 	"io"
 	"io/ioutil"
 	"log"
+	"net"
 	"net/http"
 	"net/rpc"
 	"strings"
+	"sync"
 	"time"
 )
 
+// maxRedialDelay is the longest time a client waits between attempts to
+// reconnect to the server.
+const maxRedialDelay = 30 * time.Second
+
 type Client struct {
-	client *rpc.Client
-	err    error
-	addr   string
+	mu      sync.Mutex
+	client  *rpc.Client
+	err     error
+	addr    string
+	rpcaddr string
+	// token is the secret of the API token presented to the server.
+	token string
+	// tls is the config for connecting to the server over TLS or nil.
+	tls   *tls.Config
+	httpc *http.Client
+}
+
+// Dial connects to the server at addr without an API token.
+func Dial(addr string) (*Client, error) { return DialToken(addr, "") }
+
+// DialToken connects to the server at addr presenting the API token with
+// the given secret with every request.  Addresses starting with "https://"
+// are connected to over TLS trusting the system's root certificates.
+func DialToken(addr, token string) (*Client, error) { return DialTLS(addr, token, nil) }
+
+// DialTLS is like DialToken but connects to the server over TLS with the
+// given config if it is not nil - e.g. to trust a private certificate
+// authority or present a worker's client certificate (see ClientTLS).
+func DialTLS(addr, token string, config *tls.Config) (*Client, error) {
+	scheme, defport := "http", ":80"
+	if strings.HasPrefix(addr, "https://") || config != nil {
+		scheme, defport = "https", ":443"
+		if config == nil {
+			config = &tls.Config{}
+		}
+	}
+	rpcaddr := strings.TrimPrefix(strings.TrimPrefix(addr, "http://"), "https://")
+	if !strings.Contains(rpcaddr, ":") {
+		rpcaddr += defport
+	}
+
+	client, err := dialHTTP(rpcaddr, token, config)
+	if err != nil {
+		return nil, err
+	}
+
+	httpc := http.DefaultClient
+	if config != nil {
+		t := http.DefaultTransport.(*http.Transport).Clone()
+		t.TLSClientConfig = config
+		httpc = &http.Client{Transport: t}
+	}
+	return &Client{
+		client:  client,
+		addr:    scheme + "://" + rpcaddr,
+		rpcaddr: rpcaddr,
+		token:   token,
+		tls:     config,
+		httpc:   httpc,
+	}, nil
 }
 
-func Dial(addr string) (*Client, error) {
-	if !strings.Contains(addr, ":") {
-		addr += ":80"
+// dialHTTP is like rpc.DialHTTP but sends token with the CONNECT request and
+// connects over TLS if config is not nil.
+func dialHTTP(addr, token string, config *tls.Config) (*rpc.Client, error) {
+	var conn net.Conn
+	var err error
+	if config != nil {
+		conn, err = tls.Dial("tcp", addr, config)
+	} else {
+		conn, err = net.Dial("tcp", addr)
 	}
-	client, err := rpc.DialHTTP("tcp", addr)
 	if err != nil {
 		return nil, err
 	}
-	if !strings.HasPrefix(addr, "http://") {
-		addr = "http://" + addr
+
+	req := "CONNECT " + rpc.DefaultRPCPath + " HTTP/1.0\n"
+	if token != "" {
+		req += "Authorization: Bearer " + token + "\n"
+	}
+	io.WriteString(conn, req+"\n")
+
+	resp, err := http.ReadResponse(bufio.NewReader(conn), &http.Request{Method: "CONNECT"})
+	if err == nil && resp.Status == connected {
+		return rpc.NewClient(conn), nil
+	} else if err == nil {
+		msg, _ := ioutil.ReadAll(resp.Body)
+		err = fmt.Errorf("unexpected HTTP response: %v: %s", resp.Status, bytes.TrimSpace(msg))
 	}
-	return &Client{client: client, addr: addr}, nil
+	conn.Close()
+	return nil, &net.OpError{Op: "dial-http", Net: "tcp " + addr, Err: err}
+}
+
+// do sends an HTTP request for path to the server with the client's API
+// token.  Error responses are returned as errors.
+func (c *Client) do(method, path string, body io.Reader) (*http.Response, error) {
+	req, err := http.NewRequest(method, c.addr+path, body)
+	if err != nil {
+		return nil, err
+	}
+	if c.token != "" {
+		req.Header.Set("Authorization", "Bearer "+c.token)
+	}
+
+	resp, err := c.httpc.Do(req)
+	if err != nil {
+		return nil, err
+	} else if resp.StatusCode >= 400 {
+		defer resp.Body.Close()
+		msg, _ := ioutil.ReadAll(resp.Body)
+		return nil, errors.New(string(bytes.TrimSpace(msg)))
+	}
+	return resp, nil
+}
+
+// conn returns the client's current rpc connection.
+func (c *Client) conn() *rpc.Client {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.client
+}
+
+// redial replaces the broken rpc connection old with a new one unless that
+// already happened.
+func (c *Client) redial(old *rpc.Client) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.client != old {
+		return nil
+	}
+	client, err := dialHTTP(c.rpcaddr, c.token, c.tls)
+	if err != nil {
+		return err
+	}
+	old.Close()
+	c.client = client
+	return nil
 }
 
 func (c *Client) Heartbeat(w WorkerId, j JobId, done chan struct{}) (kill chan bool) {
@@ -40,7 +166,7 @@ func (c *Client) Heartbeat(w WorkerId, j JobId, done chan struct{}) (kill chan b
 			select {
 			case <-tick.C:
 				var killval bool
-				err := c.client.Call("RPC.Heartbeat", NewBeat(w, j), &killval)
+				err := c.conn().Call("Worker.Heartbeat", NewBeat(w, j), &killval)
 				if err != nil {
 					log.Print(err)
 					return
@@ -56,24 +182,160 @@ func (c *Client) Heartbeat(w WorkerId, j JobId, done chan struct{}) (kill chan b
 	return kill
 }
 
+// StreamLog returns a writer whose contents are sent to the server as the
+// output of job j running on worker w every logInterval until done is
+// closed.  Remaining output is sent before the returned flushed channel is
+// closed.
+func (c *Client) StreamLog(w WorkerId, j JobId, done chan struct{}) (out io.Writer, flushed chan struct{}) {
+	ls := &logStreamer{}
+	flushed = make(chan struct{})
+	go func() {
+		defer close(flushed)
+		tick := time.NewTicker(logInterval)
+		defer tick.Stop()
+
+		send := func() error {
+			data := ls.take()
+			if len(data) == 0 {
+				return nil
+			}
+			var unused int
+			chunk := LogChunk{JobId: j, WorkerId: w, Data: data}
+			return c.conn().Call("Worker.AppendLog", chunk, &unused)
+		}
+
+		for {
+			select {
+			case <-tick.C:
+				if err := send(); err != nil {
+					log.Print(err)
+					return
+				}
+			case <-done:
+				if err := send(); err != nil {
+					log.Print(err)
+				}
+				return
+			}
+		}
+	}()
+	return ls, flushed
+}
+
+// Log returns the output of job j following offset.  If no output is
+// available yet, Log waits up to wait for more to arrive.
+func (c *Client) Log(j JobId, offset int64, wait time.Duration) (*LogChunk, error) {
+	chunk := &LogChunk{}
+	err := c.conn().Call("Submit.Log", LogRequest{JobId: j, Offset: offset, Wait: wait}, chunk)
+	if err != nil {
+		return nil, err
+	}
+	return chunk, nil
+}
+
+// CopyLog writes the output of job j to w.  If follow is true, CopyLog keeps
+// writing new output as it arrives until the job finishes.
+func (c *Client) CopyLog(w io.Writer, j JobId, follow bool) error {
+	var offset int64
+	for {
+		var wait time.Duration
+		if follow {
+			wait = maxLogWait
+		}
+		chunk, err := c.Log(j, offset, wait)
+		if err != nil {
+			return err
+		}
+		if _, err := w.Write(chunk.Data); err != nil {
+			return err
+		}
+		offset = chunk.Next()
+		if !follow || chunk.Done {
+			return nil
+		}
+	}
+}
+
 func (c *Client) Retrieve(j JobId) (*Job, error) {
 	var result *Job
-	err := c.client.Call("RPC.Retrieve", j, &result)
+	err := c.conn().Call("Submit.Retrieve", j, &result)
 	if err != nil {
 		return nil, err
 	}
-	return result, nil
+	return result, c.ResolveInfiles(result, nil)
 }
 
-func (c *Client) PushOutfile(j JobId, r io.Reader) error {
-	path := "/api/v1/job-outfiles/" + j.String()
+// uploadInfiles uploads the contents of j's input files to the server's blob
+// store unless the server already has them.  It returns a copy of j with the
+// input files replaced by references to the blobs along with the uploaded
+// data by hash.
+func (c *Client) uploadInfiles(j *Job) (*Job, map[string][]byte, error) {
+	blobs := map[string][]byte{}
+	hashes := []string{}
+	files := make([]File, len(j.Infiles))
+	for i, f := range j.Infiles {
+		files[i] = f
+		if f.Data == nil && f.Hash != "" {
+			continue
+		}
+		files[i] = File{Name: f.Name, Size: len(f.Data), Hash: blobHash(f.Data)}
+		blobs[files[i].Hash] = f.Data
+		hashes = append(hashes, files[i].Hash)
+	}
 
-	req, err := http.NewRequest("POST", c.addr+path, r)
-	if err != nil {
-		return err
+	var missing []string
+	if len(hashes) > 0 {
+		if err := c.conn().Call("Submit.MissingBlobs", hashes, &missing); err != nil {
+			return nil, nil, err
+		}
+	}
+
+	for _, h := range missing {
+		var unused string
+		if err := c.conn().Call("Submit.PutBlob", blobs[h], &unused); err != nil {
+			return nil, nil, err
+		}
+	}
+
+	clone := *j
+	clone.Infiles = files
+	return &clone, blobs, nil
+}
+
+// GetBlob returns the contents of the blob with the given hash from the
+// server's blob store.
+func (c *Client) GetBlob(hash string) ([]byte, error) {
+	var data []byte
+	if err := c.conn().Call("Blob.GetBlob", hash, &data); err != nil {
+		return nil, err
+	}
+	return data, nil
+}
+
+// ResolveInfiles fills in the data of all of j's input files that refer to
+// blobs in the server's blob store.  Blobs found in known (by hash) are not
+// retrieved from the server.
+func (c *Client) ResolveInfiles(j *Job, known map[string][]byte) error {
+	for i, f := range j.Infiles {
+		if f.Data != nil || f.Hash == "" {
+			continue
+		}
+
+		data, ok := known[f.Hash]
+		if !ok {
+			var err error
+			if data, err = c.GetBlob(f.Hash); err != nil {
+				return err
+			}
+		}
+		j.Infiles[i].Data = data
 	}
+	return nil
+}
 
-	resp, err := http.DefaultClient.Do(req)
+// PushOutfile uploads the output data of job j running on worker wid.
+func (c *Client) PushOutfile(wid WorkerId, j JobId, r io.Reader) error {
+	resp, err := c.do("POST", "/api/v1/job-outfiles/"+j.String()+"?worker="+wid.String(), r)
 	if err != nil {
 		return err
 	}
@@ -81,8 +343,7 @@ func (c *Client) PushOutfile(j JobId, r io.Reader) error {
 }
 
 func (c *Client) RetrieveOutfile(j JobId) (io.ReadCloser, error) {
-	path := "/api/v1/job-outfiles/" + j.String()
-	resp, err := http.Get(c.addr + path)
+	resp, err := c.do("GET", "/api/v1/job-outfiles/"+j.String(), nil)
 	if err != nil {
 		return nil, err
 	}
@@ -90,8 +351,7 @@ func (c *Client) RetrieveOutfile(j JobId) (io.ReadCloser, error) {
 }
 
 func (c *Client) RetrieveOutfileData(j *Job, fname string) ([]byte, error) {
-	path := "/api/v1/job-outfiles/" + j.Id.String()
-	resp, err := http.Get(c.addr + path)
+	resp, err := c.do("GET", "/api/v1/job-outfiles/"+j.Id.String(), nil)
 	if err != nil {
 		return nil, err
 	}
@@ -112,8 +372,117 @@ func (c *Client) RetrieveOutfileData(j *Job, fname string) ([]byte, error) {
 }
 
 func (c *Client) Submit(j *Job) error {
+	j, _, err := c.uploadInfiles(j)
+	if err != nil {
+		return err
+	}
+	var unused int
+	return c.conn().Call("Submit.SubmitAsync", j, &unused)
+}
+
+// Cancel cancels the job with the given id.  Queued jobs will never run and
+// running jobs are killed.
+func (c *Client) Cancel(j JobId) error {
+	var unused int
+	return c.conn().Call("Submit.Cancel", j, &unused)
+}
+
+// Retry requeues the failed or canceled job with the given id.
+func (c *Client) Retry(j JobId) error {
 	var unused int
-	return c.client.Call("RPC.SubmitAsync", j, &unused)
+	return c.conn().Call("Submit.Retry", j, &unused)
+}
+
+// SubmitArray submits the job array a to be expanded into its child jobs by
+// the server.
+func (c *Client) SubmitArray(a *JobArray) (*ArrayStat, error) {
+	tmpl, _, err := c.uploadInfiles(a.Template)
+	if err != nil {
+		return nil, err
+	}
+	sub := *a
+	sub.Template = tmpl
+
+	st := &ArrayStat{}
+	if err := c.conn().Call("Submit.SubmitArray", &sub, st); err != nil {
+		return nil, err
+	}
+	return st, nil
+}
+
+// Array returns the progress of the job array with the given id.
+func (c *Client) Array(id JobId) (*ArrayStat, error) {
+	st := &ArrayStat{}
+	if err := c.conn().Call("Submit.Array", id, st); err != nil {
+		return nil, err
+	}
+	return st, nil
+}
+
+// CancelArray cancels all unfinished jobs of the job array with the given
+// id.
+func (c *Client) CancelArray(id JobId) (*ArrayStat, error) {
+	st := &ArrayStat{}
+	if err := c.conn().Call("Submit.CancelArray", id, st); err != nil {
+		return nil, err
+	}
+	return st, nil
+}
+
+// RetryArray requeues all failed and canceled jobs of the job array with
+// the given id.
+func (c *Client) RetryArray(id JobId) (*ArrayStat, error) {
+	st := &ArrayStat{}
+	if err := c.conn().Call("Submit.RetryArray", id, st); err != nil {
+		return nil, err
+	}
+	return st, nil
+}
+
+// Wait blocks until the job with the given id has finished and returns it.
+// If the connection to the server drops (e.g. because the server restarted),
+// Wait reconnects and resumes waiting until ctx is done.
+func (c *Client) Wait(ctx context.Context, j JobId) (*Job, error) {
+	return c.wait(ctx, j, nil)
+}
+
+// wait is like Wait but doesn't retrieve the blobs in known (by hash) when
+// resolving the finished job's input files.
+func (c *Client) wait(ctx context.Context, j JobId, known map[string][]byte) (*Job, error) {
+	delay := time.Second
+	for {
+		client := c.conn()
+		var result *Job
+		call := client.Go("Submit.Wait", WaitRequest{JobId: j, Wait: maxJobWait}, &result, make(chan *rpc.Call, 1))
+		select {
+		case <-call.Done:
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		}
+
+		if _, ok := call.Error.(rpc.ServerError); ok {
+			return nil, call.Error
+		} else if call.Error != nil {
+			log.Printf("waiting for job %v: %v (reconnecting in %v)", j, call.Error, delay)
+			select {
+			case <-time.After(delay):
+			case <-ctx.Done():
+				return nil, ctx.Err()
+			}
+			if delay *= 2; delay > maxRedialDelay {
+				delay = maxRedialDelay
+			}
+			if err := c.redial(client); err != nil {
+				log.Print(err)
+			}
+			continue
+		}
+
+		delay = time.Second
+		if result.Done() {
+			return result, c.ResolveInfiles(result, known)
+		}
+	}
 }
 
 func (c *Client) Run(j *Job) (*Job, error) {
@@ -130,15 +499,24 @@ func (c *Client) Err() error { return c.err }
 // Start submits j and returns a channel where the completed job can be
 // retrieved from.  If the the program doesn't block on the channel, there is
 // no guarantee that the job will be submitted.  For asynchronous submission,
-// use the Submit method.
+// use the Submit method.  Once submitted, Start waits for j like Wait does so
+// the result isn't lost if the connection to the server drops.
 func (c *Client) Start(j *Job, ch chan *Job) chan *Job {
 	if ch == nil {
 		ch = make(chan *Job, 1)
 	}
 
 	go func() {
-		result := &Job{}
-		c.err = c.client.Call("RPC.Submit", j, &result)
+		var result *Job
+		sub, blobs, err := c.uploadInfiles(j)
+		if err == nil {
+			var unused int
+			err = c.conn().Call("Submit.SubmitAsync", sub, &unused)
+		}
+		if err == nil {
+			result, err = c.wait(context.Background(), j.Id, blobs)
+		}
+		c.err = err
 		if c.err != nil {
 			ch <- nil
 		} else {
@@ -150,16 +528,102 @@ func (c *Client) Start(j *Job, ch chan *Job) chan *Job {
 
 func (c *Client) Fetch(w *Worker) (*Job, error) {
 	j := &Job{}
-	err := c.client.Call("RPC.Fetch", w.Id, &j)
-	if err != nil {
+	err := c.conn().Call("Worker.Fetch", w.info(), &j)
+	if err != nil && err.Error() == drainerr.Error() {
+		return nil, drainerr
+	} else if err != nil {
 		return nil, err
 	}
 	return j, nil
 }
 
+// Release hands job jid back to the server to be requeued immediately
+// because worker wid is draining.
+func (c *Client) Release(wid WorkerId, jid JobId) error {
+	var unused int
+	return c.conn().Call("Worker.Release", NewBeat(wid, jid), &unused)
+}
+
+// Drain asks the worker with the given id to shut down after finishing its
+// running jobs.
+func (c *Client) Drain(wid WorkerId) error {
+	var unused int
+	return c.conn().Call("Admin.Drain", wid, &unused)
+}
+
+// DrainAll asks all workers to shut down after finishing their running jobs.
+func (c *Client) DrainAll() error {
+	var unused int
+	return c.conn().Call("Admin.DrainAll", 0, &unused)
+}
+
+// List returns a page of jobs matching q.  Further pages are retrieved by
+// setting q.Cursor to the returned page's Next cursor.
+func (c *Client) List(q Query) (*JobPage, error) {
+	page := &JobPage{}
+	if err := c.conn().Call("Submit.List", q, page); err != nil {
+		return nil, err
+	}
+	return page, nil
+}
+
+// Workers returns the status of all workers known to the server.
+func (c *Client) Workers() ([]WorkerStat, error) {
+	var ws []WorkerStat
+	if err := c.conn().Call("Submit.Workers", 0, &ws); err != nil {
+		return nil, err
+	}
+	return ws, nil
+}
+
+// Events returns up to limit events of all jobs following the event with
+// sequence number since - oldest first.  If limit is zero, at most
+// DefaultEventLimit events are returned.
+func (c *Client) Events(since uint64, limit int) ([]*Event, error) {
+	var events []*Event
+	if err := c.conn().Call("Submit.Events", EventRequest{Since: since, Limit: limit}, &events); err != nil {
+		return nil, err
+	}
+	return events, nil
+}
+
+// JobEvents returns all events of the job with the given id - oldest first.
+func (c *Client) JobEvents(j JobId) ([]*Event, error) {
+	var events []*Event
+	if err := c.conn().Call("Submit.JobEvents", j, &events); err != nil {
+		return nil, err
+	}
+	return events, nil
+}
+
+// CreateToken creates a new API token granting role to owner.  The returned
+// token's secret is only available now.
+func (c *Client) CreateToken(owner, role string) (*IssuedToken, error) {
+	it := &IssuedToken{}
+	if err := c.conn().Call("Admin.CreateToken", Token{Owner: owner, Role: role}, it); err != nil {
+		return nil, err
+	}
+	return it, nil
+}
+
+// Tokens returns all API tokens known to the server.
+func (c *Client) Tokens() ([]*Token, error) {
+	var ts []*Token
+	if err := c.conn().Call("Admin.Tokens", 0, &ts); err != nil {
+		return nil, err
+	}
+	return ts, nil
+}
+
+// RevokeToken deletes the API token with the given id.
+func (c *Client) RevokeToken(id string) error {
+	var unused int
+	return c.conn().Call("Admin.RevokeToken", id, &unused)
+}
+
 func (c *Client) Push(w *Worker, j *Job) error {
 	var unused int
-	return c.client.Call("RPC.Push", j, &unused)
+	return c.conn().Call("Worker.Push", j, &unused)
 }
 
-func (c *Client) Close() error { return c.client.Close() }
+func (c *Client) Close() error { return c.conn().Close() }
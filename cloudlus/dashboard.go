@@ -5,25 +5,31 @@ import (
 	"html/template"
 	"net/http"
 	"sort"
+	"syscall"
 	"time"
 )
 
 var dashtmplstr = `
 <table>
-    <tr><th>Job ID</th><th>Status</th><th>Output</th></tr>
+    <tr><th>Job ID</th><th>Owner</th><th>Status</th><th>Attempts</th><th>Output</th></tr>
 
     {{ range $job := .}}
     <tr class="status-{{$job.Status}}">
         <td><a href="{{$job.Host}}/dashboard/infile/{{$job.Id}}">{{$job.Id}}</a></td>
+        <td>{{$job.Owner}}</td>
 
         {{if eq $job.Status "complete"}}
         <td><a href="{{$job.Host}}/dashboard/output/{{$job.Id}}">{{$job.Status}}</a></td>
         {{else if eq $job.Status "failed"}}
+        <td><a href="{{$job.Host}}/dashboard/output/{{$job.Id}}">{{$job.Status}}</a>{{if $job.FailReason}} ({{$job.FailReason}}){{end}}</td>
+        {{else if eq $job.Status "canceled"}}
         <td><a href="{{$job.Host}}/dashboard/output/{{$job.Id}}">{{$job.Status}}</a></td>
 		{{else}}
         <td>{{$job.Status}}</td>
         {{end}}
 
+        <td>{{$job.Attempts}}</td>
+
         {{if eq $job.Status "complete"}}
         <td><a href="{{$job.Host}}/api/v1/job-outfiles/{{$job.Id}}">Results</a></td>
         {{else}}
@@ -33,17 +39,40 @@ var dashtmplstr = `
     {{ end }}
 </table>
 `
+
+var workerstmplstr = `
+<table>
+    <tr><th>Worker ID</th><th>Host</th><th>Labels</th><th>Running</th><th>Completed</th><th>Failed</th><th>Uptime</th><th>Last Seen</th></tr>
+
+    {{ range $w := .}}
+    <tr>
+        <td>{{$w.Id}}</td>
+        <td>{{$w.Host}}{{if $w.Draining}} (draining){{end}}</td>
+        <td>{{range $i, $l := $w.Labels}}{{if $i}}, {{end}}{{$l}}{{end}}</td>
+        <td>{{range $w.Jobs}}{{.}}<br>{{end}}</td>
+        <td>{{$w.NCompleted}}</td>
+        <td>{{$w.NFailed}}</td>
+        <td>{{$w.Uptime}}</td>
+        <td>{{$w.LastSeen.Format "Jan _2 15:04:05"}}</td>
+    </tr>
+    {{ end }}
+</table>
+`
 var tmpl = template.Must(template.New("dashtable").Parse(dashtmplstr))
+var workerstmpl = template.Must(template.New("workers").Parse(workerstmplstr))
 var hometmpl = template.Must(template.New("home").Parse(home))
 var resettmpl = template.Must(template.New("reset").Parse(resetPage))
 
 const ncompleted = 100
 
 type JobData struct {
-	Id        string
-	Status    string
-	Submitted time.Time
-	Host      string
+	Id         string
+	Status     string
+	FailReason string
+	Owner      string
+	Attempts   int
+	Submitted  time.Time
+	Host       string
 }
 
 type JobList []*Job
@@ -64,10 +93,13 @@ func (s *Server) dashboard(w http.ResponseWriter, r *http.Request) {
 	jds := []JobData{}
 	for _, j := range jobs {
 		jd := JobData{
-			Id:        fmt.Sprintf("%v", j.Id),
-			Status:    j.Status,
-			Submitted: j.Submitted,
-			Host:      s.Host,
+			Id:         fmt.Sprintf("%v", j.Id),
+			Status:     j.Status,
+			FailReason: j.FailReason,
+			Owner:      j.Owner,
+			Attempts:   len(j.Attempts),
+			Submitted:  j.Submitted,
+			Host:       s.Host,
 		}
 		jds = append(jds, jd)
 	}
@@ -79,6 +111,18 @@ func (s *Server) dashboard(w http.ResponseWriter, r *http.Request) {
 	}
 }
 
+func (s *Server) dashboardWorkers(w http.ResponseWriter, r *http.Request) {
+	ws := s.Workers()
+	for i := range ws {
+		ws[i].Uptime -= ws[i].Uptime % time.Second
+	}
+
+	w.Header().Add("Access-Control-Allow-Origin", "*")
+	if err := workerstmpl.Execute(w, ws); err != nil {
+		httperror(w, err.Error(), http.StatusInternalServerError)
+	}
+}
+
 func (s *Server) dashmain(w http.ResponseWriter, r *http.Request) {
 	w.Header().Add("Access-Control-Allow-Origin", "*")
 	err := hometmpl.Execute(w, s)
@@ -110,8 +154,15 @@ func (s *Server) dashboardInfile(w http.ResponseWriter, r *http.Request) {
 	w.Header().Add("Content-Disposition", fmt.Sprintf("filename=\"job-id-%v-infile.xml\"", j.Id))
 	if len(j.Infiles) == 0 {
 		fmt.Fprint(w, "[job contains no input data]")
+	} else if f := j.Infiles[0]; f.Data == nil && f.Hash != "" {
+		data, err := s.alljobs.GetBlob(f.Hash)
+		if err != nil {
+			httperror(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		w.Write(data)
 	} else {
-		w.Write(j.Infiles[0].Data)
+		w.Write(f.Data)
 	}
 }
 
@@ -123,15 +174,72 @@ func (s *Server) dashboardOutput(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	_, err = w.Write([]byte(j.Stdout))
-	if err != nil {
-		httperror(w, err.Error(), http.StatusInternalServerError)
-		return
+	if !j.Done() {
+		// live-update with the output of unfinished jobs until they finish
+		w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+		if err := s.writeLog(w, r, j.Id, 0, true); err != nil {
+			s.log.Print(err)
+			return
+		}
+		if j, err = s.alljobs.Get(j.Id); err != nil {
+			s.log.Print(err)
+			return
+		}
+	} else {
+		_, err = w.Write([]byte(j.Stdout))
+		if err != nil {
+			httperror(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		_, err = w.Write([]byte(j.Stderr))
+		if err != nil {
+			httperror(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
 	}
-	_, err = w.Write([]byte(j.Stderr))
+
+	if len(j.Attempts) > 0 {
+		fmt.Fprintf(w, "\n---------- attempt history ----------\n")
+	}
+	for i, a := range j.Attempts {
+		status := a.Status
+		if a.FailReason != "" {
+			status += " (" + a.FailReason + ")"
+		}
+		fmt.Fprintf(w, "attempt %v: worker %v, started %v, finished %v, %v\n",
+			i+1, a.WorkerId, a.Started.Format(time.Stamp), a.Finished.Format(time.Stamp), status)
+	}
+	if j.Status == StatusFailed && j.FailReason != "" {
+		fmt.Fprintf(w, "failed: %v, exit code %v", j.FailReason, j.ExitCode)
+		if j.Signal != 0 {
+			fmt.Fprintf(w, ", signal %v", syscall.Signal(j.Signal))
+		}
+		fmt.Fprintln(w)
+	}
+
+	events, err := s.alljobs.JobEvents(j.Id)
 	if err != nil {
-		httperror(w, err.Error(), http.StatusInternalServerError)
+		s.log.Print(err)
 		return
+	} else if len(events) > 0 {
+		fmt.Fprintf(w, "\n---------- event timeline ----------\n")
+	}
+	for _, e := range events {
+		old := e.OldStatus
+		if old == "" {
+			old = "-"
+		}
+		fmt.Fprintf(w, "%v  %-10v %v -> %v", e.Time.Format(time.StampMilli), e.Type, old, e.NewStatus)
+		if e.WorkerId != (WorkerId{}) {
+			fmt.Fprintf(w, ", worker %v", e.WorkerId)
+		}
+		if e.Actor != "" {
+			fmt.Fprintf(w, ", by %v", e.Actor)
+		}
+		if e.Msg != "" {
+			fmt.Fprintf(w, ": %v", e.Msg)
+		}
+		fmt.Fprintln(w)
 	}
 }
 
@@ -218,7 +326,7 @@ const home = `
     <title> Cyclus Run Dashboard </title>
     <script src="http://ajax.googleapis.com/ajax/libs/jquery/1.11.1/jquery.min.js"></script>
 	<style>
-		#dashboard table {
+		#dashboard table, #workers table {
 			width:80%;
 			border-color:#a9a9a9;
 			color:#333333;
@@ -227,7 +335,7 @@ const home = `
 			border-width:1px;
 			text-align:center;
 		}
-		#dashboard th {
+		#dashboard th, #workers th {
 			padding:4px;
 			border-style:solid;
 			border-color:#a9a9a9;
@@ -235,11 +343,11 @@ const home = `
 			background-color:#b8b8b8;
 			text-align:left;
 		}
-		#dashboard tr {
+		#dashboard tr, #workers tr {
 			background-color:#ffffff;
 			text-align:center;
 		}
-		#dashboard td {
+		#dashboard td, #workers td {
 			padding:4px;
 			border-color:#a9a9a9;
 			border-style:solid;
@@ -258,6 +366,12 @@ const home = `
 		#dashboard tr.status-failed {
 			background-color:#F0C2B2;
 		}
+		#dashboard tr.status-canceled {
+			background-color:#E0E0E0;
+		}
+		#dashboard tr.status-waiting {
+			background-color:#EBEBEB;
+		}
 
 		#stats,#since {
 			width:80%;
@@ -303,12 +417,22 @@ const home = `
 			<li>
 				{{.Stats.NFailed}} jobs failed
 			</li>
+			<li>
+				{{.Stats.NCanceled}} jobs canceled
+			</li>
+			{{if .Memoize}}
+			<li>
+				{{.Stats.NCacheHits}} memoized results reused ({{.Stats.NCacheMisses}} misses)
+			</li>
+			{{end}}
 			<li>
 				{{.Stats.NPurged}} old jobs purged.
 			</li>
 		</ul>
 	</div>
 
+    <br>
+    <div id="workers"></div>
     <br>
     <div id="dashboard"></div>
     <br>
@@ -333,6 +457,11 @@ const home = `
                 setTimeout("loadDash()", 30000)
             });
         }
+        function loadWorkers() {
+            $('#workers').load(server + "/dashboard/workers", function() {
+                setTimeout("loadWorkers()", 30000)
+            });
+        }
         function loadDefaultInfile() {
             $.get(server + "/dashboard/default-infile", function( data ) {
                 $('#infile-box').text(data);
@@ -341,6 +470,7 @@ const home = `
 
         loadDefaultInfile();
         loadDash();
+        loadWorkers();
     </script>
 
 </body>
@@ -0,0 +1,145 @@
+package cloudlus
+
+import (
+	"fmt"
+	"net"
+	"net/http"
+	"time"
+)
+
+// Event records a transition of a job from one status to another in the
+// server's append-only event log.
+type Event struct {
+	// Seq orders all events of the log.  It is assigned when the event is
+	// stored.
+	Seq   uint64
+	JobId JobId
+	Time  time.Time
+	// Type is what caused the transition (one of the Event* constants).
+	Type string
+	// OldStatus is empty for submit events.  OldStatus and NewStatus are only
+	// equal for requeue events.
+	OldStatus string
+	NewStatus string
+	// WorkerId is the worker the job was fetched by or taken from, if any.
+	WorkerId WorkerId
+	// Actor is who caused the event: ActorServer, ActorWorker or the
+	// submitter or API token (or, without tokens, the client host) of
+	// requests.  It is empty for requests made through the Server methods.
+	Actor string
+	// Msg holds details such as why an attempt failed.
+	Msg string
+}
+
+// Types of events.
+const (
+	EventSubmit = "submit"
+	// EventDependency is recorded when a dependency of a waiting job
+	// finished.
+	EventDependency = "dependency"
+	EventFetch      = "fetch"
+	// EventPush is recorded when a worker pushes a finished attempt.
+	EventPush = "push"
+	// EventTimeout is recorded when the server kills a job that ran past its
+	// timeout.
+	EventTimeout = "timeout"
+	// EventLost is recorded when a job's worker stops sending heartbeats.
+	EventLost = "lost"
+	// EventRelease is recorded when a draining worker hands a job back.
+	EventRelease = "release"
+	// EventRequeue is recorded when a job's retry backoff expires.
+	EventRequeue = "requeue"
+	EventCancel  = "cancel"
+	// EventRetry is recorded when a failed or canceled job is retried by
+	// request.
+	EventRetry = "retry"
+	// EventReset is recorded for queued jobs removed by a queue reset.
+	EventReset = "reset"
+	// EventRestart is recorded for unfinished jobs when the server starts.
+	EventRestart = "restart"
+)
+
+// Actors of events that weren't caused by requests.
+const (
+	ActorServer = "server"
+	ActorWorker = "worker"
+)
+
+// actor describes the client of a request authorized by t from addr as an
+// event actor.
+func actor(t *Token, addr string) string {
+	if t != nil && t.Owner != "" {
+		return fmt.Sprintf("%v (token %v)", t.Owner, t.Id)
+	} else if t != nil {
+		return "token " + t.Id
+	}
+	if host, _, err := net.SplitHostPort(addr); err == nil {
+		return host
+	}
+	return addr
+}
+
+// reqactor describes the client of r as an event actor.
+func reqactor(r *http.Request) string { return actor(reqtoken(r), r.RemoteAddr) }
+
+// submitter describes who submitted j as an event actor.
+func submitter(j *Job) string {
+	if j.TokenId != "" {
+		return actor(&Token{Id: j.TokenId, Owner: j.Owner}, "")
+	}
+	return j.Owner
+}
+
+// EventRequest requests up to Limit events following the event with sequence
+// number Since via rpc.
+type EventRequest struct {
+	Since uint64
+	Limit int
+}
+
+// DefaultEventLimit is the maximum number of events returned by the global
+// event feed (REST and rpc) for requests without a limit.
+const DefaultEventLimit = 1000
+
+// Events returns up to limit events following the event with sequence
+// number since from the event log of all jobs - oldest first.  If limit is
+// zero, all following events are returned.
+func (s *Server) Events(since uint64, limit int) ([]*Event, error) {
+	return s.alljobs.Events(since, limit)
+}
+
+// JobEvents returns all events of the job with the given id - oldest first.
+func (s *Server) JobEvents(jid JobId) ([]*Event, error) {
+	if _, err := s.alljobs.Get(jid); err != nil {
+		return nil, fmt.Errorf("unknown job id %v", jid)
+	}
+	return s.alljobs.JobEvents(jid)
+}
+
+// save stores j and records ev - j's transition from ev.OldStatus to its
+// current status - in the event log.  No event is recorded if j's status
+// didn't change.
+func (s *Server) save(j *Job, ev Event) {
+	s.alljobs.Put(j)
+	if ev.OldStatus != j.Status {
+		s.event(j, ev)
+	}
+}
+
+// event appends ev for j in its current status to the event log.
+func (s *Server) event(j *Job, ev Event) {
+	ev.JobId = j.Id
+	ev.Time = time.Now()
+	ev.NewStatus = j.Status
+	if err := s.alljobs.AppendEvent(&ev); err != nil {
+		s.log.Printf("[EVENT] job %v: %v\n", j.Id, err)
+	}
+}
+
+// lastWorker returns the worker j's most recent attempt was dispatched to.
+func lastWorker(j *Job) WorkerId {
+	if n := len(j.Attempts); n > 0 {
+		return j.Attempts[n-1].WorkerId
+	}
+	return WorkerId{}
+}
@@ -15,12 +15,13 @@ const workerpoll = 1 * time.Second
 
 func TestRemoteKill(t *testing.T) {
 	kill1 := make(chan struct{})
+	defer close(kill1)
 	w1 := &foreverWorker{ServerAddr: testaddr}
 	go w1.Run(kill1)
 
 	// empty path for in-memory db
 	db, _ := NewDB("", dblimit)
-	s := NewServer(testaddr, testaddr, db)
+	s := NewServer(testaddr, testaddr, db, nil, nil)
 	go s.ListenAndServe()
 	defer s.Close()
 
@@ -51,7 +52,7 @@ func TestWorkerFailure(t *testing.T) {
 
 	// empty path for in-memory db
 	db, err := NewDB("", dblimit)
-	s := NewServer(testaddr, testaddr, db)
+	s := NewServer(testaddr, testaddr, db, nil, nil)
 	go s.ListenAndServe()
 	defer s.Close()
 
@@ -3,12 +3,18 @@ package cloudlus
 import (
 	"archive/zip"
 	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
 	"fmt"
 	"io"
 	"io/ioutil"
 	"log"
 	"os"
 	"os/exec"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
 	"syscall"
 	"time"
 
@@ -20,6 +26,21 @@ const (
 	StatusRunning  = "running"
 	StatusComplete = "complete"
 	StatusFailed   = "failed"
+	StatusWaiting  = "waiting"
+	StatusCanceled = "canceled"
+)
+
+// Failure reasons recorded in Job.FailReason.
+const (
+	FailTimeout        = "timeout"
+	FailKilledByServer = "killed-by-server"
+	FailWhitelist      = "whitelist-rejected"
+	FailMissingOutfile = "missing-outfile"
+	FailSetup          = "setup-error"
+	FailNonzeroExit    = "nonzero-exit"
+	FailWorkerLost     = "worker-lost"
+	FailCanceled       = "canceled"
+	FailDependency     = "dependency-failed"
 )
 
 const DefaultInfile = "input.xml"
@@ -41,17 +62,125 @@ type Job struct {
 	Finished  time.Time
 	WorkerId  WorkerId
 	Note      string
+	// Owner identifies the user or program that submitted the job.  Queued
+	// jobs are dispatched fair share across owners.  It is set to the owner
+	// of the API token the job was submitted with if the token has one.
+	Owner string
+	// TokenId is the id of the API token the job was submitted with.
+	TokenId string
+	// Priority orders queued jobs of the same owner - higher priority jobs
+	// run first.
+	Priority int
+	// MaxRetries is the number of times the job is automatically requeued
+	// after failing before giving up.  Retrying the job by request grants it
+	// MaxRetries more.
+	MaxRetries int
+	// RetryBackoff is the delay before a failed job is requeued.  It doubles
+	// with each retry.
+	RetryBackoff time.Duration
+	// RetryBase is the number of attempts the job had when it was last
+	// retried by request.  Only later attempts count against MaxRetries.
+	RetryBase int
+	// Attempts holds the history of each time the job was dispatched to a
+	// worker.
+	Attempts []Attempt
+	// DependsOn holds the ids of jobs that must complete successfully before
+	// this job is queued to run.  If any of them fail, this job fails too.
+	DependsOn []JobId
+	// InheritOutfiles, if true, causes the output files of all DependsOn jobs
+	// to be added to this job's Infiles before it is queued.
+	InheritOutfiles bool
+	// Requires holds labels a worker must advertise to be dispatched this
+	// job (e.g. "cycamore" or "cyclus=1.3").
+	Requires []string
+	// MinMemory is the amount of free memory in MiB a worker must have to
+	// be dispatched this job.
+	MinMemory int
+	// MinCPUs is the number of free CPUs a worker must have to be
+	// dispatched this job.
+	MinCPUs int
+	// NoCache, if true, causes the job to always be run even if the server
+	// has the results of an identical job memoized.
+	NoCache bool
+	// Limits restricts the resources the job may use on workers running
+	// Linux.
+	Limits Limits
+	// Env holds environment variables set for the job's process in addition
+	// to the worker's environment.
+	Env map[string]string
+	// Stdin, if not empty, names an input file fed to the job's standard
+	// input.
+	Stdin string
+	// Dir is the working directory of the job's process relative to its
+	// scratch directory - it is created if it doesn't exist.  Input and
+	// output file names are always relative to the scratch directory.
+	Dir string
+	// ArrayId is the id of the job array the job was created by and
+	// ArrayIndex the index of its parameter set.  ArrayId is zero for jobs
+	// not created by an array.
+	ArrayId    JobId
+	ArrayIndex int
+	// FailReason holds the reason a job failed or was canceled (e.g.
+	// FailTimeout or FailMemoryLimit).  It is empty for jobs that didn't
+	// fail.
+	FailReason string
+	// ExitCode is the exit code of the job's process - it is -1 if the
+	// process was killed by a signal or never ran.
+	ExitCode int
+	// Signal is the number of the signal that killed the job's process or
+	// zero if it wasn't killed by a signal.
+	Signal    int
 	dir       string
 	wd        string
 	whitelist []string
-	log       io.Writer
+	// envallow and envdeny are the worker's environment variable key
+	// patterns.
+	envallow []string
+	envdeny  []string
+	log      io.Writer
+	// stream, if not nil, receives the job's stdout and stderr as the job
+	// runs.
+	stream io.Writer
+}
+
+// tailsize is the number of trailing stderr bytes kept for each job attempt.
+const tailsize = 2048
+
+// Attempt records a single dispatch of a job to a worker.
+type Attempt struct {
+	WorkerId WorkerId
+	Started  time.Time
+	Finished time.Time
+	Status   string
+	// FailReason is the job's failure reason at the end of the attempt.
+	FailReason string
+	// Stderr holds the tail end of the job's stderr at the end of the
+	// attempt.
+	Stderr string
 }
 
 type File struct {
-	Name  string
-	Data  []byte
-	Size  int
-	Cache bool
+	// Name is the slash-separated path of the file relative to the job's
+	// working directory.  For output files, Name may also be a glob pattern
+	// (see filepath.Match) or a directory - all matching files are collected
+	// recursively.
+	Name string
+	Data []byte
+	// Size is the file size in bytes.  For output files it is the total size
+	// of all collected files matching Name.
+	Size int
+	// Hash is the hex-encoded SHA-256 hash of the file's contents.  Input
+	// files with a Hash and no Data refer to a blob stored on the server.
+	Hash string
+	// Optional, if true, allows an output file or pattern to match nothing
+	// without failing the job.
+	Optional bool
+}
+
+// blobHash returns the hex-encoded SHA-256 hash of data.
+func blobHash(data []byte) string {
+	sum := sha256.Sum256(data)
+	return hex.EncodeToString(sum[:])
 }
 
 func NewJob() *Job {
@@ -59,8 +188,10 @@ func NewJob() *Job {
 	var id [16]byte
 	copy(id[:], uid)
 	return &Job{
-		Id:      id,
-		Timeout: DefaultTimeout,
+		Id:       id,
+		Timeout:  DefaultTimeout,
+		Owner:    os.Getenv("USER"),
+		ExitCode: -1,
 	}
 }
 
@@ -89,26 +220,228 @@ func (j *Job) Whitelist(cmds ...string) {
 	j.whitelist = append(j.whitelist, cmds...)
 }
 
+// AllowEnv restricts the environment variables j may set to those with keys
+// matching one of the allow patterns (if any are given) and none of the deny
+// patterns.  Patterns use path.Match syntax (e.g. "OMP_*").
+func (j *Job) AllowEnv(allow, deny []string) {
+	j.envallow = append(j.envallow, allow...)
+	j.envdeny = append(j.envdeny, deny...)
+}
+
+// checkEnv returns an error if any of j's environment variables aren't
+// allowed.
+func (j *Job) checkEnv() error {
+	matches := func(patterns []string, key string) bool {
+		for _, pat := range patterns {
+			if ok, _ := path.Match(pat, key); ok {
+				return true
+			}
+		}
+		return false
+	}
+
+	for key := range j.Env {
+		if key == "" || strings.ContainsAny(key, "=\x00") {
+			return fmt.Errorf("invalid environment variable name '%v'", key)
+		} else if matches(j.envdeny, key) || (len(j.envallow) > 0 && !matches(j.envallow, key)) {
+			return fmt.Errorf("environment variable '%v' is not allowed by the worker", key)
+		}
+	}
+	return nil
+}
+
+// environ returns the environment of j's process.
+func (j *Job) environ() []string {
+	if len(j.Env) == 0 {
+		return nil
+	}
+	keys := make([]string, 0, len(j.Env))
+	for key := range j.Env {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	env := os.Environ()
+	for _, key := range keys {
+		env = append(env, key+"="+j.Env[key])
+	}
+	return env
+}
+
+// After adds all the given jobs as dependencies of j.
+func (j *Job) After(deps ...*Job) {
+	for _, dep := range deps {
+		j.DependsOn = append(j.DependsOn, dep.Id)
+	}
+}
+
+// endAttempt records the end of j's most recent attempt on worker wid with
+// the given status and returns it.  nil is returned if j never ran on wid.
+func (j *Job) endAttempt(wid WorkerId, status string) *Attempt {
+	for i := len(j.Attempts) - 1; i >= 0; i-- {
+		a := &j.Attempts[i]
+		if a.WorkerId != wid {
+			continue
+		}
+		a.Finished = time.Now()
+		a.Status = status
+		a.FailReason = j.FailReason
+		a.Stderr = j.Stderr
+		if len(a.Stderr) > tailsize {
+			a.Stderr = a.Stderr[len(a.Stderr)-tailsize:]
+		}
+		return a
+	}
+	return nil
+}
+
+// sanitize resets all fields of j that only the server sets - its status,
+// results, attempt history and array membership - before a client's job is
+// submitted.
+func (j *Job) sanitize() {
+	j.Status = ""
+	j.Stdout, j.Stderr = "", ""
+	for i, f := range j.Outfiles {
+		j.Outfiles[i] = File{Name: f.Name, Optional: f.Optional}
+	}
+	j.Submitted, j.Fetched, j.Started, j.Finished = time.Time{}, time.Time{}, time.Time{}, time.Time{}
+	j.WorkerId = WorkerId{}
+	j.TokenId = ""
+	j.RetryBase = 0
+	j.Attempts = nil
+	j.ArrayId, j.ArrayIndex = JobId{}, 0
+	j.FailReason = ""
+	j.ExitCode, j.Signal = -1, 0
+}
+
+// triedOn returns true if j was dispatched to worker wid since it was last
+// retried by request.
+func (j *Job) triedOn(wid WorkerId) bool {
+	for i := len(j.Attempts) - 1; i >= 0 && i >= j.RetryBase; i-- {
+		if j.Attempts[i].WorkerId == wid {
+			return true
+		}
+	}
+	return false
+}
+
+// merge copies the outcome of an attempt pushed by a worker into j - the
+// server's copy of the job.  Everything else, e.g. j's attempts, is kept.
+func (j *Job) merge(pushed *Job) {
+	j.Status = pushed.Status
+	j.FailReason = pushed.FailReason
+	j.Stdout, j.Stderr = pushed.Stdout, pushed.Stderr
+	j.Outfiles = pushed.Outfiles
+	j.Started, j.Finished = pushed.Started, pushed.Finished
+	j.WorkerId = pushed.WorkerId
+	j.ExitCode, j.Signal = pushed.ExitCode, pushed.Signal
+}
+
+// queuedSince returns the time j was last queued: when its previous attempt
+// ended or, if it has none, when it was submitted.
+func (j *Job) queuedSince() time.Time {
+	if n := len(j.Attempts); n > 0 && !j.Attempts[n-1].Finished.IsZero() {
+		return j.Attempts[n-1].Finished
+	}
+	return j.Submitted
+}
+
+// recentAttempts returns the number of attempts of j since it was last
+// retried by request.
+func (j *Job) recentAttempts() int { return len(j.Attempts) - j.RetryBase }
+
+// backoff returns the delay before j is requeued after its most recent
+// failed attempt.
+func (j *Job) backoff() time.Duration {
+	n := j.recentAttempts() - 1
+	if n < 0 {
+		n = 0
+	} else if n > 16 {
+		n = 16
+	}
+	return j.RetryBackoff << uint(n)
+}
+
+// memoHash returns a hash of the job's command, input files and requested
+// output files.  Jobs with equal hashes are expected to produce the same
+// results.
+func (j *Job) memoHash() []byte {
+	h := sha256.New()
+	field := func(s string) { fmt.Fprintf(h, "%d:%s", len(s), s) }
+
+	fmt.Fprintf(h, "cmd%d;", len(j.Cmd))
+	for _, arg := range j.Cmd {
+		field(arg)
+	}
+	fmt.Fprintf(h, "infiles%d;", len(j.Infiles))
+	for _, f := range j.Infiles {
+		field(f.Name)
+		if f.Hash != "" && f.Data == nil {
+			field(f.Hash)
+		} else {
+			field(blobHash(f.Data))
+		}
+	}
+	// only hash the process environment if it is set so hashes of jobs
+	// without it don't change
+	if len(j.Env) > 0 || j.Stdin != "" || j.Dir != "" {
+		keys := []string{}
+		for key := range j.Env {
+			keys = append(keys, key)
+		}
+		sort.Strings(keys)
+		fmt.Fprintf(h, "env%d;", len(keys))
+		for _, key := range keys {
+			field(key)
+			field(j.Env[key])
+		}
+		field(j.Stdin)
+		field(j.Dir)
+	}
+	fmt.Fprintf(h, "outfiles%d;", len(j.Outfiles))
+	for _, f := range j.Outfiles {
+		field(f.Name)
+		if f.Optional {
+			field("optional")
+		}
+	}
+	// jobs requiring different worker labels (e.g. tool versions) may
+	// produce different results
+	if len(j.Requires) > 0 {
+		labels := append([]string{}, j.Requires...)
+		sort.Strings(labels)
+		fmt.Fprintf(h, "requires%d;", len(labels))
+		for _, label := range labels {
+			field(label)
+		}
+	}
+	return h.Sum(nil)
+}
+
 func (j *Job) Done() bool {
-	return j.Status == StatusComplete || j.Status == StatusFailed
+	return j.Status == StatusComplete || j.Status == StatusFailed || j.Status == StatusCanceled
 }
 
+// AddOutfile adds a required output file, glob pattern or directory to j.
+// The job fails if nothing matches it.
 func (j *Job) AddOutfile(fname string) {
-	j.Outfiles = append(j.Outfiles, File{fname, nil, 0, false})
+	j.Outfiles = append(j.Outfiles, File{Name: fname})
 }
 
-func (j *Job) AddInfile(fname string, data []byte) {
-	j.Infiles = append(j.Infiles, File{fname, data, len(data), false})
+// AddOptionalOutfile adds an output file, glob pattern or directory to j
+// that is collected if it exists.
+func (j *Job) AddOptionalOutfile(fname string) {
+	j.Outfiles = append(j.Outfiles, File{Name: fname, Optional: true})
 }
 
-func (j *Job) AddInfileCached(fname string, data []byte) {
-	j.Infiles = append(j.Infiles, File{fname, data, len(data), true})
+func (j *Job) AddInfile(fname string, data []byte) {
+	j.Infiles = append(j.Infiles, File{Name: fname, Data: data, Size: len(data)})
 }
 
 func (j *Job) Size() int64 {
 	n := len(j.Stdout) + len(j.Stderr)
 	for _, f := range j.Infiles {
-		n += len(f.Data)
+		n += f.Size
 	}
 	for _, f := range j.Outfiles {
 		n += f.Size
@@ -124,19 +457,25 @@ func (j *Job) Execute(kill chan bool, outbuf io.Writer) {
 		j.Timeout = DefaultTimeout
 	}
 	j.Started = time.Now()
+	j.FailReason = ""
+	j.ExitCode, j.Signal = -1, 0
 	defer func() { j.Finished = time.Now() }()
 
 	// set up stderr/stdout tee's and exec command
 	var stdout bytes.Buffer
 	var stderr bytes.Buffer
-	multiout := io.MultiWriter(j.log, &stdout)
-	multierr := io.MultiWriter(j.log, &stderr)
+	stream := j.stream
+	if stream == nil {
+		stream = ioutil.Discard
+	}
+	multiout := io.MultiWriter(j.log, &stdout, stream)
+	multierr := io.MultiWriter(j.log, &stderr, stream)
 	defer func() { j.Stdout += stdout.String() }()
 	defer func() { j.Stderr += stderr.String() }()
 
 	// make sure job is valid/acceptable
 	if len(j.Cmd) == 0 {
-		j.Status = StatusFailed
+		j.fail(FailSetup)
 		fmt.Fprint(multierr, "job has no command to run\n")
 		return
 	} else if len(j.whitelist) > 0 {
@@ -148,20 +487,24 @@ func (j *Job) Execute(kill chan bool, outbuf io.Writer) {
 			}
 		}
 		if !approved {
-			j.Status = StatusFailed
+			j.fail(FailWhitelist)
 			fmt.Fprintf(multierr, "'%v' is not a white-listed command in %v\n", j.Cmd[0], j.whitelist)
 			return
 		}
 	}
+	if err := j.checkEnv(); err != nil {
+		j.fail(FailWhitelist)
+		fmt.Fprintf(multierr, "%v\n", err)
+		return
+	}
 
-	if err := j.setup(); err != nil {
-		j.Status = StatusFailed
+	err := j.setup()
+	defer j.teardown()
+	if err != nil {
+		j.fail(FailSetup)
 		fmt.Fprint(multierr, err)
 		return
 	}
-	defer j.teardown()
-
-	var err error
 
 	cmd := exec.Command(j.Cmd[0], j.Cmd[1:]...)
 	cmd.SysProcAttr = &syscall.SysProcAttr{Setpgid: true} // required to kill all child processes together with parent
@@ -169,11 +512,34 @@ func (j *Job) Execute(kill chan bool, outbuf io.Writer) {
 
 	cmd.Stderr = multierr
 	cmd.Stdout = multiout
+	cmd.Dir = j.path(j.Dir)
+	cmd.Env = j.environ()
+	if j.Stdin != "" {
+		f, err := os.Open(j.path(j.Stdin))
+		if err != nil {
+			j.fail(FailSetup)
+			fmt.Fprintf(multierr, "%v\n", err)
+			return
+		}
+		defer f.Close()
+		cmd.Stdin = f
+	}
 
-	// launch job process
+	if err := j.Limits.prepare(cmd); err != nil {
+		j.fail(FailSetup)
+		fmt.Fprint(multierr, err)
+		return
+	}
+
+	// launch job process - it must be started before it can be killed
+	if err := cmd.Start(); err != nil {
+		j.fail(FailSetup)
+		fmt.Fprint(multierr, err)
+		return
+	}
 	done := make(chan bool)
 	go func() {
-		if err := cmd.Run(); err != nil {
+		if err := cmd.Wait(); err != nil {
 			j.Status = StatusFailed
 			fmt.Fprint(multierr, err)
 		} else {
@@ -182,61 +548,102 @@ func (j *Job) Execute(kill chan bool, outbuf io.Writer) {
 		close(done)
 	}()
 
-	// wait for job to finish or timeout
+	exceeded := j.Limits.watch(cmd.Process.Pid, j.dir, done)
+
+	// wait for job to finish, timeout or exceed its limits
 	select {
 	case <-time.After(j.Timeout):
 		fmt.Fprintf(multierr, "\nKilling job...")
-		killall(multierr, cmd)
-		j.Status = StatusFailed
+		terminate(multierr, cmd, done)
 		fmt.Fprintf(multierr, "\nJob timed out after %v\n", time.Now().Sub(j.Started))
-		<-done
+		j.exited(cmd.ProcessState)
+		j.fail(FailTimeout)
 		return
 	case <-kill:
-		killall(multierr, cmd)
-		j.Status = StatusFailed
+		terminate(multierr, cmd, done)
 		fmt.Fprintf(multierr, "\nJob was terminated by server\n")
+		j.exited(cmd.ProcessState)
+		j.fail(FailKilledByServer)
+		return
+	case reason := <-exceeded:
+		// processes over their limits aren't given the chance to grow
+		// further
+		killall(multierr, cmd, syscall.SIGKILL)
 		<-done
+		j.exited(cmd.ProcessState)
+		j.fail(reason)
+		fmt.Fprint(multierr, j.Limits.exceeded(reason))
 		return
 	case <-done:
+		j.exited(cmd.ProcessState)
+		if reason := j.Limits.classify(cmd.ProcessState); reason != "" {
+			j.fail(reason)
+			fmt.Fprint(multierr, j.Limits.exceeded(reason))
+			return
+		} else if j.Status == StatusFailed {
+			j.fail(FailNonzeroExit)
+		}
 	}
 
 	// collect output data
 	zw := zip.NewWriter(outbuf)
+	collected := map[string]bool{}
 	for i, f := range j.Outfiles {
-		w, err := zw.Create(f.Name)
+		matches, err := j.match(f.Name)
 		if err != nil {
-			j.Status = StatusFailed
+			j.fail(FailSetup)
 			fmt.Fprintf(multierr, "%v\n", err)
-			break
+			continue
+		} else if len(matches) == 0 && !f.Optional {
+			j.fail(FailMissingOutfile)
+			fmt.Fprintf(multierr, "no output files match '%v'\n", f.Name)
+			continue
 		}
 
-		func() {
-			r, err := os.Open(f.Name)
-			if err != nil {
-				j.Status = StatusFailed
-				fmt.Fprintf(multierr, "%v\n", err)
-				return
+		j.Outfiles[i].Size = 0
+		for _, name := range matches {
+			if collected[name] {
+				continue
 			}
-			defer r.Close()
+			collected[name] = true
 
-			n, err := io.Copy(w, r)
+			n, err := j.zipfile(zw, name)
 			if err != nil {
-				j.Status = StatusFailed
+				j.fail(FailSetup)
 				fmt.Fprintf(multierr, "%v\n", err)
-				return
+				continue
 			}
-
-			j.Outfiles[i].Size = int(n)
-		}()
+			j.Outfiles[i].Size += int(n)
+		}
 	}
 
 	err = zw.Close()
 	if err != nil {
-		j.Status = StatusFailed
+		j.fail(FailSetup)
 		fmt.Fprintf(multierr, "%v\n", err)
 	}
 }
 
+// fail marks j as failed for the given reason.  The first reason recorded
+// by an execution is kept.
+func (j *Job) fail(reason string) {
+	j.Status = StatusFailed
+	if j.FailReason == "" {
+		j.FailReason = reason
+	}
+}
+
+// exited records the exit code and signal of j's finished process.
+func (j *Job) exited(state *os.ProcessState) {
+	if state == nil {
+		return
+	}
+	j.ExitCode = state.ExitCode()
+	if ws, ok := state.Sys().(syscall.WaitStatus); ok && ws.Signaled() {
+		j.Signal = int(ws.Signal())
+	}
+}
+
 func (j *Job) GetOutfile(outbuf io.ReaderAt, size int, fname string) (io.ReadCloser, error) {
 	r, err := zip.NewReader(outbuf, int64(size))
 	if err != nil {
@@ -254,6 +661,10 @@ func (j *Job) GetOutfile(outbuf io.ReaderAt, size int, fname string) (io.ReadClo
 	return nil, fmt.Errorf("outfile '%v' not found for job %v", fname, j.Id)
 }
 
+// setup creates a uniquely named scratch directory for the job inside its
+// working directory (defaulting to the process' current directory) and
+// writes the job's input files into it.  Jobs never change the process'
+// current directory so multiple jobs can safely run concurrently.
 func (j *Job) setup() error {
 	var err error
 	if j.wd == "" {
@@ -262,23 +673,103 @@ func (j *Job) setup() error {
 			return err
 		}
 	}
-	j.dir = uuid.NewRandom().String()
+	j.dir = filepath.Join(j.wd, uuid.NewRandom().String())
 	err = os.MkdirAll(j.dir, 0755)
 	if err != nil {
 		return err
 	}
 
-	if err := os.Chdir(j.dir); err != nil {
-		return err
+	for _, name := range []string{j.Dir, j.Stdin} {
+		if !localPath(filepath.FromSlash(name)) {
+			return fmt.Errorf("'%v' is outside the job directory", name)
+		}
 	}
-
 	for _, f := range j.Infiles {
-		err := ioutil.WriteFile(f.Name, f.Data, 0755)
+		if !localPath(filepath.FromSlash(f.Name)) {
+			return fmt.Errorf("input file '%v' is outside the job directory", f.Name)
+		}
+		if err := os.MkdirAll(filepath.Dir(j.path(f.Name)), 0755); err != nil {
+			return err
+		}
+		err := ioutil.WriteFile(j.path(f.Name), f.Data, 0755)
 		if err != nil {
 			return err
 		}
 	}
-	return nil
+	return os.MkdirAll(j.path(j.Dir), 0755)
+}
+
+// path returns the location of the named file in j's scratch directory.
+func (j *Job) path(name string) string { return filepath.Join(j.dir, filepath.FromSlash(name)) }
+
+// match returns the slash-separated paths relative to j's scratch directory
+// of all regular files matching the output file pattern.  Directories are
+// searched recursively.
+func (j *Job) match(pattern string) ([]string, error) {
+	paths, err := filepath.Glob(j.path(pattern))
+	if err != nil {
+		return nil, fmt.Errorf("invalid output file pattern '%v': %v", pattern, err)
+	}
+
+	names := []string{}
+	add := func(path string) error {
+		rel, err := filepath.Rel(j.dir, path)
+		if err != nil {
+			return err
+		} else if !localPath(rel) {
+			return fmt.Errorf("output file '%v' is outside the job directory", rel)
+		}
+		names = append(names, filepath.ToSlash(rel))
+		return nil
+	}
+
+	for _, p := range paths {
+		// follow symlinks named explicitly but not those inside directories
+		if info, err := os.Stat(p); err != nil {
+			return nil, err
+		} else if !info.IsDir() {
+			if err := add(p); err != nil {
+				return nil, err
+			}
+			continue
+		}
+
+		err := filepath.Walk(p, func(path string, info os.FileInfo, err error) error {
+			if err != nil {
+				return err
+			} else if !info.Mode().IsRegular() {
+				return nil
+			}
+			return add(path)
+		})
+		if err != nil {
+			return nil, err
+		}
+	}
+	return names, nil
+}
+
+// localPath returns true if the relative path p doesn't refer to anything
+// outside of the directory it is relative to.
+func localPath(p string) bool {
+	p = filepath.Clean(p)
+	return !filepath.IsAbs(p) && p != ".." && !strings.HasPrefix(p, ".."+string(filepath.Separator))
+}
+
+// zipfile adds the named file in j's scratch directory to zw and returns
+// its size.
+func (j *Job) zipfile(zw *zip.Writer, name string) (int64, error) {
+	r, err := os.Open(j.path(name))
+	if err != nil {
+		return 0, err
+	}
+	defer r.Close()
+
+	w, err := zw.Create(name)
+	if err != nil {
+		return 0, err
+	}
+	return io.Copy(w, r)
 }
 
 func (j *Job) teardown() error {
@@ -286,11 +777,6 @@ func (j *Job) teardown() error {
 		j.dir = ""
 	}()
 
-	if err := os.Chdir(j.wd); err != nil {
-		log.Print(err)
-		return err
-	}
-
 	if err := os.RemoveAll(j.dir); err != nil {
 		log.Print(err)
 		return err
@@ -302,39 +788,75 @@ func (j *Job) teardown() error {
 // messages with current job state/status info while avoiding sending large
 // data like input and output files.
 type JobStat struct {
-	Id        JobId
-	Cmd       []string
-	Status    string
-	Size      int64
-	Stdout    string
-	Stderr    string
-	Submitted time.Time
-	Started   time.Time
-	Finished  time.Time
+	Id         JobId
+	Cmd        []string
+	Status     string
+	Owner      string
+	Priority   int
+	Size       int64
+	Stdout     string
+	Stderr     string
+	Submitted  time.Time
+	Started    time.Time
+	Finished   time.Time
+	Attempts   []Attempt
+	WorkerId   WorkerId
+	Note       string
+	FailReason string
+	ExitCode   int
+	Signal     int
+	ArrayId    JobId
+	ArrayIndex int
 }
 
 func NewJobStat(j *Job) *JobStat {
 	return &JobStat{
-		Id:        j.Id,
-		Cmd:       j.Cmd,
-		Status:    j.Status,
-		Size:      j.Size(),
-		Stdout:    j.Stdout,
-		Stderr:    j.Stderr,
-		Submitted: j.Submitted,
-		Started:   j.Started,
-		Finished:  j.Finished,
-	}
-}
-
-func killall(multierr io.Writer, cmd *exec.Cmd) {
-	cmd.Start()
-
-	pgid, err := syscall.Getpgid(cmd.Process.Pid)
-	if err == nil {
-		syscall.Kill(-pgid, 15) // note the minus sign
-		cmd.Wait()
-	} else {
+		Id:         j.Id,
+		Cmd:        j.Cmd,
+		Status:     j.Status,
+		Owner:      j.Owner,
+		Priority:   j.Priority,
+		Size:       j.Size(),
+		Stdout:     j.Stdout,
+		Stderr:     j.Stderr,
+		Submitted:  j.Submitted,
+		Started:    j.Started,
+		Finished:   j.Finished,
+		Attempts:   j.Attempts,
+		WorkerId:   j.WorkerId,
+		Note:       j.Note,
+		FailReason: j.FailReason,
+		ExitCode:   j.ExitCode,
+		Signal:     j.Signal,
+		ArrayId:    j.ArrayId,
+		ArrayIndex: j.ArrayIndex,
+	}
+}
+
+// killGrace is how long a job's processes get to exit after being asked to
+// before they are killed.
+var killGrace = 10 * time.Second
+
+// killall sends sig to the started cmd and all its child processes.  The
+// caller is responsible for waiting on cmd.
+func killall(multierr io.Writer, cmd *exec.Cmd, sig syscall.Signal) {
+	// cmd leads its own process group - which outlives cmd if its children
+	// don't exit with it
+	if err := syscall.Kill(-cmd.Process.Pid, sig); err != nil && err != syscall.ESRCH {
 		fmt.Fprintf(multierr, "\n%v\n", err)
 	}
 }
+
+// terminate asks the started cmd and all its child processes to exit with
+// SIGTERM and kills them with SIGKILL if they haven't within killGrace.  It
+// returns once done - closed when waiting on cmd returns - is closed.
+func terminate(multierr io.Writer, cmd *exec.Cmd, done chan bool) {
+	killall(multierr, cmd, syscall.SIGTERM)
+	select {
+	case <-done:
+	case <-time.After(killGrace):
+		fmt.Fprintf(multierr, "\nJob didn't exit within %v, killing it...", killGrace)
+		killall(multierr, cmd, syscall.SIGKILL)
+		<-done
+	}
+}
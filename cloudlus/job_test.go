@@ -1,7 +1,229 @@
 package cloudlus
 
-import "testing"
+import (
+	"archive/zip"
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestMain(m *testing.M) {
+	// jobs with resource limits re-execute the test binary
+	RunShim()
+	os.Exit(m.Run())
+}
 
 func TestJobTimeout(t *testing.T) {
-	t.Fatalf("not implemented")
+	j := NewJobCmd("sleep", "10")
+	j.Timeout = 200 * time.Millisecond
+	j.log = ioutil.Discard
+
+	start := time.Now()
+	j.Execute(nil, ioutil.Discard)
+	if elapsed := time.Now().Sub(start); elapsed > 5*time.Second {
+		t.Errorf("job ran for %v, should have been killed after %v", elapsed, j.Timeout)
+	}
+	if j.Status != StatusFailed {
+		t.Errorf("wrong job status: got '%v', expected '%v'", j.Status, StatusFailed)
+	}
+	if j.FailReason != FailTimeout || j.ExitCode != -1 || j.Signal == 0 {
+		t.Errorf("wrong failure: got reason '%v', exit code %v, signal %v", j.FailReason, j.ExitCode, j.Signal)
+	}
+}
+
+func TestJobTimeoutIgnoringTerm(t *testing.T) {
+	defer func(d time.Duration) { killGrace = d }(killGrace)
+	killGrace = 200 * time.Millisecond
+
+	j := NewJobCmd("sh", "-c", "trap '' TERM; sleep 10")
+	j.Timeout = 200 * time.Millisecond
+	j.log = ioutil.Discard
+
+	start := time.Now()
+	j.Execute(nil, ioutil.Discard)
+	if elapsed := time.Now().Sub(start); elapsed > 5*time.Second {
+		t.Errorf("job ignoring SIGTERM ran for %v, should have been killed after %v", elapsed, j.Timeout+killGrace)
+	}
+	if j.FailReason != FailTimeout {
+		t.Errorf("wrong fail reason: got '%v', want '%v'", j.FailReason, FailTimeout)
+	}
+}
+
+func TestJobFailReason(t *testing.T) {
+	tests := []struct {
+		cmd      []string
+		outfile  string
+		reason   string
+		exitcode int
+	}{
+		{[]string{"sh", "-c", "exit 3"}, "", FailNonzeroExit, 3},
+		{[]string{"sh", "-c", "kill -TERM $$"}, "", FailNonzeroExit, -1},
+		{[]string{"true"}, "missing.txt", FailMissingOutfile, 0},
+		{[]string{"rm", "-rf", "/"}, "", FailWhitelist, -1},
+		{[]string{"no-such-command-exists"}, "", FailSetup, -1},
+		{[]string{"true"}, "", "", 0},
+	}
+
+	for i, test := range tests {
+		j := NewJobCmd(test.cmd[0], test.cmd[1:]...)
+		if test.outfile != "" {
+			j.AddOutfile(test.outfile)
+		}
+		j.Whitelist("sh", "true", "no-such-command-exists")
+		j.log = ioutil.Discard
+
+		j.Execute(nil, ioutil.Discard)
+		if j.FailReason != test.reason || j.ExitCode != test.exitcode {
+			t.Errorf("job %v: got reason '%v' and exit code %v, want '%v' and %v", i, j.FailReason, j.ExitCode, test.reason, test.exitcode)
+		}
+	}
+}
+
+func TestJobConcurrentExecute(t *testing.T) {
+	wd, err := os.Getwd()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	n := 4
+	jobs := make([]*Job, n)
+	bufs := make([]bytes.Buffer, n)
+	var wg sync.WaitGroup
+	for i := range jobs {
+		j := NewJobCmd("sh", "-c", "sleep 0.2; cat in.txt > out.txt")
+		j.AddInfile("in.txt", []byte{byte('a' + i)})
+		j.AddOutfile("out.txt")
+		j.log = ioutil.Discard
+		jobs[i] = j
+
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			jobs[i].Execute(nil, &bufs[i])
+		}(i)
+	}
+	wg.Wait()
+
+	for i, j := range jobs {
+		if j.Status != StatusComplete {
+			t.Errorf("job %v failed: %v", i, j.Stderr)
+			continue
+		}
+		rc, err := j.GetOutfile(bytes.NewReader(bufs[i].Bytes()), bufs[i].Len(), "out.txt")
+		if err != nil {
+			t.Errorf("job %v: %v", i, err)
+			continue
+		}
+		data, _ := ioutil.ReadAll(rc)
+		rc.Close()
+		if want := string([]byte{byte('a' + i)}); string(data) != want {
+			t.Errorf("job %v: got output '%s', want '%s'", i, data, want)
+		}
+	}
+
+	if after, _ := os.Getwd(); after != wd {
+		t.Errorf("running jobs changed the working directory from %v to %v", wd, after)
+	}
+}
+
+func TestJobOutfilePatterns(t *testing.T) {
+	j := NewJobCmd("sh", "-c", "mkdir -p out/sub && cp in/x.txt out/a.txt && echo b > out/sub/b.txt && echo c > c.dat && echo d > d.dat")
+	j.AddInfile("in/x.txt", []byte("a"))
+	j.AddOutfile("out")
+	j.AddOutfile("*.dat")
+	j.AddOutfile("c.dat")
+	j.AddOptionalOutfile("*.h5")
+	j.log = ioutil.Discard
+
+	var buf bytes.Buffer
+	j.Execute(nil, &buf)
+	if j.Status != StatusComplete {
+		t.Fatalf("job failed: %v", j.Stderr)
+	}
+
+	r, err := zip.NewReader(bytes.NewReader(buf.Bytes()), int64(buf.Len()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	names := []string{}
+	for _, f := range r.File {
+		names = append(names, f.Name)
+	}
+	sort.Strings(names)
+	if want := "[c.dat d.dat out/a.txt out/sub/b.txt]"; fmt.Sprint(names) != want {
+		t.Errorf("wrong output files: got %v, want %v", names, want)
+	}
+	if j.Outfiles[0].Size != 3 || j.Outfiles[1].Size != 4 || j.Outfiles[3].Size != 0 {
+		t.Errorf("wrong output file sizes: %+v", j.Outfiles)
+	}
+
+	j = NewJobCmd("true")
+	j.AddOutfile("*.h5")
+	j.log = ioutil.Discard
+	j.Execute(nil, ioutil.Discard)
+	if j.Status != StatusFailed || j.FailReason != FailMissingOutfile {
+		t.Errorf("unmatched required outfile pattern: got status '%v' (%v), want failed (%v)", j.Status, j.FailReason, FailMissingOutfile)
+	}
+
+	j = NewJobCmd("true")
+	j.AddInfile("../escape.txt", []byte("x"))
+	j.log = ioutil.Discard
+	j.Execute(nil, ioutil.Discard)
+	if j.Status != StatusFailed || j.FailReason != FailSetup {
+		t.Errorf("input file outside the job directory: got status '%v' (%v), want failed (%v)", j.Status, j.FailReason, FailSetup)
+	}
+}
+
+func TestJobEnvStdinDir(t *testing.T) {
+	j := NewJobCmd("sh", "-c", `echo "$GREETING $(cat)" > out.txt; pwd > wd.txt`)
+	j.Env = map[string]string{"GREETING": "hello"}
+	j.Stdin = "in/name.txt"
+	j.Dir = "run"
+	j.AddInfile("in/name.txt", []byte("world"))
+	j.AddOutfile("run/out.txt")
+	j.AddOutfile("run/wd.txt")
+	j.AllowEnv([]string{"GREET*", "OMP_*"}, []string{"LD_*"})
+	j.log = ioutil.Discard
+
+	var buf bytes.Buffer
+	j.Execute(nil, &buf)
+	if j.Status != StatusComplete {
+		t.Fatalf("job failed: %v", j.Stderr)
+	}
+	for fname, want := range map[string]string{"run/out.txt": "hello world", "run/wd.txt": "/run"} {
+		rc, err := j.GetOutfile(bytes.NewReader(buf.Bytes()), buf.Len(), fname)
+		if err != nil {
+			t.Fatal(err)
+		}
+		data, _ := ioutil.ReadAll(rc)
+		rc.Close()
+		if got := strings.TrimSpace(string(data)); !strings.HasSuffix(got, want) {
+			t.Errorf("wrong %v contents: got '%v', want '%v'", fname, got, want)
+		}
+	}
+
+	for _, key := range []string{"LD_PRELOAD", "PATH"} {
+		j := NewJobCmd("true")
+		j.Env = map[string]string{key: "x"}
+		j.AllowEnv([]string{"OMP_*"}, []string{"LD_*"})
+		j.log = ioutil.Discard
+		j.Execute(nil, ioutil.Discard)
+		if j.Status != StatusFailed || j.FailReason != FailWhitelist {
+			t.Errorf("disallowed environment variable %v: got status '%v' (%v), want failed (%v)", key, j.Status, j.FailReason, FailWhitelist)
+		}
+	}
+
+	j = NewJobCmd("true")
+	j.Dir = "../.."
+	j.log = ioutil.Discard
+	j.Execute(nil, ioutil.Discard)
+	if j.Status != StatusFailed || j.FailReason != FailSetup {
+		t.Errorf("working dir outside the job directory: got status '%v' (%v), want failed (%v)", j.Status, j.FailReason, FailSetup)
+	}
 }
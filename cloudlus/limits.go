@@ -0,0 +1,62 @@
+package cloudlus
+
+import (
+	"fmt"
+	"time"
+)
+
+// Failure reasons recorded in Job.FailReason for jobs killed for exceeding
+// their resource limits.
+const (
+	FailMemoryLimit   = "memory-limit"
+	FailCPULimit      = "cpu-limit"
+	FailFileSizeLimit = "file-size-limit"
+	FailDiskLimit     = "disk-limit"
+)
+
+// limitPoll is how often the memory and scratch disk usage of jobs with
+// limits on them is checked.
+var limitPoll = 1 * time.Second
+
+// Limits restricts the resources a job's processes may use.  Limits are
+// enforced by workers running on Linux - jobs with limits fail on other
+// platforms.  Zero valued fields mean no limit.
+type Limits struct {
+	// MaxMemory is the maximum resident memory in MiB used by all of the
+	// job's processes together.  The address space of each process is
+	// limited to it as well, so allocations past it fail right away.
+	MaxMemory int
+	// MaxCPUTime is the maximum CPU time used by each of the job's
+	// processes.
+	MaxCPUTime time.Duration
+	// MaxOpenFiles is the maximum number of files each of the job's
+	// processes can have open at once.  Processes exceeding it get errors
+	// opening files rather than being killed.
+	MaxOpenFiles int
+	// MaxFileSize is the maximum size in MiB of any file written by the job.
+	MaxFileSize int
+	// MaxDisk is the maximum total size in MiB of all files in the job's
+	// scratch directory.
+	MaxDisk int
+	// Isolate runs the job in new user, mount and network namespaces - the
+	// job has no network access.
+	Isolate bool
+}
+
+func (l Limits) empty() bool { return l == Limits{} }
+
+// exceeded returns the message recorded in a job's stderr when it is killed
+// for the given failure reason.
+func (l Limits) exceeded(reason string) string {
+	switch reason {
+	case FailMemoryLimit:
+		return fmt.Sprintf("\nJob exceeded its memory limit of %v MiB\n", l.MaxMemory)
+	case FailCPULimit:
+		return fmt.Sprintf("\nJob exceeded its CPU time limit of %v\n", l.MaxCPUTime)
+	case FailFileSizeLimit:
+		return fmt.Sprintf("\nJob exceeded its file size limit of %v MiB\n", l.MaxFileSize)
+	case FailDiskLimit:
+		return fmt.Sprintf("\nJob exceeded its scratch disk limit of %v MiB\n", l.MaxDisk)
+	}
+	return fmt.Sprintf("\nJob exceeded its resource limits (%v)\n", reason)
+}
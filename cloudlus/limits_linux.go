@@ -0,0 +1,218 @@
+//go:build linux
+// +build linux
+
+package cloudlus
+
+import (
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+)
+
+// rlimitShim is the name the worker re-executes itself under to set the
+// rlimits of a job's process before exec'ing the job's command.  Go can't set
+// rlimits for a child before it execs, and setting them once the command
+// runs lets processes it forks in the meantime escape them.
+const rlimitShim = "cloudlus-rlimit"
+
+// shimReady is true once RunShim was called - only then does re-executing
+// the running binary start the shim.
+var shimReady bool
+
+// RunShim must be called at the start of main by programs running jobs with
+// resource limits (see Limits).  If the process was started as the rlimit
+// shim of a job, it sets the job's rlimits and execs the job's command
+// instead of returning.  Jobs with rlimits fail to start in programs that
+// don't call it.
+func RunShim() {
+	if len(os.Args) > 0 && os.Args[0] == rlimitShim {
+		execLimited(os.Args[1:])
+	}
+	shimReady = true
+}
+
+// rlimit is a limit on one resource of a process.
+type rlimit struct {
+	resource   int
+	soft, hard uint64
+}
+
+// rlimits returns the rlimits enforcing l.  Processes started by the job
+// inherit them.
+func (l Limits) rlimits() []rlimit {
+	lims := []rlimit{}
+	if l.MaxCPUTime > 0 {
+		secs := uint64((l.MaxCPUTime + time.Second - 1) / time.Second)
+		// SIGXCPU at the soft limit, SIGKILL a second later
+		lims = append(lims, rlimit{syscall.RLIMIT_CPU, secs, secs + 1})
+	}
+	if l.MaxOpenFiles > 0 {
+		n := uint64(l.MaxOpenFiles)
+		lims = append(lims, rlimit{syscall.RLIMIT_NOFILE, n, n})
+	}
+	if l.MaxFileSize > 0 {
+		n := uint64(l.MaxFileSize) * 1024 * 1024
+		lims = append(lims, rlimit{syscall.RLIMIT_FSIZE, n, n})
+	}
+	if l.MaxMemory > 0 {
+		// no single process may even reserve more than the whole job may use
+		n := uint64(l.MaxMemory) * 1024 * 1024
+		lims = append(lims, rlimit{syscall.RLIMIT_AS, n, n})
+	}
+	return lims
+}
+
+// prepare configures cmd to start in new namespaces if the job is to be
+// isolated and to run through the rlimit shim if it has rlimits.
+func (l Limits) prepare(cmd *exec.Cmd) error {
+	if l.Isolate {
+		attr := cmd.SysProcAttr
+		attr.Cloneflags = syscall.CLONE_NEWUSER | syscall.CLONE_NEWNS | syscall.CLONE_NEWNET
+		attr.UidMappings = []syscall.SysProcIDMap{{ContainerID: os.Getuid(), HostID: os.Getuid(), Size: 1}}
+		attr.GidMappings = []syscall.SysProcIDMap{{ContainerID: os.Getgid(), HostID: os.Getgid(), Size: 1}}
+	}
+
+	lims := l.rlimits()
+	if len(lims) == 0 || cmd.Err != nil {
+		// commands that weren't found fail to start as usual
+		return nil
+	} else if !shimReady {
+		return errors.New("job resource limits require the worker program to call cloudlus.RunShim")
+	}
+	args := []string{rlimitShim}
+	for _, lim := range lims {
+		args = append(args, fmt.Sprintf("%d:%d:%d", lim.resource, lim.soft, lim.hard))
+	}
+	cmd.Args = append(append(args, "--", cmd.Path), cmd.Args...)
+	// the running worker binary - even if it was replaced on disk since
+	cmd.Path = "/proc/self/exe"
+	return nil
+}
+
+// execLimited runs the rlimit shim: it sets the rlimits in args (as
+// formatted by prepare) and execs the command following them.  It never
+// returns.
+func execLimited(args []string) {
+	i := 0
+	for ; i < len(args) && args[i] != "--"; i++ {
+		var lim rlimit
+		_, err := fmt.Sscanf(args[i], "%d:%d:%d", &lim.resource, &lim.soft, &lim.hard)
+		if err == nil {
+			err = syscall.Setrlimit(lim.resource, &syscall.Rlimit{Cur: lim.soft, Max: lim.hard})
+		}
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "failed to set resource limits: %v\n", err)
+			os.Exit(127)
+		}
+	}
+	if i+2 >= len(args) {
+		fmt.Fprintf(os.Stderr, "%v: no command to run\n", rlimitShim)
+		os.Exit(127)
+	}
+
+	path, argv := args[i+1], args[i+2:]
+	err := syscall.Exec(path, argv, os.Environ())
+	fmt.Fprintf(os.Stderr, "%v: %v\n", argv[0], err)
+	os.Exit(127)
+}
+
+// watch checks the resident memory of all processes in process group pgid
+// and the size of all files in dir every limitPoll until done is closed.  If
+// a limit is exceeded, the failure reason is sent on the returned channel.
+// RLIMIT_AS only bounds each process on its own, so the memory of all of
+// them together is sampled here.
+func (l Limits) watch(pgid int, dir string, done chan bool) chan string {
+	exceeded := make(chan string, 1)
+	if l.MaxMemory <= 0 && l.MaxDisk <= 0 {
+		return exceeded
+	}
+
+	go func() {
+		tick := time.NewTicker(limitPoll)
+		defer tick.Stop()
+		for {
+			select {
+			case <-tick.C:
+			case <-done:
+				return
+			}
+
+			if l.MaxMemory > 0 && groupRSS(pgid) > int64(l.MaxMemory)*1024*1024 {
+				exceeded <- FailMemoryLimit
+				return
+			} else if l.MaxDisk > 0 && dirSize(dir) > int64(l.MaxDisk)*1024*1024 {
+				exceeded <- FailDiskLimit
+				return
+			}
+		}
+	}()
+	return exceeded
+}
+
+// classify returns the failure reason for a job process that was killed
+// by the kernel for exceeding one of its rlimits.
+func (l Limits) classify(state *os.ProcessState) string {
+	if state == nil {
+		return ""
+	}
+	ws, ok := state.Sys().(syscall.WaitStatus)
+	if !ok || !ws.Signaled() {
+		return ""
+	}
+
+	switch ws.Signal() {
+	case syscall.SIGXCPU:
+		return FailCPULimit
+	case syscall.SIGKILL:
+		if l.MaxCPUTime > 0 && state.UserTime()+state.SystemTime() >= l.MaxCPUTime {
+			return FailCPULimit
+		}
+	case syscall.SIGXFSZ:
+		return FailFileSizeLimit
+	}
+	return ""
+}
+
+// groupRSS returns the total resident memory in bytes of all processes in
+// process group pgid.
+func groupRSS(pgid int) int64 {
+	procs, _ := filepath.Glob("/proc/[0-9]*/stat")
+	var rss int64
+	for _, path := range procs {
+		data, err := ioutil.ReadFile(path)
+		if err != nil {
+			continue
+		}
+		// the command name field may contain spaces - skip past it
+		s := string(data)
+		fields := strings.Fields(s[strings.LastIndex(s, ")")+1:])
+		if len(fields) < 22 {
+			continue
+		}
+		if pgrp, _ := strconv.Atoi(fields[2]); pgrp != pgid {
+			continue
+		}
+		pages, _ := strconv.ParseInt(fields[21], 10, 64)
+		rss += pages * int64(os.Getpagesize())
+	}
+	return rss
+}
+
+// dirSize returns the total size in bytes of all files in dir.
+func dirSize(dir string) int64 {
+	var size int64
+	filepath.Walk(dir, func(path string, info os.FileInfo, err error) error {
+		if err == nil && info.Mode().IsRegular() {
+			size += info.Size()
+		}
+		return nil
+	})
+	return size
+}
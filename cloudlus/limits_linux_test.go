@@ -0,0 +1,108 @@
+package cloudlus
+
+import (
+	"io/ioutil"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestLimits(t *testing.T) {
+	limitPoll = 50 * time.Millisecond
+
+	tests := []struct {
+		cmd    string
+		limits Limits
+		reason string
+	}{
+		{"while :; do :; done", Limits{MaxCPUTime: 1 * time.Second}, FailCPULimit},
+		// only the process writing the file is signaled
+		{"exec dd if=/dev/zero of=f bs=1M count=2 2>/dev/null", Limits{MaxFileSize: 1}, FailFileSizeLimit},
+		{"for i in 1 2 3; do dd if=/dev/zero of=f$i bs=1M count=1 2>/dev/null; done; sleep 5", Limits{MaxDisk: 2}, FailDiskLimit},
+		{"echo hello", Limits{MaxMemory: 100, MaxOpenFiles: 10, MaxDisk: 1}, ""},
+	}
+
+	for i, test := range tests {
+		j := NewJobCmd("sh", "-c", test.cmd)
+		j.Limits = test.limits
+		j.Timeout = 20 * time.Second
+		j.log = ioutil.Discard
+
+		j.Execute(nil, ioutil.Discard)
+		if test.reason == "" {
+			if j.Status != StatusComplete {
+				t.Errorf("job %v failed within its limits: %v", i, j.Stderr)
+			}
+			continue
+		}
+		if j.Status != StatusFailed {
+			t.Errorf("job %v: wrong status: got '%v', want '%v'", i, j.Status, StatusFailed)
+		}
+		if j.FailReason != test.reason {
+			t.Errorf("job %v: wrong fail reason: got '%v', want '%v'", i, j.FailReason, test.reason)
+		}
+		if !strings.Contains(j.Stderr, "exceeded its") {
+			t.Errorf("job %v: limit not reported in stderr: %q", i, j.Stderr)
+		}
+	}
+}
+
+func TestLimitsIsolate(t *testing.T) {
+	j := NewJobCmd("sh", "-c", "cat /proc/net/dev")
+	j.Limits.Isolate = true
+	j.log = ioutil.Discard
+
+	j.Execute(nil, ioutil.Discard)
+	if j.Status != StatusComplete {
+		t.Skipf("namespaces unavailable: %v", j.Stderr)
+	}
+	if strings.Contains(j.Stdout, "eth") {
+		t.Errorf("isolated job can see host network interfaces:\n%v", j.Stdout)
+	}
+}
+
+func TestLimitsBeforeExec(t *testing.T) {
+	// the limits must already be in place when the command starts
+	j := NewJobCmd("sh", "-c", "ulimit -n; ulimit -t; ulimit -v")
+	j.Limits = Limits{MaxOpenFiles: 10, MaxCPUTime: 5 * time.Second, MaxMemory: 100}
+	j.log = ioutil.Discard
+
+	j.Execute(nil, ioutil.Discard)
+	if j.Status != StatusComplete {
+		t.Fatalf("job failed: %v", j.Stderr)
+	}
+	if got := strings.Fields(j.Stdout); len(got) != 3 || got[0] != "10" || got[1] != "5" || got[2] != "102400" {
+		t.Errorf("job ran with wrong limits: got %q, want open files 10, cpu time 5 and address space 102400 KiB", j.Stdout)
+	}
+}
+
+func TestLimitsWithoutShim(t *testing.T) {
+	defer func() { shimReady = true }()
+	shimReady = false
+
+	j := NewJobCmd("echo", "hello")
+	j.Limits = Limits{MaxOpenFiles: 10}
+	j.log = ioutil.Discard
+
+	j.Execute(nil, ioutil.Discard)
+	if j.Status != StatusFailed || j.FailReason != FailSetup || !strings.Contains(j.Stderr, "RunShim") {
+		t.Errorf("job with limits started without the shim: status '%v', reason '%v', stderr %q", j.Status, j.FailReason, j.Stderr)
+	}
+}
+
+func TestLimitsKill(t *testing.T) {
+	// jobs over their limits are killed even if they ignore SIGTERM
+	j := NewJobCmd("sh", "-c", "trap '' TERM; dd if=/dev/zero of=f bs=1M count=3 2>/dev/null; sleep 30")
+	j.Limits = Limits{MaxDisk: 2}
+	j.Timeout = 60 * time.Second
+	j.log = ioutil.Discard
+
+	start := time.Now()
+	j.Execute(nil, ioutil.Discard)
+	if elapsed := time.Now().Sub(start); elapsed > 10*time.Second {
+		t.Errorf("job over its limits ran for %v", elapsed)
+	}
+	if j.FailReason != FailDiskLimit {
+		t.Errorf("wrong fail reason: got '%v', want '%v'", j.FailReason, FailDiskLimit)
+	}
+}
@@ -0,0 +1,26 @@
+//go:build !linux
+// +build !linux
+
+package cloudlus
+
+import (
+	"errors"
+	"os"
+	"os/exec"
+)
+
+// RunShim must be called at the start of main by programs running jobs with
+// resource limits.  Limits are only supported on linux, so it does nothing
+// here.
+func RunShim() {}
+
+func (l Limits) prepare(cmd *exec.Cmd) error {
+	if !l.empty() {
+		return errors.New("job resource limits are only supported on linux")
+	}
+	return nil
+}
+
+func (l Limits) watch(pgid int, dir string, done chan bool) chan string { return make(chan string) }
+
+func (l Limits) classify(state *os.ProcessState) string { return "" }
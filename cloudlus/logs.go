@@ -0,0 +1,176 @@
+package cloudlus
+
+import (
+	"fmt"
+	"sync"
+	"time"
+)
+
+// LogTailSize is the number of trailing bytes of each running job's combined
+// stdout and stderr kept by the server for streaming to clients.
+var LogTailSize = 64 * 1024
+
+// logInterval is how often workers send new job output to the server.
+const logInterval = 1 * time.Second
+
+// maxLogWait is the longest time the server waits for new output before
+// responding to a log request.
+const maxLogWait = 30 * time.Second
+
+// logKeep is how long the server keeps the streamed output of finished jobs
+// so clients following it can catch up before it is dropped.
+const logKeep = 1 * time.Minute
+
+// LogChunk holds a piece of a job's combined stdout and stderr output stream.
+type LogChunk struct {
+	JobId    JobId
+	WorkerId WorkerId
+	Data     []byte
+	// Offset is the position of Data in the job's output stream.  When
+	// reading, a client that fell behind by more than the server's tail size
+	// receives data starting after the requested offset.
+	Offset int64
+	// Done is true if the job has finished and no more output will follow.
+	Done bool
+}
+
+// LogRequest asks for the output of a job following Offset.  If no output
+// is available yet, the server waits up to Wait for more.
+type LogRequest struct {
+	JobId  JobId
+	Offset int64
+	Wait   time.Duration
+}
+
+// Next returns the offset of the output following c.
+func (c *LogChunk) Next() int64 { return c.Offset + int64(len(c.Data)) }
+
+// jobLog holds the tail end of a job's streamed output.
+type jobLog struct {
+	tail []byte
+	// size is the total number of bytes streamed.
+	size int64
+	// wait is closed (and replaced) whenever output is appended or the job
+	// finishes.
+	wait     chan struct{}
+	finished time.Time
+}
+
+func (l *jobLog) notify() {
+	close(l.wait)
+	l.wait = make(chan struct{})
+}
+
+// jobLogs tracks the streamed output of running jobs.  It is only used from
+// the server's dispatcher goroutine.
+type jobLogs map[JobId]*jobLog
+
+func (l jobLogs) get(jid JobId) *jobLog {
+	jl, ok := l[jid]
+	if !ok {
+		jl = &jobLog{wait: make(chan struct{})}
+		l[jid] = jl
+	}
+	return jl
+}
+
+// append adds data to the end of job jid's output keeping at most
+// LogTailSize bytes.
+func (l jobLogs) append(jid JobId, data []byte) {
+	jl := l.get(jid)
+	jl.tail = append(jl.tail, data...)
+	if n := len(jl.tail) - LogTailSize; n > 0 {
+		jl.tail = append([]byte{}, jl.tail[n:]...)
+	}
+	jl.size += int64(len(data))
+	jl.notify()
+}
+
+// read returns the output of job jid following offset and a channel that is
+// closed when more output is available.  ok is false if the output of jid
+// isn't tracked.
+func (l jobLogs) read(jid JobId, offset int64) (c *LogChunk, wait chan struct{}, ok bool) {
+	jl, ok := l[jid]
+	if !ok {
+		return nil, nil, false
+	}
+
+	start := jl.size - int64(len(jl.tail))
+	if offset < start {
+		offset = start
+	} else if offset > jl.size {
+		offset = jl.size
+	}
+	c = &LogChunk{
+		JobId:  jid,
+		Data:   append([]byte{}, jl.tail[offset-start:]...),
+		Offset: offset,
+		Done:   !jl.finished.IsZero(),
+	}
+	return c, jl.wait, true
+}
+
+// restart marks the start of attempt number attempt of job jid on worker
+// wid.  Output of earlier attempts is kept and separated from the new
+// attempt's output by a line announcing it, so offsets of followers stay
+// valid.
+func (l jobLogs) restart(jid JobId, attempt int, wid WorkerId) {
+	jl, ok := l[jid]
+	if !ok {
+		return
+	}
+	jl.finished = time.Time{}
+	if jl.size == 0 {
+		return
+	}
+	sep := fmt.Sprintf("--- attempt %v (worker %v) ---\n", attempt, wid)
+	if n := len(jl.tail); n > 0 && jl.tail[n-1] != '\n' {
+		sep = "\n" + sep
+	}
+	l.append(jid, []byte(sep))
+}
+
+// finish marks the output of job jid as complete and wakes all readers.
+func (l jobLogs) finish(jid JobId) {
+	if jl, ok := l[jid]; ok && jl.finished.IsZero() {
+		jl.finished = time.Now()
+		jl.notify()
+	}
+}
+
+// expire drops the output of jobs that finished more than logKeep ago.
+func (l jobLogs) expire() {
+	now := time.Now()
+	for jid, jl := range l {
+		if !jl.finished.IsZero() && now.Sub(jl.finished) > logKeep {
+			delete(l, jid)
+		}
+	}
+}
+
+// logStreamer buffers a running job's output until it is sent to the
+// server.
+type logStreamer struct {
+	mu  sync.Mutex
+	buf []byte
+}
+
+func (ls *logStreamer) Write(p []byte) (int, error) {
+	ls.mu.Lock()
+	defer ls.mu.Unlock()
+	ls.buf = append(ls.buf, p...)
+	// the server only keeps the tail anyway
+	if n := len(ls.buf) - LogTailSize; n > 0 {
+		ls.buf = append([]byte{}, ls.buf[n:]...)
+	}
+	return len(p), nil
+}
+
+// take returns and clears the buffered output.
+func (ls *logStreamer) take() []byte {
+	ls.mu.Lock()
+	defer ls.mu.Unlock()
+	data := ls.buf
+	ls.buf = nil
+	return data
+}
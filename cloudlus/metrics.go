@@ -0,0 +1,148 @@
+package cloudlus
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"math"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// jobTimeBuckets are the upper bounds in seconds of the job wait and run
+// time histogram buckets.
+var jobTimeBuckets = []float64{1, 5, 15, 60, 5 * 60, 15 * 60, 3600, 4 * 3600, 12 * 3600, 24 * 3600}
+
+// gcTimeBuckets are the upper bounds in seconds of the db garbage collection
+// duration histogram buckets.
+var gcTimeBuckets = []float64{.01, .05, .1, .5, 1, 5, 15, 60}
+
+// histogram counts observations in buckets like a Prometheus histogram.  It
+// is not safe for concurrent use.
+type histogram struct {
+	bounds []float64
+	// counts holds the number of observations in each bucket - the last
+	// one counts observations above all bounds.
+	counts []int
+	sum    float64
+	n      int
+}
+
+func newHistogram(bounds ...float64) *histogram {
+	return &histogram{bounds: bounds, counts: make([]int, len(bounds)+1)}
+}
+
+func (h *histogram) observe(v float64) {
+	i := 0
+	for i < len(h.bounds) && v > h.bounds[i] {
+		i++
+	}
+	h.counts[i]++
+	h.sum += v
+	h.n++
+}
+
+// write writes h in the Prometheus text format as metric name.
+func (h *histogram) write(w io.Writer, name, help string) {
+	writeHeader(w, name, "histogram", help)
+	cum := 0
+	for i, bound := range h.bounds {
+		cum += h.counts[i]
+		fmt.Fprintf(w, "%v_bucket{le=\"%v\"} %v\n", name, formatFloat(bound), cum)
+	}
+	fmt.Fprintf(w, "%v_bucket{le=\"+Inf\"} %v\n", name, h.n)
+	fmt.Fprintf(w, "%v_sum %v\n", name, formatFloat(h.sum))
+	fmt.Fprintf(w, "%v_count %v\n", name, h.n)
+}
+
+func (h *histogram) clone() *histogram {
+	c := *h
+	c.counts = append([]int{}, h.counts...)
+	return &c
+}
+
+func writeHeader(w io.Writer, name, typ, help string) {
+	fmt.Fprintf(w, "# HELP %v %v\n# TYPE %v %v\n", name, help, name, typ)
+}
+
+func writeMetric(w io.Writer, name, typ, help string, v float64) {
+	writeHeader(w, name, typ, help)
+	fmt.Fprintf(w, "%v %v\n", name, formatFloat(v))
+}
+
+func formatFloat(v float64) string { return strconv.FormatFloat(v, 'g', -1, 64) }
+
+// labelEscaper escapes label values in the Prometheus text format.
+var labelEscaper = strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`)
+
+// handleMetrics serves the server's statistics in the Prometheus text
+// exposition format.
+func (s *Server) handleMetrics(w http.ResponseWriter, r *http.Request) {
+	s.statsmu.Lock()
+	st := s.stats
+	waittime, runtime, gctime := s.waittime.clone(), s.runtime.clone(), s.gctime.clone()
+	s.statsmu.Unlock()
+
+	dbsize, err := s.alljobs.Size()
+	if err != nil {
+		httperror(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	workers := s.Workers()
+
+	var buf bytes.Buffer
+	writeMetric(&buf, "cloudlus_jobs_queued", "gauge", "Number of jobs waiting in the queue to be run.", float64(st.CurrQueued))
+	writeMetric(&buf, "cloudlus_jobs_running", "gauge", "Number of jobs currently running on workers.", float64(st.CurrRunning))
+	writeMetric(&buf, "cloudlus_jobs_submitted_total", "counter", "Jobs submitted to the server.", float64(st.NSubmitted))
+	writeMetric(&buf, "cloudlus_jobs_completed_total", "counter", "Jobs completed successfully.", float64(st.NCompleted))
+	writeMetric(&buf, "cloudlus_jobs_failed_total", "counter", "Jobs failed after using up their retries.", float64(st.NFailed))
+	writeMetric(&buf, "cloudlus_jobs_canceled_total", "counter", "Jobs canceled by request.", float64(st.NCanceled))
+	writeMetric(&buf, "cloudlus_jobs_requeued_total", "counter", "Job attempts requeued after failing, losing their worker or being released.", float64(st.NRequeued))
+	writeMetric(&buf, "cloudlus_jobs_purged_total", "counter", "Old jobs purged from the job database.", float64(st.NPurged))
+	writeMetric(&buf, "cloudlus_cache_hits_total", "counter", "Jobs completed with memoized results.", float64(st.NCacheHits))
+	writeMetric(&buf, "cloudlus_cache_misses_total", "counter", "Jobs without memoized results.", float64(st.NCacheMisses))
+	writeMetric(&buf, "cloudlus_heartbeats_total", "counter", "Heartbeats received from workers running jobs.", float64(st.NHeartbeats))
+	writeMetric(&buf, "cloudlus_db_size_bytes", "gauge", "Size of the job database.", float64(dbsize))
+	if !st.Started.IsZero() {
+		writeMetric(&buf, "cloudlus_start_time_seconds", "gauge", "Time the server started as a unix timestamp.", float64(st.Started.Unix()))
+	}
+	waittime.write(&buf, "cloudlus_job_wait_seconds", "Time jobs were queued before being dispatched to a worker.")
+	runtime.write(&buf, "cloudlus_job_run_seconds", "Run time of job attempts.")
+	gctime.write(&buf, "cloudlus_db_gc_seconds", "Duration of job database garbage collection runs.")
+
+	writeMetric(&buf, "cloudlus_workers", "gauge", "Number of workers that recently contacted the server.", float64(len(workers)))
+	perworker := []struct {
+		name, typ, help string
+		value           func(ws *WorkerStat) float64
+	}{
+		{"cloudlus_worker_running_jobs", "gauge", "Number of jobs running on the worker.", func(ws *WorkerStat) float64 { return float64(len(ws.Jobs)) }},
+		{"cloudlus_worker_free_cpus", "gauge", "Free CPUs reported by the worker.", func(ws *WorkerStat) float64 { return float64(ws.CPUs) }},
+		{"cloudlus_worker_free_memory_bytes", "gauge", "Free memory reported by the worker.", func(ws *WorkerStat) float64 {
+			if ws.Memory < 0 {
+				return math.Inf(1) // unlimited
+			}
+			return float64(ws.Memory) * MB
+		}},
+		{"cloudlus_worker_last_seen_seconds", "gauge", "Time since the worker last fetched a job or sent a heartbeat.", func(ws *WorkerStat) float64 { return time.Now().Sub(ws.LastSeen).Seconds() }},
+		{"cloudlus_worker_draining", "gauge", "1 if the worker has been asked to drain.", func(ws *WorkerStat) float64 {
+			if ws.Draining {
+				return 1
+			}
+			return 0
+		}},
+		{"cloudlus_worker_jobs_completed_total", "counter", "Jobs completed by the worker.", func(ws *WorkerStat) float64 { return float64(ws.NCompleted) }},
+		{"cloudlus_worker_jobs_failed_total", "counter", "Job attempts failed on the worker.", func(ws *WorkerStat) float64 { return float64(ws.NFailed) }},
+	}
+	for _, m := range perworker {
+		writeHeader(&buf, m.name, m.typ, m.help)
+		for i := range workers {
+			ws := &workers[i]
+			fmt.Fprintf(&buf, "%v{worker=\"%v\",host=\"%v\"} %v\n", m.name, ws.Id, labelEscaper.Replace(ws.Host), formatFloat(m.value(ws)))
+		}
+	}
+
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+	w.Write(buf.Bytes())
+}
@@ -0,0 +1,85 @@
+package cloudlus
+
+import (
+	"bytes"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestHistogram(t *testing.T) {
+	h := newHistogram(1, 10)
+	for _, v := range []float64{0.5, 1, 3, 20} {
+		h.observe(v)
+	}
+
+	var buf bytes.Buffer
+	h.write(&buf, "x", "test")
+	want := `# HELP x test
+# TYPE x histogram
+x_bucket{le="1"} 2
+x_bucket{le="10"} 3
+x_bucket{le="+Inf"} 4
+x_sum 24.5
+x_count 4
+`
+	if buf.String() != want {
+		t.Errorf("wrong histogram output:\ngot\n%v\nwant\n%v", buf.String(), want)
+	}
+}
+
+func TestMetrics(t *testing.T) {
+	db, _ := NewDB("", dblimit)
+	s := NewServer(testaddr, testaddr, db, nil, nil)
+	nolog(s)
+	go s.dispatcher()
+	defer s.Close()
+
+	ts := httptest.NewServer(s.handler(ServiceAdmin))
+	defer ts.Close()
+
+	wid := WorkerId{1}
+	for i := 0; i < 2; i++ {
+		s.Start(NewJobCmd("echo", "1"), nil)
+	}
+	j := fetch(s, wid)
+	b := NewBeat(wid, j.Id)
+	b.kill = make(chan bool)
+	s.beat <- b
+	<-b.kill
+	j.WorkerId = wid
+	j.Status = StatusComplete
+	s.pushjobs <- j
+	s.Get(j.Id)
+
+	resp, err := http.Get(ts.URL + "/metrics")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	data, _ := ioutil.ReadAll(resp.Body)
+	metrics := string(data)
+
+	for _, line := range []string{
+		"cloudlus_jobs_queued 1",
+		"cloudlus_jobs_running 0",
+		"cloudlus_jobs_submitted_total 2",
+		"cloudlus_jobs_completed_total 1",
+		"cloudlus_jobs_failed_total 0",
+		"cloudlus_heartbeats_total 1",
+		"cloudlus_job_wait_seconds_count 1",
+		"cloudlus_job_run_seconds_count 1",
+		"cloudlus_workers 1",
+		`cloudlus_worker_jobs_completed_total{worker="` + wid.String() + `",host=""} 1`,
+		"# TYPE cloudlus_db_size_bytes gauge",
+	} {
+		if !strings.Contains(metrics, line+"\n") {
+			t.Errorf("metrics missing '%v'", line)
+		}
+	}
+	if t.Failed() {
+		t.Logf("metrics:\n%v", metrics)
+	}
+}
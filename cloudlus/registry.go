@@ -0,0 +1,140 @@
+package cloudlus
+
+import (
+	"fmt"
+	"sort"
+	"time"
+)
+
+// WorkerExpiry is the length of time after which workers that have stopped
+// fetching jobs and sending heartbeats are dropped from the worker registry.
+var WorkerExpiry = 5 * time.Minute
+
+// WorkerStat holds the status of a worker as seen by the server.
+type WorkerStat struct {
+	Id     WorkerId
+	Host   string
+	Labels []string
+	// CPUs and Memory are the free resources the worker reported on its
+	// last fetch.  Memory is negative if it is unlimited.
+	CPUs   int
+	Memory int
+	// Started is the time the worker started running.
+	Started  time.Time
+	Uptime   time.Duration
+	LastSeen time.Time
+	// Jobs holds the ids of the jobs currently running on the worker.
+	Jobs       []JobId
+	NCompleted int
+	NFailed    int
+	// Draining is true if the worker has been asked to shut down after
+	// finishing its running jobs.
+	Draining bool
+}
+
+// registry tracks all workers that have recently contacted the server.  It
+// is only used from the server's dispatcher goroutine.
+type registry map[WorkerId]*WorkerStat
+
+// fetched updates the registry with the info a worker sent with a fetch.
+// True is returned if the worker has been asked to drain.
+func (r registry) fetched(info *WorkerInfo) (drain bool) {
+	ws := r.get(info.Id)
+	ws.Host = info.Host
+	ws.Labels = info.Labels
+	ws.CPUs = info.CPUs
+	ws.Memory = info.Memory
+	ws.Started = info.Started
+	ws.LastSeen = time.Now()
+	return ws.Draining
+}
+
+// drain marks worker wid (or all workers if all is true) as draining.
+func (r registry) drain(wid WorkerId, all bool) error {
+	if all {
+		for _, ws := range r {
+			ws.Draining = true
+		}
+		return nil
+	}
+
+	ws, ok := r[wid]
+	if !ok {
+		return fmt.Errorf("unknown worker id %v", wid)
+	}
+	ws.Draining = true
+	return nil
+}
+
+// beat updates the last seen time of the worker sending b.
+func (r registry) beat(b Beat) { r.get(b.WorkerId).LastSeen = b.Time }
+
+// finished records the final outcome of a job attempt run by worker wid.
+func (r registry) finished(wid WorkerId, status string) {
+	ws, ok := r[wid]
+	if !ok {
+		return
+	} else if status == StatusComplete {
+		ws.NCompleted++
+	} else if status == StatusFailed {
+		ws.NFailed++
+	}
+}
+
+// expire removes workers that haven't been seen for longer than
+// WorkerExpiry and are not running any of the jobs in jobinfo.
+func (r registry) expire(jobinfo map[JobId]Beat) {
+	busy := map[WorkerId]bool{}
+	for _, b := range jobinfo {
+		busy[b.WorkerId] = true
+	}
+
+	now := time.Now()
+	for wid, ws := range r {
+		if !busy[wid] && now.Sub(ws.LastSeen) > WorkerExpiry {
+			delete(r, wid)
+		}
+	}
+}
+
+func (r registry) get(wid WorkerId) *WorkerStat {
+	ws, ok := r[wid]
+	if !ok {
+		ws = &WorkerStat{Id: wid}
+		r[wid] = ws
+	}
+	return ws
+}
+
+// list returns a copy of the status of all registered workers (sorted by
+// host) with their current jobs taken from jobinfo.
+func (r registry) list(jobinfo map[JobId]Beat) []WorkerStat {
+	jobs := map[WorkerId][]JobId{}
+	for jid, b := range jobinfo {
+		jobs[b.WorkerId] = append(jobs[b.WorkerId], jid)
+	}
+
+	now := time.Now()
+	stats := make([]WorkerStat, 0, len(r))
+	for wid, ws := range r {
+		stat := *ws
+		stat.Jobs = jobs[wid]
+		if !stat.Started.IsZero() {
+			stat.Uptime = now.Sub(stat.Started)
+		}
+		stats = append(stats, stat)
+	}
+	sort.Sort(byHost(stats))
+	return stats
+}
+
+type byHost []WorkerStat
+
+func (s byHost) Len() int      { return len(s) }
+func (s byHost) Swap(i, j int) { s[i], s[j] = s[j], s[i] }
+func (s byHost) Less(i, j int) bool {
+	if s[i].Host != s[j].Host {
+		return s[i].Host < s[j].Host
+	}
+	return s[i].Id.String() < s[j].Id.String()
+}
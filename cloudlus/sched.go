@@ -0,0 +1,239 @@
+package cloudlus
+
+import "sort"
+
+// Scheduler decides which queued jobs are dispatched to workers and in what
+// order.  A server's scheduler is only used from its dispatcher goroutine, so
+// implementations need not be safe for concurrent use.
+type Scheduler interface {
+	// Enqueue adds a newly queued job.
+	Enqueue(j *Job)
+	// Dequeue removes and returns the id of the next job to run on the given
+	// worker.  Jobs the worker cannot run (see WorkerInfo.CanRun) must be
+	// skipped.  A nil worker can run any job.  False is returned if there are
+	// no jobs for the worker.
+	Dequeue(w *WorkerInfo) (JobId, bool)
+	// Requeue returns a previously dequeued job to the queue (e.g. because
+	// its worker stopped responding).
+	Requeue(j *Job)
+	// Remove removes the job with the given id from the queue.  False is
+	// returned if the job wasn't queued.
+	Remove(id JobId) bool
+	// Snapshot returns the ids of all queued jobs in the order they would be
+	// dispatched.
+	Snapshot() []JobId
+	// Len returns the number of queued jobs.
+	Len() int
+}
+
+// schedStub returns a copy of j holding only the fields schedulers need to
+// order jobs and match them to workers - leaving out bulky file data.
+func schedStub(j *Job) *Job {
+	stub := &Job{
+		Id:        j.Id,
+		Owner:     j.Owner,
+		Priority:  j.Priority,
+		Submitted: j.Submitted,
+		Requires:  j.Requires,
+		MinMemory: j.MinMemory,
+		MinCPUs:   j.MinCPUs,
+	}
+	if len(j.Cmd) > 0 {
+		stub.Cmd = j.Cmd[:1]
+	}
+	return stub
+}
+
+// FIFOScheduler dispatches jobs in the order they were queued.  Requeued
+// jobs are dispatched before all others.
+type FIFOScheduler struct {
+	queue []*Job
+}
+
+func NewFIFOScheduler() *FIFOScheduler { return &FIFOScheduler{} }
+
+func (s *FIFOScheduler) Enqueue(j *Job) { s.queue = append(s.queue, schedStub(j)) }
+
+func (s *FIFOScheduler) Dequeue(w *WorkerInfo) (JobId, bool) {
+	for i, j := range s.queue {
+		if w.CanRun(j) {
+			s.queue = append(s.queue[:i], s.queue[i+1:]...)
+			return j.Id, true
+		}
+	}
+	return JobId{}, false
+}
+
+func (s *FIFOScheduler) Requeue(j *Job) { s.queue = append([]*Job{schedStub(j)}, s.queue...) }
+
+func (s *FIFOScheduler) Remove(id JobId) bool {
+	for i, j := range s.queue {
+		if j.Id == id {
+			s.queue = append(s.queue[:i], s.queue[i+1:]...)
+			return true
+		}
+	}
+	return false
+}
+
+func (s *FIFOScheduler) Snapshot() []JobId {
+	ids := make([]JobId, len(s.queue))
+	for i, j := range s.queue {
+		ids[i] = j.Id
+	}
+	return ids
+}
+
+func (s *FIFOScheduler) Len() int { return len(s.queue) }
+
+// FairScheduler dispatches jobs using weighted fair share scheduling across
+// job owners.  Each owner's jobs are ordered by priority (highest first) and
+// then by submission time.  The next job is always taken from the owner with
+// queued jobs that has been served the smallest weighted share of dispatched
+// jobs.  With a single owner and equal priorities, this is FIFO order.
+type FairScheduler struct {
+	// Weights holds the fair share weight of each owner.  An owner with
+	// weight 2 is dispatched twice as many jobs as an owner with weight 1
+	// when both have jobs queued.  Owners not listed have weight 1.
+	Weights map[string]float64
+	owners  map[string]*ownerQueue
+	n       int
+}
+
+// before returns true if a should be dispatched before b when both belong to
+// the same owner.
+func before(a, b *Job) bool {
+	if a.Priority != b.Priority {
+		return a.Priority > b.Priority
+	}
+	return a.Submitted.Before(b.Submitted)
+}
+
+type ownerQueue struct {
+	owner string
+	jobs  []*Job
+	// served is the number of jobs dispatched for the owner divided by the
+	// owner's weight.
+	served float64
+}
+
+func NewFairScheduler() *FairScheduler {
+	return &FairScheduler{
+		Weights: map[string]float64{},
+		owners:  map[string]*ownerQueue{},
+	}
+}
+
+// weight returns the fair share weight for owner - defaulting to 1.
+func (s *FairScheduler) weight(owner string) float64 {
+	if w, ok := s.Weights[owner]; ok && w > 0 {
+		return w
+	}
+	return 1
+}
+
+func (s *FairScheduler) Enqueue(j *Job) {
+	oq, ok := s.owners[j.Owner]
+	if !ok {
+		oq = &ownerQueue{owner: j.Owner}
+		s.owners[j.Owner] = oq
+	}
+
+	if len(oq.jobs) == 0 {
+		// owners becoming active start level with the least served active
+		// owner.  They get no credit for the time they were idle - otherwise
+		// they could starve everyone else until catching up - and aren't held
+		// back by jobs run while nobody else was waiting.
+		min, found := 0.0, false
+		for owner, other := range s.owners {
+			if owner != j.Owner && len(other.jobs) > 0 && (!found || other.served < min) {
+				min, found = other.served, true
+			}
+		}
+		oq.served = min
+	}
+
+	stub := schedStub(j)
+	i := sort.Search(len(oq.jobs), func(i int) bool { return before(stub, oq.jobs[i]) })
+	oq.jobs = append(oq.jobs, nil)
+	copy(oq.jobs[i+1:], oq.jobs[i:])
+	oq.jobs[i] = stub
+	s.n++
+}
+
+// ownerOrder sorts owner queues by the order they should be served in.
+type ownerOrder []*ownerQueue
+
+func (o ownerOrder) Len() int      { return len(o) }
+func (o ownerOrder) Swap(i, j int) { o[i], o[j] = o[j], o[i] }
+func (o ownerOrder) Less(i, j int) bool {
+	if o[i].served != o[j].served {
+		return o[i].served < o[j].served
+	}
+	return before(o[i].jobs[0], o[j].jobs[0])
+}
+
+// Dequeue returns the highest priority job the worker can run from the
+// owner with the smallest weighted share - moving on to owners with larger
+// shares only if the worker can't run any of the owner's jobs.
+func (s *FairScheduler) Dequeue(w *WorkerInfo) (JobId, bool) {
+	active := ownerOrder{}
+	for _, oq := range s.owners {
+		if len(oq.jobs) > 0 {
+			active = append(active, oq)
+		}
+	}
+	sort.Sort(active)
+
+	for _, oq := range active {
+		for i, j := range oq.jobs {
+			if !w.CanRun(j) {
+				continue
+			}
+			oq.jobs = append(oq.jobs[:i], oq.jobs[i+1:]...)
+			oq.served += 1 / s.weight(oq.owner)
+			s.n--
+			return j.Id, true
+		}
+	}
+	return JobId{}, false
+}
+
+// Requeue returns j to its original place amongst its owner's queued jobs
+// and refunds the owner's share for the lost dispatch.
+func (s *FairScheduler) Requeue(j *Job) {
+	s.Enqueue(j)
+	if oq := s.owners[j.Owner]; oq.served > 0 {
+		oq.served -= 1 / s.weight(j.Owner)
+	}
+}
+
+func (s *FairScheduler) Remove(id JobId) bool {
+	for _, oq := range s.owners {
+		for i, item := range oq.jobs {
+			if item.Id == id {
+				oq.jobs = append(oq.jobs[:i], oq.jobs[i+1:]...)
+				s.n--
+				return true
+			}
+		}
+	}
+	return false
+}
+
+func (s *FairScheduler) Snapshot() []JobId {
+	// simulate dispatching on a copy of the queue state
+	clone := &FairScheduler{Weights: s.Weights, owners: map[string]*ownerQueue{}, n: s.n}
+	for owner, oq := range s.owners {
+		jobs := append([]*Job{}, oq.jobs...)
+		clone.owners[owner] = &ownerQueue{owner: owner, jobs: jobs, served: oq.served}
+	}
+
+	ids := make([]JobId, 0, s.n)
+	for id, ok := clone.Dequeue(nil); ok; id, ok = clone.Dequeue(nil) {
+		ids = append(ids, id)
+	}
+	return ids
+}
+
+func (s *FairScheduler) Len() int { return s.n }
@@ -0,0 +1,225 @@
+package cloudlus
+
+import (
+	"testing"
+	"time"
+)
+
+func queuejob(owner string, priority int, submitted time.Time) *Job {
+	j := NewJob()
+	j.Owner = owner
+	j.Priority = priority
+	j.Submitted = submitted
+	return j
+}
+
+func TestFairScheduler_Priority(t *testing.T) {
+	q := NewFairScheduler()
+	t0 := time.Now()
+
+	low := queuejob("alice", 0, t0)
+	high := queuejob("alice", 5, t0.Add(time.Second))
+	late := queuejob("alice", 0, t0.Add(2*time.Second))
+	q.Enqueue(late)
+	q.Enqueue(low)
+	q.Enqueue(high)
+
+	for i, want := range []*Job{high, low, late} {
+		got, ok := q.Dequeue(nil)
+		if !ok {
+			t.Fatalf("queue empty after %v pops", i)
+		} else if got != want.Id {
+			t.Errorf("pop %v: got job %v, want %v", i, got, want.Id)
+		}
+	}
+	if _, ok := q.Dequeue(nil); ok {
+		t.Errorf("queue should be empty")
+	}
+}
+
+func TestFairScheduler_Snapshot(t *testing.T) {
+	q := NewFairScheduler()
+	t0 := time.Now()
+
+	jobs := []*Job{
+		queuejob("alice", 0, t0),
+		queuejob("alice", 0, t0.Add(1)),
+		queuejob("bob", 0, t0.Add(2)),
+		queuejob("bob", 0, t0.Add(3)),
+	}
+	for _, j := range jobs {
+		q.Enqueue(j)
+	}
+
+	// requeued jobs go back to their original place
+	id, _ := q.Dequeue(nil)
+	q.Requeue(jobs[0])
+	if !q.Remove(jobs[3].Id) {
+		t.Errorf("failed to remove queued job")
+	}
+
+	want := []JobId{jobs[0].Id, jobs[2].Id, jobs[1].Id}
+	got := q.Snapshot()
+	if id != jobs[0].Id {
+		t.Errorf("dequeued wrong job: got %v, want %v", id, jobs[0].Id)
+	}
+	if len(got) != len(want) {
+		t.Fatalf("wrong snapshot length: got %v, want %v", len(got), len(want))
+	}
+	for i := range want {
+		if got[i] != want[i] {
+			t.Errorf("snapshot[%v]: got %v, want %v", i, got[i], want[i])
+		}
+	}
+	if q.Len() != len(want) {
+		t.Errorf("snapshot modified scheduler: got len %v, want %v", q.Len(), len(want))
+	}
+}
+
+func TestFIFOScheduler(t *testing.T) {
+	q := NewFIFOScheduler()
+	jobs := []*Job{NewJob(), NewJob(), NewJob()}
+	for _, j := range jobs {
+		q.Enqueue(j)
+	}
+
+	id, _ := q.Dequeue(nil)
+	q.Remove(jobs[1].Id)
+	q.Requeue(jobs[0])
+
+	want := []JobId{jobs[0].Id, jobs[2].Id}
+	for i, w := range want {
+		got, ok := q.Dequeue(nil)
+		if !ok || got != w {
+			t.Errorf("dequeue %v: got %v, want %v", i, got, w)
+		}
+	}
+	if id != jobs[0].Id {
+		t.Errorf("dequeued wrong job: got %v, want %v", id, jobs[0].Id)
+	}
+	if q.Len() != 0 {
+		t.Errorf("queue should be empty")
+	}
+}
+
+func TestFairScheduler_FairShare(t *testing.T) {
+	q := NewFairScheduler()
+	q.Weights["bob"] = 2
+	t0 := time.Now()
+
+	// alice submits a big batch before anyone else
+	for i := 0; i < 100; i++ {
+		q.Enqueue(queuejob("alice", 0, t0.Add(time.Duration(i))))
+	}
+	for i := 0; i < 5; i++ {
+		q.Dequeue(nil)
+	}
+
+	// bob and carol show up later and shouldn't have to wait for alice's
+	// batch to finish - or get to starve alice until they catch up.
+	owners := map[JobId]string{}
+	for i := 0; i < 20; i++ {
+		for _, owner := range []string{"bob", "carol"} {
+			j := queuejob(owner, 0, t0.Add(time.Hour))
+			owners[j.Id] = owner
+			q.Enqueue(j)
+		}
+	}
+
+	counts := map[string]int{}
+	for i := 0; i < 40; i++ {
+		id, _ := q.Dequeue(nil)
+		if owner, ok := owners[id]; ok {
+			counts[owner]++
+		} else {
+			counts["alice"]++
+		}
+	}
+
+	if counts["alice"] != 10 || counts["carol"] != 10 || counts["bob"] != 20 {
+		t.Errorf("unfair dispatch counts: got %v, want alice=10 bob=20 carol=10", counts)
+	}
+	if n := q.Len(); n != 140-45 {
+		t.Errorf("wrong queue length: got %v, want %v", n, 140-45)
+	}
+}
+
+func TestFairScheduler_Reactivate(t *testing.T) {
+	q := NewFairScheduler()
+	t0 := time.Now()
+
+	// alice runs a big batch while nobody else is waiting and goes idle
+	for i := 0; i < 1000; i++ {
+		q.Enqueue(queuejob("alice", 0, t0))
+		q.Dequeue(nil)
+	}
+
+	// bob starts fresh instead of being held back by alice's batch
+	bob := map[JobId]bool{}
+	for i := 0; i < 20; i++ {
+		j := queuejob("bob", 0, t0.Add(time.Duration(i)))
+		bob[j.Id] = true
+		q.Enqueue(j)
+	}
+	for i := 0; i < 10; i++ {
+		q.Dequeue(nil)
+	}
+
+	// alice comes back and shares with bob right away rather than waiting
+	// for him to catch up on the batch she ran alone
+	for i := 0; i < 10; i++ {
+		q.Enqueue(queuejob("alice", 0, t0.Add(time.Duration(i))))
+	}
+	counts := map[string]int{}
+	for i := 0; i < 10; i++ {
+		id, _ := q.Dequeue(nil)
+		if bob[id] {
+			counts["bob"]++
+		} else {
+			counts["alice"]++
+		}
+	}
+	if counts["alice"] != 5 || counts["bob"] != 5 {
+		t.Errorf("unfair dispatch counts: got %v, want alice=5 bob=5", counts)
+	}
+}
+
+func TestScheduler_Requirements(t *testing.T) {
+	for _, q := range []Scheduler{NewFIFOScheduler(), NewFairScheduler()} {
+		t0 := time.Now()
+		big := queuejob("alice", 0, t0)
+		big.MinMemory = 4096
+		labeled := queuejob("alice", 0, t0.Add(1))
+		labeled.Requires = []string{"cyclus=1.3"}
+		labeled.Cmd = []string{"cyclus"}
+		plain := queuejob("bob", 0, t0.Add(2))
+		plain.Cmd = []string{"sh"}
+		for _, j := range []*Job{big, labeled, plain} {
+			q.Enqueue(j)
+		}
+
+		small := &WorkerInfo{CPUs: 1, Memory: 1024, Labels: []string{"cyclus=1.3"}}
+		if id, _ := q.Dequeue(small); id != labeled.Id {
+			t.Errorf("%T: small worker got job %v, want labeled job %v", q, id, labeled.Id)
+		}
+
+		restricted := &WorkerInfo{CPUs: 8, Memory: 8192, Whitelist: true, Commands: []string{"cyclus"}}
+		if id, _ := q.Dequeue(restricted); id != big.Id {
+			t.Errorf("%T: restricted worker got job %v, want big job %v", q, id, big.Id)
+		}
+		if _, ok := q.Dequeue(restricted); ok {
+			t.Errorf("%T: restricted worker got non-whitelisted job", q)
+		}
+		if id, _ := q.Dequeue(small); id != plain.Id {
+			t.Errorf("%T: small worker got job %v, want plain job %v", q, id, plain.Id)
+		}
+	}
+
+	// workers that can't detect their memory run jobs with any MinMemory
+	unknown := &WorkerInfo{CPUs: 1, Memory: -1}
+	big := NewJobCmd("echo", "1")
+	big.MinMemory = 4096
+	if !unknown.CanRun(big) {
+		t.Errorf("worker with unknown memory refused job with MinMemory")
+	}
+}
@@ -1,12 +1,16 @@
 package cloudlus
 
 import (
+	"crypto/tls"
+	"crypto/x509"
 	"errors"
 	"fmt"
 	"log"
 	"net/http"
 	"net/rpc"
 	"os"
+	"strings"
+	"sync"
 	"time"
 )
 
@@ -16,6 +20,9 @@ const dblimit = 7000 * MB
 
 var nojoberr = errors.New("no jobs available to run")
 
+// drainerr is returned to workers fetching jobs after being asked to drain.
+var drainerr = errors.New("worker drain requested")
+
 const defaultdbpath = "./jobdb"
 
 // defaultCollectFreq if the duration between old job purging from db.
@@ -25,105 +32,298 @@ const beatInterval = 15 * time.Second
 const beatLimit = 2 * beatInterval
 const beatCheckFreq = beatInterval / 3
 
+// MinLostRetries is the minimum number of times a job is requeued after
+// losing contact with the workers running it regardless of the job's
+// MaxRetries.
+var MinLostRetries = 3
+
+// attemptLost is the status of job attempts whose worker stopped responding.
+const attemptLost = "lost"
+
+// attemptDrained is the status of job attempts handed back by a draining
+// worker.
+const attemptDrained = "drained"
+
+// attemptSuperseded is the status of job attempts stopped because the result
+// of an earlier attempt arrived late.
+const attemptSuperseded = "superseded"
+
 type Server struct {
-	log          *log.Logger
-	serv         *http.Server
-	Host         string
-	CollectFreq  time.Duration
+	log         *log.Logger
+	Host        string
+	CollectFreq time.Duration
+	// Addrs holds the addresses the server listens on.
+	Addrs Addrs
+	// Memoize, if true, causes submitted jobs identical to a previously
+	// completed job (same command, input files and requested output files)
+	// to be completed immediately with a copy of the earlier job's results
+	// instead of being run.  Jobs with NoCache set are always run.
+	Memoize bool
+	// RequireAuth, if true, requires all requests to present an API token
+	// granting the role needed for the request (see Token).
+	RequireAuth bool
+	// TLS, if not nil, is used to serve all listeners over HTTPS.
+	TLS *tls.Config
+	// WorkerCAs, if not nil, restricts the worker service to clients
+	// presenting a certificate signed by one of its certificate authorities.
+	// It requires TLS.
+	WorkerCAs    *x509.CertPool
 	submitjobs   chan jobSubmit
 	submitchans  map[[16]byte]chan *Job
 	retrievejobs chan jobRequest
+	waitjobs     chan waitRequest
+	waiters      map[JobId]chan struct{}
 	pushjobs     chan *Job
 	fetchjobs    chan workRequest
-	reset        chan struct{}
-	queue        []JobId
-	alljobs      *DB
-	rpc          *RPC
+	reset        chan string
+	canceljobs   chan jobCancel
+	retryjobs    chan jobCancel
+	requeue      chan JobId
+	queue        Scheduler
+	alljobs      JobStore
+	outdata      BlobStore
+	servs        []*http.Server
+	servmu       sync.Mutex
 	jobinfo      map[JobId]Beat // map[Worker]Job
+	workers      registry
+	listworkers  chan chan []WorkerStat
+	drainworkers chan workerDrain
+	releasejobs  chan Beat
+	logs         jobLogs
+	appendlogs   chan LogChunk
+	readlogs     chan logRequest
 	beat         chan Beat
-	rpcaddr      string
 	kill         chan struct{}
-	Stats        *Stats
+	dispatchmu   sync.Mutex // held by the running dispatcher (see Close)
+	statsmu      sync.Mutex // guards stats and the histograms below
+	stats        Stats
+	waittime     *histogram
+	runtime      *histogram
+	gctime       *histogram
 }
 
+// Stats holds a server's job counters (see Server.Stats).
 type Stats struct {
-	Started     time.Time
-	NSubmitted  int
-	NCompleted  int
-	NFailed     int
-	NPurged     int
-	NRequeued   int
-	CurrQueued  int
-	CurrRunning int
+	Started    time.Time
+	NSubmitted int
+	NCompleted int
+	NFailed    int
+	NPurged    int
+	NRequeued  int
+	NCanceled  int
+	// NCacheHits and NCacheMisses count the jobs whose results were (or
+	// were not) found memoized when Memoize is enabled.
+	NCacheHits   int
+	NCacheMisses int
+	CurrQueued   int
+	CurrRunning  int
+	// NHeartbeats counts the heartbeats received from workers.
+	NHeartbeats int
 }
 
-// TODO: Make worker RPC serving separate from submitter RPC interface serving
-// to allow for local listening only for job submission for more security.
-
-func NewServer(httpaddr, rpcaddr string, db *DB) *Server {
+// NewServer creates a server listening for submitters, admins and the
+// dashboard on httpaddr and for workers on rpcaddr.  The addresses can be
+// changed (and split further) with the server's Addrs before it is started.
+// Submission can be restricted to local clients by listening on a loopback
+// address for everything but workers.  If db is nil, a leveldb db is
+// created at the default path.  If outdata is nil, job output data archives
+// are stored in the current directory.  If sched is nil, jobs are dispatched
+// with a FairScheduler.
+func NewServer(httpaddr, rpcaddr string, db JobStore, outdata BlobStore, sched Scheduler) *Server {
 	s := &Server{
 		submitjobs:   make(chan jobSubmit),
 		submitchans:  map[[16]byte]chan *Job{},
 		retrievejobs: make(chan jobRequest),
+		waitjobs:     make(chan waitRequest),
+		waiters:      map[JobId]chan struct{}{},
 		pushjobs:     make(chan *Job),
 		fetchjobs:    make(chan workRequest),
 		jobinfo:      map[JobId]Beat{},
+		workers:      registry{},
+		listworkers:  make(chan chan []WorkerStat),
+		drainworkers: make(chan workerDrain),
+		releasejobs:  make(chan Beat),
+		logs:         jobLogs{},
+		appendlogs:   make(chan LogChunk),
+		readlogs:     make(chan logRequest),
 		beat:         make(chan Beat),
-		reset:        make(chan struct{}),
-		rpcaddr:      rpcaddr,
+		reset:        make(chan string),
+		canceljobs:   make(chan jobCancel),
+		retryjobs:    make(chan jobCancel),
+		requeue:      make(chan JobId),
 		log:          log.New(os.Stdout, "", log.LstdFlags),
 		kill:         make(chan struct{}),
+		Addrs:        Addrs{Submit: httpaddr, Worker: rpcaddr},
 		CollectFreq:  defaultCollectFreq,
-		Stats:        &Stats{},
+		waittime:     newHistogram(jobTimeBuckets...),
+		runtime:      newHistogram(jobTimeBuckets...),
+		gctime:       newHistogram(gcTimeBuckets...),
 	}
 
-	var err error
 	if db == nil {
-		db, err = NewDB(defaultdbpath, dblimit)
+		ldb, err := NewDB(defaultdbpath, dblimit)
 		if err != nil {
 			panic(err)
 		}
+		db = ldb
 	}
 	s.alljobs = db
+
+	if outdata == nil {
+		outdata = &FSBlobStore{Root: "."}
+	}
+	s.outdata = outdata
+
+	if sched == nil {
+		sched = NewFairScheduler()
+	}
+	s.queue = sched
+
 	q, err := db.Current()
 	if err != nil {
 		panic(err)
 	}
 	for _, j := range q {
-		s.queue = append(s.queue, j.Id)
+		switch j.Status {
+		case StatusWaiting:
+			// dependencies may have finished while the server was down
+			s.schedule(j, Event{Type: EventRestart, OldStatus: j.Status, Actor: ActorServer})
+		case StatusRunning:
+			// contact with the job's worker was lost with the restart
+			j.endAttempt(lastWorker(j), attemptLost)
+			j.Status = StatusQueued
+			s.save(j, Event{Type: EventRestart, OldStatus: StatusRunning, WorkerId: lastWorker(j), Actor: ActorServer, Msg: "worker lost by server restart"})
+			s.queue.Enqueue(j)
+		default:
+			s.queue.Enqueue(j)
+		}
+	}
+
+	return s
+}
+
+// Addrs holds the addresses a server listens on for each kind of client.
+// Empty addresses default to Submit - services sharing an address are
+// served by the same listener.  Each listener only serves the REST endpoints
+// and rpc methods of its services.
+type Addrs struct {
+	// Submit serves job submission, retrieval and listing.
+	Submit string
+	// Worker serves fetching jobs, heartbeats and pushing results.
+	Worker string
+	// Admin serves token management, draining workers, resetting the queue
+	// and Prometheus metrics.
+	Admin string
+	// Dashboard serves the dashboard pages.
+	Dashboard string
+}
+
+// Services served by a server's listeners (see Addrs).
+const (
+	ServiceSubmit    = "submit"
+	ServiceWorker    = "worker"
+	ServiceAdmin     = "admin"
+	ServiceDashboard = "dashboard"
+)
+
+// listeners returns the services to serve on each address.
+func (a Addrs) listeners() map[string][]string {
+	l := map[string][]string{}
+	for _, svc := range []struct{ addr, name string }{
+		{a.Submit, ServiceSubmit},
+		{a.Worker, ServiceWorker},
+		{a.Admin, ServiceAdmin},
+		{a.Dashboard, ServiceDashboard},
+	} {
+		addr := svc.addr
+		if addr == "" {
+			addr = a.Submit
+		}
+		l[addr] = append(l[addr], svc.name)
 	}
+	return l
+}
 
+// handler returns the handler serving the REST endpoints and rpc methods of
+// the given services.
+func (s *Server) handler(services ...string) http.Handler {
+	read, submit, worker, admin := RoleReadOnly, RoleSubmitter, RoleWorker, RoleAdmin
 	mux := http.NewServeMux()
-	mux.HandleFunc("/", s.dashmain)
-	mux.HandleFunc("/reset", s.dashreset)
-	mux.HandleFunc("/reset/", s.dashreset)
-	mux.HandleFunc("/api/v1/reset-queue", s.handleReset)
-	mux.HandleFunc("/api/v1/job", s.handleJob)
-	mux.HandleFunc("/api/v1/job/", s.handleJob)
-	mux.HandleFunc("/api/v1/job-stat/", s.handleJobStat)
-	mux.HandleFunc("/api/v1/job-infile", s.handleSubmitInfile)
-	mux.HandleFunc("/api/v1/job-outfiles/", s.handleOutfiles)
-	mux.HandleFunc("/dashboard", s.dashboard)
-	mux.HandleFunc("/dashboard/", s.dashboard)
-	mux.HandleFunc("/dashboard/infile/", s.dashboardInfile)
-	mux.HandleFunc("/dashboard/output/", s.dashboardOutput)
-	mux.HandleFunc("/dashboard/default-infile", s.dashboardDefaultInfile)
-
-	s.rpc = &RPC{s}
-	rpc.Register(s.rpc)
-
-	if httpaddr == rpcaddr {
-		mux.Handle(rpc.DefaultRPCPath, rpc.DefaultServer)
-	} else {
-		rpc.HandleHTTP()
+	has := map[string]bool{}
+	for _, svc := range services {
+		has[svc] = true
 	}
 
-	s.serv = &http.Server{Addr: httpaddr, Handler: mux}
-	return s
+	switch {
+	case has[ServiceSubmit] && has[ServiceWorker]:
+		mux.HandleFunc("/api/v1/job-outfiles/", s.guard(read, worker, s.workerCert(s.handleOutfiles)))
+	case has[ServiceSubmit] || has[ServiceDashboard]:
+		mux.HandleFunc("/api/v1/job-outfiles/", s.guard(read, worker, methods(s.handleOutfiles, "GET", "HEAD")))
+	case has[ServiceWorker]:
+		mux.HandleFunc("/api/v1/job-outfiles/", s.guard(read, worker, s.workerCert(methods(s.handleOutfiles, "POST"))))
+	}
+
+	if has[ServiceSubmit] {
+		mux.HandleFunc("/api/v1/job", s.guard(read, submit, s.handleJob))
+		mux.HandleFunc("/api/v1/job/", s.guard(read, submit, s.handleJob))
+		mux.HandleFunc("/api/v1/job-stat/", s.guard(read, read, s.handleJobStat))
+		mux.HandleFunc("/api/v1/jobs", s.guard(read, read, s.handleJobs))
+		mux.HandleFunc("/api/v1/job-infile", s.guard(submit, submit, s.handleSubmitInfile))
+		mux.HandleFunc("/api/v1/array", s.guard(read, submit, s.handleArray))
+		mux.HandleFunc("/api/v1/array/", s.guard(read, submit, s.handleArray))
+		mux.HandleFunc("/api/v1/blob", s.guard(read, submit, s.handleBlob))
+		mux.HandleFunc("/api/v1/blob/", s.guard(read, submit, s.handleBlob))
+		mux.HandleFunc("/api/v1/blob-missing", s.guard(submit, submit, s.handleMissingBlobs))
+		mux.HandleFunc("/api/v1/workers", s.guard(read, read, s.handleWorkers))
+		mux.HandleFunc("/api/v1/events", s.guard(read, read, s.handleEvents))
+	}
+	if has[ServiceAdmin] {
+		mux.HandleFunc("/api/v1/reset-queue", s.guard(admin, admin, s.handleReset))
+		mux.HandleFunc("/api/v1/worker-drain", s.guard(admin, admin, s.handleDrain))
+		mux.HandleFunc("/api/v1/worker-drain/", s.guard(admin, admin, s.handleDrain))
+		mux.HandleFunc("/api/v1/tokens", s.guard(admin, admin, s.handleTokens))
+		mux.HandleFunc("/api/v1/tokens/", s.guard(admin, admin, s.handleTokens))
+		mux.HandleFunc("/metrics", s.guard(read, read, s.handleMetrics))
+	}
+	if has[ServiceDashboard] {
+		// the dashboard pages submit jobs and reset the queue on their own
+		// listener
+		if !has[ServiceSubmit] {
+			mux.HandleFunc("/api/v1/job-infile", s.guard(submit, submit, methods(s.handleSubmitInfile, "POST")))
+		}
+		if !has[ServiceAdmin] {
+			mux.HandleFunc("/api/v1/reset-queue", s.guard(admin, admin, methods(s.handleReset, "POST")))
+		}
+		// other api endpoints served by other listeners shouldn't fall
+		// through to the dashboard
+		mux.Handle("/api/", http.NotFoundHandler())
+		mux.HandleFunc("/", s.guard(read, read, s.dashmain))
+		mux.HandleFunc("/reset", s.guard(admin, admin, s.dashreset))
+		mux.HandleFunc("/reset/", s.guard(admin, admin, s.dashreset))
+		mux.HandleFunc("/dashboard", s.guard(read, read, s.dashboard))
+		mux.HandleFunc("/dashboard/", s.guard(read, read, s.dashboard))
+		mux.HandleFunc("/dashboard/workers", s.guard(read, read, s.dashboardWorkers))
+		mux.HandleFunc("/dashboard/infile/", s.guard(read, read, s.dashboardInfile))
+		mux.HandleFunc("/dashboard/output/", s.guard(read, read, s.dashboardOutput))
+		mux.HandleFunc("/dashboard/default-infile", s.guard(read, read, s.dashboardDefaultInfile))
+	}
+
+	// each rpc connection is authenticated separately and checked for the
+	// required role by the rpc methods
+	if has[ServiceSubmit] || has[ServiceWorker] || has[ServiceAdmin] {
+		mux.HandleFunc(rpc.DefaultRPCPath, func(w http.ResponseWriter, r *http.Request) {
+			s.serveRPC(w, r, has)
+		})
+	}
+	return mux
 }
 
 func (s *Server) ListenAndServe() error {
-	s.Stats.Started = time.Now()
+	if s.WorkerCAs != nil && s.TLS == nil {
+		return errors.New("worker client certificates require TLS")
+	}
+
+	s.updateStats(func(st *Stats) { st.Started = time.Now() })
 	go s.dispatcher()
 	go func() {
 		for {
@@ -131,45 +331,146 @@ func (s *Server) ListenAndServe() error {
 			case <-s.kill:
 				return
 			default:
-				npurged, nremain, err := s.alljobs.GC()
-				s.Stats.NPurged += npurged
+				start := time.Now()
+				purged, nremain, err := s.alljobs.GC()
+				s.observe(s.gctime, time.Now().Sub(start))
+				s.updateStats(func(st *Stats) { st.NPurged += len(purged) })
 				if err != nil {
 					s.log.Print(err)
 				}
-				s.log.Printf("[INFO] purged %v old jobs from db, %v remain", npurged, nremain)
+				for _, id := range purged {
+					s.outdata.Remove(outfileName(&Job{Id: id}))
+				}
+				s.log.Printf("[INFO] purged %v old jobs from db, %v remain", len(purged), nremain)
 			}
 			<-time.After(s.CollectFreq)
 		}
 	}()
 
-	if s.rpcaddr != s.serv.Addr {
+	listeners := s.Addrs.listeners()
+	errs := make(chan error, len(listeners))
+	s.servmu.Lock()
+	for addr, services := range listeners {
+		s.log.Printf("[INFO] listening on %v (%v)\n", addr, strings.Join(services, ", "))
+		serv := &http.Server{Addr: addr, Handler: s.handler(services...), TLSConfig: s.tlsConfig(services...)}
+		s.servs = append(s.servs, serv)
 		go func() {
-			if err := http.ListenAndServe(s.rpcaddr, nil); err != nil {
-				log.Fatal(err)
+			if serv.TLSConfig != nil {
+				errs <- serv.ListenAndServeTLS("", "")
+			} else {
+				errs <- serv.ListenAndServe()
 			}
 		}()
 	}
-	return s.serv.ListenAndServe()
+	s.servmu.Unlock()
+
+	// a listener failing stops all of them
+	err := <-errs
+	if err == http.ErrServerClosed {
+		return nil
+	}
+	s.closeListeners()
+	return err
+}
+
+// tlsConfig returns the TLS config of the listener for services or nil if
+// it doesn't use TLS.  Listeners serving workers ask for client certificates
+// if s.WorkerCAs is set - and require them if they serve nothing else.
+func (s *Server) tlsConfig(services ...string) *tls.Config {
+	if s.TLS == nil {
+		return nil
+	}
+	config := s.TLS.Clone()
+	for _, svc := range services {
+		if svc == ServiceWorker && s.WorkerCAs != nil {
+			config.ClientCAs = s.WorkerCAs
+			config.ClientAuth = tls.VerifyClientCertIfGiven
+			if len(services) == 1 {
+				config.ClientAuth = tls.RequireAndVerifyClientCert
+			}
+		}
+	}
+	return config
+}
+
+// checkWorkerCert returns an error if s.WorkerCAs is set and r was not made
+// with a client certificate signed by one of them.
+func (s *Server) checkWorkerCert(r *http.Request) error {
+	if s.WorkerCAs == nil {
+		return nil
+	} else if r.TLS == nil || len(r.TLS.VerifiedChains) == 0 {
+		return errors.New("workers must present a client certificate signed by a trusted certificate authority")
+	}
+	return nil
+}
+
+// Stats returns a copy of the server's job counters.
+func (s *Server) Stats() Stats {
+	s.statsmu.Lock()
+	defer s.statsmu.Unlock()
+	return s.stats
+}
+
+// updateStats calls f with the server's job counters locked.  They are
+// updated by both the dispatcher and the db garbage collector and read by
+// http handlers.
+func (s *Server) updateStats(f func(st *Stats)) {
+	s.statsmu.Lock()
+	defer s.statsmu.Unlock()
+	f(&s.stats)
+}
+
+// observe records d in the server's histogram h.
+func (s *Server) observe(h *histogram, d time.Duration) {
+	s.statsmu.Lock()
+	defer s.statsmu.Unlock()
+	h.observe(d.Seconds())
+}
+
+func (s *Server) closeListeners() {
+	s.servmu.Lock()
+	defer s.servmu.Unlock()
+	for _, serv := range s.servs {
+		serv.Close()
+	}
 }
 
+// Close stops the server's listeners and closes its job database once the
+// dispatcher has stopped.
 func (s *Server) Close() error {
 	close(s.kill)
+	s.closeListeners()
+	s.dispatchmu.Lock()
+	defer s.dispatchmu.Unlock()
 	return s.alljobs.Close()
 }
 
+// Run submits j and blocks until it has finished returning the result job.
+// nil is returned if j was rejected (see Start).
 func (s *Server) Run(j *Job) *Job {
 	ch := s.Start(j, nil)
 	return <-ch
 }
 
+// Start submits j and returns a channel receiving the result job once it
+// has finished.  If ch is not nil, it is used as the result channel.  Jobs
+// with the id of an existing job are rejected and the channel is closed
+// without a result.
 func (s *Server) Start(j *Job, ch chan *Job) chan *Job {
 	if ch == nil {
 		ch = make(chan *Job, 1)
 	}
-	s.submitjobs <- jobSubmit{j, ch}
+	s.submitjobs <- jobSubmit{J: j, Result: ch}
 	return ch
 }
 
+// submit is Start returning an error if j was rejected.
+func (s *Server) submit(j *Job, ch chan *Job) error {
+	resp := make(chan error)
+	s.submitjobs <- jobSubmit{J: j, Result: ch, Resp: resp}
+	return <-resp
+}
+
 func (s *Server) Get(jid JobId) (*Job, error) {
 	ch := make(chan *Job)
 	s.retrievejobs <- jobRequest{Id: jid, Resp: ch}
@@ -180,14 +481,273 @@ func (s *Server) Get(jid JobId) (*Job, error) {
 	return j, nil
 }
 
+// maxJobWait is the longest time the server waits for a job to finish before
+// responding to a wait request.
+const maxJobWait = 30 * time.Second
+
+// Wait returns the job with the given id once it has finished.  If it
+// hasn't finished within wait, the job is returned in its current state.
+// Unlike Run, waiting doesn't depend on the job having been submitted by the
+// caller or since the server started.
+func (s *Server) Wait(jid JobId, wait time.Duration) (*Job, error) {
+	timeout := time.After(wait)
+	for {
+		req := waitRequest{Id: jid, Resp: make(chan waitResponse)}
+		s.waitjobs <- req
+		resp := <-req.Resp
+		if resp.J == nil {
+			return nil, fmt.Errorf("unknown job id %v", jid)
+		} else if resp.J.Done() || wait <= 0 {
+			return resp.J, nil
+		}
+
+		select {
+		case <-resp.Done:
+		case <-timeout:
+			return resp.J, nil
+		}
+	}
+}
+
+// Cancel cancels the job with the given id.  Queued jobs are removed from
+// the queue.  Running jobs are killed on their worker's next heartbeat.  An
+// error is returned if the job is unknown or already finished.
+func (s *Server) Cancel(jid JobId) error { return s.cancelBy(jid, nil, "") }
+
+// cancelBy is Cancel on behalf of by (see Event.Actor) authorized by t.  If
+// t doesn't manage the job, errNotOwner is returned.
+func (s *Server) cancelBy(jid JobId, t *Token, by string) error {
+	ch := make(chan error)
+	s.canceljobs <- jobCancel{Id: jid, Token: t, By: by, Resp: ch}
+	return <-ch
+}
+
+// Retry requeues the failed or canceled job with the given id with a fresh
+// budget of MaxRetries automatic retries.  Dependents that failed because
+// the job did are requeued with it.  An error is returned if the job is
+// unknown, hasn't finished or completed successfully.
+func (s *Server) Retry(jid JobId) error { return s.retryBy(jid, nil, "") }
+
+// retryBy is Retry on behalf of by (see Event.Actor) authorized by t.  If t
+// doesn't manage the job, errNotOwner is returned.
+func (s *Server) retryBy(jid JobId, t *Token, by string) error {
+	ch := make(chan error)
+	s.retryjobs <- jobCancel{Id: jid, Token: t, By: by, Resp: ch}
+	return <-ch
+}
+
+// StartArray expands the job array a into its child jobs and submits them.
+// An error is returned if a job array with a's id already exists.
+func (s *Server) StartArray(a *JobArray) (*ArrayStat, error) {
+	if a.Id == (JobId{}) {
+		a.Id = NewJob().Id
+	} else if _, err := s.arrayjobs(a.Id); err == nil {
+		return nil, fmt.Errorf("job array %v already exists", a.Id)
+	}
+	if a.Template == nil {
+		return nil, fmt.Errorf("job array %v has no template job", a.Id)
+	}
+	// store shared input files once rather than for every child
+	if err := s.storeInfiles(a.Template); err != nil {
+		return nil, err
+	}
+
+	jobs, err := a.Expand(s.alljobs.GetBlob)
+	if err != nil {
+		return nil, err
+	}
+	s.log.Printf("[ARRAY] %v with %v jobs\n", a.Id, len(jobs))
+	for _, j := range jobs {
+		s.submitjobs <- jobSubmit{J: j}
+	}
+	// the dispatcher handles requests in order - once the last job can be
+	// retrieved, all of them have been stored
+	s.Get(jobs[len(jobs)-1].Id)
+	return s.Array(a.Id)
+}
+
+// Array returns the progress of the job array with the given id.
+func (s *Server) Array(id JobId) (*ArrayStat, error) {
+	jobs, err := s.arrayjobs(id)
+	if err != nil {
+		return nil, err
+	}
+	return NewArrayStat(id, jobs), nil
+}
+
+// CancelArray cancels all unfinished jobs of the job array with the given
+// id.
+func (s *Server) CancelArray(id JobId) (*ArrayStat, error) { return s.cancelArrayBy(id, nil, "") }
+
+// cancelArrayBy is CancelArray on behalf of by (see Event.Actor) authorized
+// by t.  If t doesn't manage all of the array's jobs, errNotOwner is
+// returned and no job is canceled.
+func (s *Server) cancelArrayBy(id JobId, t *Token, by string) (*ArrayStat, error) {
+	jobs, err := s.managedArray(id, t)
+	if err != nil {
+		return nil, err
+	}
+	for _, j := range jobs {
+		if !j.Done() {
+			// jobs may finish in the meantime
+			s.cancelBy(j.Id, t, by)
+		}
+	}
+	return s.Array(id)
+}
+
+// RetryArray requeues all failed and canceled jobs of the job array with
+// the given id.
+func (s *Server) RetryArray(id JobId) (*ArrayStat, error) { return s.retryArrayBy(id, nil, "") }
+
+// retryArrayBy is RetryArray on behalf of by (see Event.Actor) authorized by
+// t.  If t doesn't manage all of the array's jobs, errNotOwner is returned
+// and no job is retried.
+func (s *Server) retryArrayBy(id JobId, t *Token, by string) (*ArrayStat, error) {
+	jobs, err := s.managedArray(id, t)
+	if err != nil {
+		return nil, err
+	}
+	for _, j := range jobs {
+		// dependents of retried jobs may have been requeued along with them
+		if j, err = s.Get(j.Id); err != nil {
+			return nil, err
+		} else if j.Status == StatusFailed || j.Status == StatusCanceled {
+			if err := s.retryBy(j.Id, t, by); err != nil {
+				return nil, err
+			}
+		}
+	}
+	return s.Array(id)
+}
+
+// arrayjobs returns all child jobs of the job array with the given id.
+func (s *Server) arrayjobs(id JobId) ([]*Job, error) {
+	jobs, _, err := s.alljobs.Query(Query{Array: id, Ascending: true})
+	if err != nil {
+		return nil, err
+	} else if len(jobs) == 0 {
+		return nil, fmt.Errorf("unknown job array %v", id)
+	}
+	return jobs, nil
+}
+
+// managedArray returns all child jobs of the job array with the given id if
+// t manages all of them.
+func (s *Server) managedArray(id JobId, t *Token) ([]*Job, error) {
+	jobs, err := s.arrayjobs(id)
+	if err != nil {
+		return nil, err
+	}
+	for _, j := range jobs {
+		if !t.manages(j) {
+			return nil, errNotOwner
+		}
+	}
+	return jobs, nil
+}
+
+// MissingBlobs returns the hashes that are not in the server's blob store.
+func (s *Server) MissingBlobs(hashes []string) ([]string, error) {
+	missing := []string{}
+	for _, h := range hashes {
+		if ok, err := s.alljobs.HasBlob(h); err != nil {
+			return nil, err
+		} else if !ok {
+			missing = append(missing, h)
+		}
+	}
+	return missing, nil
+}
+
+// Workers returns the status of all workers that have recently contacted
+// the server.
+func (s *Server) Workers() []WorkerStat {
+	ch := make(chan []WorkerStat)
+	s.listworkers <- ch
+	return <-ch
+}
+
+// Log returns the combined stdout and stderr output of job jid following
+// offset.  While a job runs, only the last LogTailSize bytes of its output
+// are available.  If no output is available yet, Log waits up to wait for
+// more to arrive.
+func (s *Server) Log(jid JobId, offset int64, wait time.Duration) (*LogChunk, error) {
+	timeout := time.After(wait)
+	for {
+		req := logRequest{Id: jid, Offset: offset, Resp: make(chan logResponse)}
+		s.readlogs <- req
+		resp := <-req.Resp
+		if resp.Err != nil {
+			return nil, resp.Err
+		}
+
+		c := resp.Chunk
+		if len(c.Data) > 0 || c.Done || wait <= 0 {
+			return c, nil
+		}
+		select {
+		case <-resp.Wait:
+		case <-timeout:
+			return c, nil
+		}
+	}
+}
+
+// DefaultListLimit is the maximum number of jobs returned by List for
+// queries without a Limit.
+const DefaultListLimit = 100
+
+// List returns a page of jobs matching q along with the cursor for
+// retrieving the next page.
+func (s *Server) List(q Query) (*JobPage, error) {
+	if q.Limit == 0 {
+		q.Limit = DefaultListLimit
+	}
+	jobs, next, err := s.alljobs.Query(q)
+	if err != nil {
+		return nil, err
+	}
+
+	page := &JobPage{Jobs: make([]*JobStat, len(jobs)), Next: next}
+	for i, j := range jobs {
+		page.Jobs[i] = NewJobStat(j)
+	}
+	return page, nil
+}
+
+// Drain asks the worker with the given id to shut down after finishing its
+// running jobs.  The worker is told on its next fetch.  An error is returned
+// if the worker is unknown.
+func (s *Server) Drain(wid WorkerId) error {
+	ch := make(chan error)
+	s.drainworkers <- workerDrain{Id: wid, Resp: ch}
+	return <-ch
+}
+
+// DrainAll asks all currently registered workers to shut down after
+// finishing their running jobs.
+func (s *Server) DrainAll() {
+	ch := make(chan error)
+	s.drainworkers <- workerDrain{All: true, Resp: ch}
+	<-ch
+}
+
 // ResetQueue removes all jobs from the queue permanently.
-func (s *Server) ResetQueue() {
-	s.reset <- struct{}{}
+func (s *Server) ResetQueue() { s.resetQueueBy("") }
+
+// resetQueueBy is ResetQueue on behalf of by (see Event.Actor).
+func (s *Server) resetQueueBy(by string) {
+	s.reset <- by
 }
 
 // checkbeat checks for workers that have stopped responding and requeues their
-// jobs to try again.
+// jobs to try again.  Workers that have stopped polling for jobs are removed
+// from the worker registry.
 func (s *Server) checkbeat() {
+	defer s.workers.expire(s.jobinfo)
+	defer s.logs.expire()
+
 	now := time.Now()
 	for jid, b := range s.jobinfo {
 		if now.Sub(b.Time) > beatLimit {
@@ -195,53 +755,93 @@ func (s *Server) checkbeat() {
 			delete(s.jobinfo, jid)
 			if err != nil {
 				log.Printf("cannot find job %v for reassignment", jid)
-			} else {
-				s.Stats.NRequeued++
-				s.log.Printf("[REQUEUE] job %v\n", jid)
-				j.Status = StatusQueued
-				s.queue = append([]JobId{j.Id}, s.queue...)
-				s.alljobs.Put(j)
+				continue
+			}
+
+			j.FailReason = FailWorkerLost
+			j.endAttempt(b.WorkerId, attemptLost)
+			ev := Event{Type: EventLost, OldStatus: j.Status, WorkerId: b.WorkerId, Actor: ActorServer}
+			if !s.retry(j, true, ev) {
+				s.failjob(j, FailWorkerLost, fmt.Sprintf("giving up after %v attempts: worker %v stopped responding", len(j.Attempts), b.WorkerId), ev)
 			}
 		}
 	}
 }
 
 func (s *Server) dispatcher() {
+	s.dispatchmu.Lock()
+	defer s.dispatchmu.Unlock()
 	beatcheck := time.NewTicker(beatCheckFreq)
 	defer beatcheck.Stop()
 
 	for {
-		s.Stats.CurrQueued = len(s.queue)
-		s.Stats.CurrRunning = len(s.jobinfo)
+		s.updateStats(func(st *Stats) {
+			st.CurrQueued = s.queue.Len()
+			st.CurrRunning = len(s.jobinfo)
+		})
 
 		select {
 		case <-beatcheck.C:
 			s.checkbeat()
-		case <-s.reset:
-			for _, jid := range s.queue {
+		case by := <-s.reset:
+			for _, jid := range s.queue.Snapshot() {
+				s.queue.Remove(jid)
 				j, err := s.alljobs.Get(jid)
-				if err == nil {
-					j.Status = StatusFailed
-					j.Stderr += "\nkilled by server reset\n"
+				if err == nil && !j.Done() {
+					s.failjob(j, FailKilledByServer, "killed by server reset", Event{Type: EventReset, OldStatus: j.Status, Actor: by})
 				}
-				s.alljobs.Put(j)
 			}
-			s.Stats.NFailed += len(s.queue)
-			s.queue = s.queue[:0]
 		case <-s.kill:
 			return
+		case ch := <-s.listworkers:
+			ch <- s.workers.list(s.jobinfo)
+		case req := <-s.drainworkers:
+			req.Resp <- s.workers.drain(req.Id, req.All)
+		case b := <-s.releasejobs:
+			s.release(b)
+		case c := <-s.appendlogs:
+			// ignore output from workers the job was taken away from
+			if b, ok := s.jobinfo[c.JobId]; ok && b.WorkerId == c.WorkerId {
+				s.logs.append(c.JobId, c.Data)
+			}
+		case req := <-s.readlogs:
+			req.Resp <- s.readlog(req.Id, req.Offset)
+		case req := <-s.canceljobs:
+			req.Resp <- s.cancel(req.Id, req.Token, req.By)
+		case req := <-s.retryjobs:
+			req.Resp <- s.rerun(req.Id, req.Token, req.By)
+		case jid := <-s.requeue:
+			// retry backoff expired
+			j, err := s.alljobs.Get(jid)
+			if err == nil && j.Status == StatusQueued {
+				s.log.Printf("[REQUEUE] job %v\n", jid)
+				s.event(j, Event{Type: EventRequeue, OldStatus: j.Status, Actor: ActorServer, Msg: "retry backoff expired"})
+				s.queue.Requeue(j)
+			}
 		case js := <-s.submitjobs:
-			s.Stats.NSubmitted++
-			s.log.Printf("[SUBMIT] job %v\n", js.J.Id)
 			j := js.J
+			if _, err := s.alljobs.Get(j.Id); err == nil {
+				// don't let submitters overwrite existing jobs
+				s.log.Printf("[SUBMIT] job %v rejected - id already exists\n", j.Id)
+				if js.Result != nil {
+					close(js.Result)
+				}
+				if js.Resp != nil {
+					js.Resp <- fmt.Errorf("job %v already exists", j.Id)
+				}
+				continue
+			}
+
+			s.updateStats(func(st *Stats) { st.NSubmitted++ })
+			s.log.Printf("[SUBMIT] job %v\n", j.Id)
 			if js.Result != nil {
 				s.submitchans[j.Id] = js.Result
 			}
-			j.Status = StatusQueued
 			j.Submitted = time.Now()
-			s.queue = append(s.queue, j.Id)
-
-			s.alljobs.Put(j)
+			s.schedule(j, Event{Type: EventSubmit, Actor: submitter(j)})
+			if js.Resp != nil {
+				js.Resp <- nil
+			}
 		case req := <-s.retrievejobs:
 			if j, err := s.alljobs.Get(req.Id); err == nil {
 				s.log.Printf("[RETRIEVE] job %v\n", j.Id)
@@ -249,95 +849,524 @@ func (s *Server) dispatcher() {
 			} else {
 				req.Resp <- nil
 			}
-		case j := <-s.pushjobs:
-			if j.Status == StatusFailed {
-				s.Stats.NFailed++
-			} else if j.Status == StatusComplete {
-				s.Stats.NCompleted++
+		case req := <-s.waitjobs:
+			req.Resp <- s.waitjob(req.Id)
+		case pushed := <-s.pushjobs:
+			// results are merged into the stored job - workers nilify the
+			// Infiles to reduce network traffic and their copy of the job
+			// may be out of date.
+			j, err := s.alljobs.Get(pushed.Id)
+			if err != nil {
+				s.log.Printf("[PUSH] error - job %v not found in db\n", pushed.Id)
+				continue
 			}
+			wid := pushed.WorkerId
+			ev := Event{Type: EventPush, OldStatus: j.Status, WorkerId: wid, Actor: ActorWorker}
+			b, running := s.jobinfo[j.Id]
 
-			s.log.Printf("[PUSH] job %v\n", j.Id)
-			if jj, err := s.alljobs.Get(j.Id); err == nil {
-				// workers nilify the Infiles to reduce network traffic
-				// we want to re-add the locally stored infiles back to keep
-				// job data complete.
-				j.Infiles = jj.Infiles
+			switch {
+			case j.Status == StatusCanceled:
+				// keep the killed job's output but not its status
+				if lastWorker(j) == wid {
+					s.log.Printf("[PUSH] job %v (canceled)\n", j.Id)
+					j.Stdout, j.Stderr = pushed.Stdout, pushed.Stderr
+					s.alljobs.Put(j)
+				}
+				continue
+			case j.Done():
+				s.log.Printf("[PUSH] job %v ignored from worker %v - already %v\n", j.Id, wid, j.Status)
+				continue
+			case running && b.WorkerId == wid:
+				s.log.Printf("[PUSH] job %v\n", j.Id)
+			case pushed.Status != StatusComplete || j.Status == StatusWaiting || !j.triedOn(wid):
+				// the job was already taken away from this worker (or was
+				// never dispatched to it) - but successful results of
+				// attempts it ran are still welcome.
+				s.log.Printf("[PUSH] job %v ignored from worker %v\n", j.Id, wid)
+				continue
+			case running:
+				// the job's current worker is told to kill it on its next
+				// heartbeat
+				s.log.Printf("[PUSH] job %v (late result from worker %v)\n", j.Id, wid)
+				j.endAttempt(b.WorkerId, attemptSuperseded)
+			default:
+				s.log.Printf("[PUSH] job %v (late result from worker %v)\n", j.Id, wid)
+				s.queue.Remove(j.Id)
 			}
 
-			if ch, ok := s.submitchans[j.Id]; ok {
-				ch <- j
-				close(ch)
-				delete(s.submitchans, j.Id)
-			}
-			delete(s.jobinfo, j.Id)
-			s.alljobs.Put(j)
+			j.merge(pushed)
+			s.finish(j, ev)
 		case req := <-s.fetchjobs:
 			var j *Job
-			var err error
+			if s.workers.fetched(req.Worker) {
+				// closing the channel tells the worker to drain
+				s.log.Printf("[DRAIN] worker %v\n", req.Worker.Id)
+				close(req.Ch)
+				continue
+			}
 
-			// skip jobs that were finished by a worker reassigned *from*
-			for i, id := range s.queue {
-				j, err = s.alljobs.Get(id)
-				if err == nil && j.Status == StatusQueued {
-					s.queue = s.queue[i+1:]
+			// skip jobs that were finished by a worker reassigned *from* - the
+			// scheduler skips jobs the worker can't run
+			for id, ok := s.queue.Dequeue(req.Worker); ok; id, ok = s.queue.Dequeue(req.Worker) {
+				jj, err := s.alljobs.Get(id)
+				if err == nil && jj.Status == StatusQueued {
+					j = jj
 					break
 				}
 			}
 
 			if j == nil {
-				s.log.Printf("[FETCH] no work in queue (worker %v)\n", req.WorkerId)
-				s.queue = nil
+				s.log.Printf("[FETCH] no work in queue (worker %v)\n", req.Worker.Id)
 			} else {
-				s.log.Printf("[FETCH] job %v (worker %v)\n", j.Id, req.WorkerId)
-				s.jobinfo[j.Id] = NewBeat(req.WorkerId, j.Id)
+				s.log.Printf("[FETCH] job %v (worker %v)\n", j.Id, req.Worker.Id)
+				s.jobinfo[j.Id] = NewBeat(req.Worker.Id, j.Id)
 				j.Fetched = time.Now()
+				s.observe(s.waittime, j.Fetched.Sub(j.queuedSince()))
 				j.Status = StatusRunning
-				s.alljobs.Put(j)
+				j.Attempts = append(j.Attempts, Attempt{WorkerId: req.Worker.Id, Started: j.Fetched})
+				s.logs.restart(j.Id, len(j.Attempts), req.Worker.Id)
+				s.save(j, Event{Type: EventFetch, OldStatus: StatusQueued, WorkerId: req.Worker.Id, Actor: ActorWorker})
 			}
 
 			req.Ch <- j
 		case b := <-s.beat:
-			var err error
+			s.updateStats(func(st *Stats) { st.NHeartbeats++ })
+			// make sure that this job hasn't been completed, canceled or
+			// reassigned to another worker
 			oldb, ok := s.jobinfo[b.JobId]
-			kill := false
-			var j *Job
-			if ok {
-				j, err = s.alljobs.Get(b.JobId)
-				if err != nil {
-					s.log.Printf("[BEAT] error - job %v not found in db\n", b.JobId)
-					continue
-				}
-				kill = time.Now().Sub(j.Fetched) > j.Timeout
-			} else {
-				// job was completed by another worker already
-				kill = true
+			if !ok || oldb.WorkerId != b.WorkerId {
+				b.kill <- true
+				continue
 			}
 
-			// make sure that this job hasn't been reassigned to another worker
-			if oldb.WorkerId == b.WorkerId {
-				s.log.Printf("[BEAT] job %v (worker %v)\n", b.JobId, b.WorkerId)
-				s.jobinfo[b.JobId] = b
-			} else {
-				// job has been reassigned
-				kill = true
+			j, err := s.alljobs.Get(b.JobId)
+			if err != nil {
+				s.log.Printf("[BEAT] error - job %v not found in db\n", b.JobId)
+				b.kill <- false
+				continue
 			}
 
-			if kill && j != nil {
+			s.log.Printf("[BEAT] job %v (worker %v)\n", b.JobId, b.WorkerId)
+			s.jobinfo[b.JobId] = b
+			s.workers.beat(b)
+
+			kill := time.Now().Sub(j.Fetched) > j.Timeout
+			if kill {
+				ev := Event{Type: EventTimeout, OldStatus: j.Status, WorkerId: b.WorkerId, Actor: ActorServer}
 				j.Status = StatusFailed
-				s.Stats.NFailed++
+				j.FailReason = FailTimeout
+				j.Stderr += "\nkilled by server after timeout\n"
+				s.finish(j, ev)
+			}
+			b.kill <- kill
+		}
+	}
+}
 
-				if ch, ok := s.submitchans[j.Id]; ok {
-					ch <- j
-					close(ch)
-					delete(s.submitchans, j.Id)
-				}
+// schedule moves j into the queue if all of its dependencies have completed.
+// If any dependency failed, j is failed as well.  Otherwise j is left waiting
+// in the db until its dependencies finish.  ev is the cause of any resulting
+// transition of j (see save).
+func (s *Server) schedule(j *Job, ev Event) {
+	if err := s.storeInfiles(j); err != nil {
+		s.failjob(j, FailSetup, err.Error(), ev)
+		return
+	}
 
-				delete(s.jobinfo, j.Id)
-				s.alljobs.Put(j)
+	ready, err := s.depstatus(j)
+	if err != nil {
+		s.failjob(j, FailDependency, err.Error(), ev)
+		return
+	} else if !ready {
+		j.Status = StatusWaiting
+		s.save(j, ev)
+		return
+	}
+
+	if j.InheritOutfiles {
+		for _, id := range j.DependsOn {
+			dep, err := s.alljobs.Get(id)
+			if err == nil {
+				var files []File
+				files, err = readOutfiles(s.outdata, dep)
+				j.Infiles = append(j.Infiles, files...)
 			}
-			b.kill <- kill
+			if err != nil {
+				s.failjob(j, FailSetup, fmt.Sprintf("cannot inherit outfiles from dependency %v: %v", id, err), ev)
+				return
+			}
+		}
+		if err := s.storeInfiles(j); err != nil {
+			s.failjob(j, FailSetup, err.Error(), ev)
+			return
 		}
 	}
+
+	if s.memoized(j, ev) {
+		return
+	}
+
+	j.Status = StatusQueued
+	s.queue.Enqueue(j)
+	s.save(j, ev)
+}
+
+// memoized completes j with a copy of the results of an identical,
+// previously completed job if s.Memoize is enabled and such a job (and its
+// output data) still exists.  It returns false if j needs to be run.  ev is
+// the cause of j's completion.
+func (s *Server) memoized(j *Job, ev Event) bool {
+	if !s.Memoize || j.NoCache {
+		return false
+	}
+
+	cached, err := s.alljobs.Memoized(j)
+	if err == nil {
+		var prev *Job
+		prev, err = s.alljobs.Get(cached)
+		if err == nil && prev.Status != StatusComplete {
+			err = fmt.Errorf("memoized job %v is %v", cached, prev.Status)
+		} else if err == nil {
+			err = copyOutfiles(s.outdata, j, prev)
+		}
+
+		if err == nil {
+			s.log.Printf("[MEMO] job %v has results of job %v\n", j.Id, cached)
+			now := time.Now()
+			j.Status = StatusComplete
+			j.Stdout = prev.Stdout
+			j.Stderr = prev.Stderr
+			j.Outfiles = prev.Outfiles
+			j.Started, j.Finished = now, now
+			s.updateStats(func(st *Stats) {
+				st.NCacheHits++
+				st.NCompleted++
+			})
+			ev.Msg = fmt.Sprintf("memoized results of job %v", cached)
+			s.save(j, ev)
+			s.jobdone(j)
+			return true
+		}
+	}
+
+	s.updateStats(func(st *Stats) { st.NCacheMisses++ })
+	return false
+}
+
+// storeInfiles moves the data of all of j's input files into the blob store
+// leaving only references to it in j.  An error is returned if j refers to
+// unknown blobs.
+func (s *Server) storeInfiles(j *Job) error {
+	for i, f := range j.Infiles {
+		if f.Hash != "" && f.Data == nil {
+			if ok, err := s.alljobs.HasBlob(f.Hash); err != nil {
+				return err
+			} else if !ok {
+				return fmt.Errorf("input file %v refers to unknown blob %v", f.Name, f.Hash)
+			}
+			continue
+		}
+
+		hash, err := s.alljobs.PutBlob(f.Data)
+		if err != nil {
+			return err
+		}
+		j.Infiles[i] = File{Name: f.Name, Size: len(f.Data), Hash: hash}
+	}
+	return nil
+}
+
+// depstatus returns true if all of j's dependencies have completed
+// successfully.  An error is returned if any dependency failed or is unknown.
+func (s *Server) depstatus(j *Job) (ready bool, err error) {
+	ready = true
+	for _, id := range j.DependsOn {
+		dep, err := s.alljobs.Get(id)
+		if err != nil {
+			return false, fmt.Errorf("unknown dependency %v", id)
+		} else if dep.Done() && dep.Status != StatusComplete {
+			return false, fmt.Errorf("dependency %v %v", id, dep.Status)
+		} else if dep.Status != StatusComplete {
+			ready = false
+		}
+	}
+	return ready, nil
+}
+
+// cancel cancels the job with the given id if t manages it.  Running jobs are
+// dropped from s.jobinfo which causes them to be killed on their next
+// heartbeat.
+func (s *Server) cancel(jid JobId, t *Token, by string) error {
+	j, err := s.alljobs.Get(jid)
+	if err != nil {
+		return fmt.Errorf("unknown job id %v", jid)
+	} else if !t.manages(j) {
+		return errNotOwner
+	} else if j.Done() {
+		return fmt.Errorf("job %v already %v", jid, j.Status)
+	}
+
+	s.log.Printf("[CANCEL] job %v (%v)\n", jid, j.Status)
+	ev := Event{Type: EventCancel, OldStatus: j.Status, Actor: by}
+	switch j.Status {
+	case StatusQueued:
+		s.queue.Remove(jid)
+	case StatusRunning:
+		ev.WorkerId = s.jobinfo[jid].WorkerId
+		delete(s.jobinfo, jid)
+	}
+
+	j.Status = StatusCanceled
+	j.FailReason = FailCanceled
+	j.Stderr += "\ncanceled by request\n"
+	j.Finished = time.Now()
+	s.updateStats(func(st *Stats) { st.NCanceled++ })
+	s.save(j, ev)
+	s.jobdone(j)
+	return nil
+}
+
+// rerun requeues the failed or canceled job with the given id if t manages
+// it.  Its dependents that failed because it did are requeued too.
+func (s *Server) rerun(jid JobId, t *Token, by string) error {
+	j, err := s.alljobs.Get(jid)
+	if err != nil {
+		return fmt.Errorf("unknown job id %v", jid)
+	} else if !t.manages(j) {
+		return errNotOwner
+	} else if j.Status != StatusFailed && j.Status != StatusCanceled {
+		return fmt.Errorf("job %v is %v", jid, j.Status)
+	}
+
+	s.log.Printf("[RERUN] job %v\n", jid)
+	ev := Event{Type: EventRetry, OldStatus: j.Status, Actor: by}
+	j.FailReason = ""
+	j.Finished = time.Time{}
+	j.RetryBase = len(j.Attempts)
+	ready, err := s.depstatus(j)
+	if err != nil {
+		return fmt.Errorf("cannot retry job %v: %v", jid, err)
+	} else if !ready {
+		j.Status = StatusWaiting
+		s.save(j, ev)
+	} else {
+		j.Status = StatusQueued
+		s.save(j, ev)
+		s.queue.Enqueue(j)
+	}
+	s.rewait(j, by)
+	return nil
+}
+
+// rewait moves the dependents of the just retried job j that failed because
+// a dependency failed (and their dependents in turn) back to waiting.
+// Dependents with other failed dependencies stay failed.
+func (s *Server) rewait(j *Job, by string) {
+	ids, err := s.alljobs.Dependents(j.Id)
+	if err != nil {
+		s.log.Print(err)
+		return
+	}
+	for _, id := range ids {
+		dep, err := s.alljobs.Get(id)
+		if err != nil || dep.Status != StatusFailed || dep.FailReason != FailDependency {
+			continue
+		} else if _, err := s.depstatus(dep); err != nil {
+			continue
+		}
+
+		s.log.Printf("[RERUN] job %v (dependency %v retried)\n", dep.Id, j.Id)
+		ev := Event{Type: EventRetry, OldStatus: dep.Status, Actor: by, Msg: fmt.Sprintf("dependency %v retried", j.Id)}
+		dep.Status = StatusWaiting
+		dep.FailReason = ""
+		dep.Finished = time.Time{}
+		dep.RetryBase = len(dep.Attempts)
+		s.save(dep, ev)
+		s.rewait(dep, by)
+	}
+}
+
+// release requeues the job in b immediately after it was handed back by its
+// draining worker.
+func (s *Server) release(b Beat) {
+	if oldb, ok := s.jobinfo[b.JobId]; !ok || oldb.WorkerId != b.WorkerId {
+		return
+	}
+	delete(s.jobinfo, b.JobId)
+
+	j, err := s.alljobs.Get(b.JobId)
+	if err != nil {
+		s.log.Printf("[RELEASE] error - job %v not found in db\n", b.JobId)
+		return
+	}
+
+	s.log.Printf("[RELEASE] job %v (worker %v)\n", j.Id, b.WorkerId)
+	j.endAttempt(b.WorkerId, attemptDrained)
+	j.Status = StatusQueued
+	s.updateStats(func(st *Stats) { st.NRequeued++ })
+	s.save(j, Event{Type: EventRelease, OldStatus: StatusRunning, WorkerId: b.WorkerId, Actor: ActorWorker, Msg: "worker draining"})
+	s.queue.Requeue(j)
+}
+
+// finish records the outcome of j's attempt on worker ev.WorkerId (just
+// pushed or killed) and either retries j or saves it with its final status.
+// ev is the cause of j's transition.
+func (s *Server) finish(j *Job, ev Event) {
+	delete(s.jobinfo, j.Id)
+	if a := j.endAttempt(ev.WorkerId, j.Status); a != nil {
+		s.workers.finished(a.WorkerId, j.Status)
+		s.observe(s.runtime, a.Finished.Sub(a.Started))
+	}
+	if j.Status == StatusFailed && s.retry(j, false, ev) {
+		return
+	}
+
+	if j.Status == StatusFailed {
+		s.updateStats(func(st *Stats) { st.NFailed++ })
+		ev.Msg = j.FailReason
+		if j.MaxRetries > 0 {
+			j.Stderr += fmt.Sprintf("\ngiving up after %v attempts\n", len(j.Attempts))
+			ev.Msg = fmt.Sprintf("%v - giving up after %v attempts", j.FailReason, len(j.Attempts))
+		}
+	} else if j.Status == StatusComplete {
+		s.updateStats(func(st *Stats) { st.NCompleted++ })
+	}
+	s.save(j, ev)
+	s.jobdone(j)
+}
+
+// retry requeues j after a failed attempt if it has any retries left.  If
+// lost is true, the attempt failed because contact with its worker was lost
+// and j is requeued immediately without backoff.  False is returned if j's
+// retries are used up.  ev is the cause of j's transition.
+func (s *Server) retry(j *Job, lost bool, ev Event) bool {
+	budget := j.MaxRetries
+	if lost && budget < MinLostRetries {
+		budget = MinLostRetries
+	}
+	if j.recentAttempts() > budget {
+		return false
+	}
+
+	var delay time.Duration
+	if !lost {
+		delay = j.backoff()
+	}
+	ev.Msg = fmt.Sprintf("attempt %v failed: %v", len(j.Attempts), j.FailReason)
+	if delay > 0 {
+		ev.Msg += fmt.Sprintf(" - retrying in %v", delay)
+	}
+
+	s.updateStats(func(st *Stats) { st.NRequeued++ })
+	j.Status = StatusQueued
+	j.FailReason = ""
+	s.save(j, ev)
+
+	if delay == 0 {
+		s.log.Printf("[REQUEUE] job %v\n", j.Id)
+		s.queue.Requeue(j)
+		return true
+	}
+
+	s.log.Printf("[RETRY] job %v in %v\n", j.Id, delay)
+	jid := j.Id
+	time.AfterFunc(delay, func() {
+		select {
+		case s.requeue <- jid:
+		case <-s.kill:
+		}
+	})
+	return true
+}
+
+// failjob marks j as failed for the given reason (one of the Fail*
+// constants) and records it in the db.  msg is appended to j's stderr and
+// recorded with ev - the cause of the failure - in the event log.
+func (s *Server) failjob(j *Job, reason, msg string, ev Event) {
+	s.log.Printf("[FAIL] job %v: %v\n", j.Id, msg)
+	j.Status = StatusFailed
+	j.FailReason = reason
+	j.Stderr += "\n" + msg + "\n"
+	j.Finished = time.Now()
+	s.updateStats(func(st *Stats) { st.NFailed++ })
+	ev.Msg = msg
+	s.save(j, ev)
+	s.jobdone(j)
+}
+
+// waitjob returns the job with the given id and, if it hasn't finished, a
+// channel that is closed when it does.
+func (s *Server) waitjob(jid JobId) waitResponse {
+	j, err := s.alljobs.Get(jid)
+	if err != nil {
+		return waitResponse{}
+	} else if j.Done() {
+		return waitResponse{J: j}
+	}
+
+	ch, ok := s.waiters[jid]
+	if !ok {
+		ch = make(chan struct{})
+		s.waiters[jid] = ch
+	}
+	return waitResponse{J: j, Done: ch}
+}
+
+// readlog returns the output of job jid following offset.  The output of
+// finished jobs no longer being streamed is taken from their stdout and
+// stderr.
+func (s *Server) readlog(jid JobId, offset int64) logResponse {
+	if c, wait, ok := s.logs.read(jid, offset); ok {
+		return logResponse{Chunk: c, Wait: wait}
+	}
+
+	j, err := s.alljobs.Get(jid)
+	if err != nil {
+		return logResponse{Err: fmt.Errorf("unknown job id %v", jid)}
+	} else if !j.Done() {
+		// start tracking output so readers can wait for it
+		s.logs.get(jid)
+		c, wait, _ := s.logs.read(jid, offset)
+		return logResponse{Chunk: c, Wait: wait}
+	}
+
+	out := j.Stdout + j.Stderr
+	if offset < 0 {
+		offset = 0
+	} else if offset > int64(len(out)) {
+		offset = int64(len(out))
+	}
+	c := &LogChunk{JobId: jid, Data: []byte(out[offset:]), Offset: offset, Done: true}
+	return logResponse{Chunk: c}
+}
+
+// jobdone notifies any submitters and waiters waiting on j and releases (or
+// fails) the jobs waiting on j as a dependency.  It must be called after j
+// has reached its final status and been saved to the db.
+func (s *Server) jobdone(j *Job) {
+	s.logs.finish(j.Id)
+	if ch, ok := s.submitchans[j.Id]; ok {
+		ch <- j
+		close(ch)
+		delete(s.submitchans, j.Id)
+	}
+	if ch, ok := s.waiters[j.Id]; ok {
+		close(ch)
+		delete(s.waiters, j.Id)
+	}
+
+	ids, err := s.alljobs.Dependents(j.Id)
+	if err != nil {
+		s.log.Print(err)
+		return
+	}
+	for _, id := range ids {
+		dep, err := s.alljobs.Get(id)
+		if err != nil || dep.Status != StatusWaiting {
+			continue
+		}
+		s.schedule(dep, Event{Type: EventDependency, OldStatus: StatusWaiting, Actor: ActorServer, Msg: fmt.Sprintf("dependency %v %v", j.Id, j.Status)})
+	}
 }
 
 type jobRequest struct {
@@ -345,12 +1374,60 @@ type jobRequest struct {
 	Resp chan *Job
 }
 
+type waitRequest struct {
+	Id   JobId
+	Resp chan waitResponse
+}
+
+// waitResponse holds a job and, if it hasn't finished, a channel that is
+// closed when it does.
+type waitResponse struct {
+	J    *Job
+	Done chan struct{}
+}
+
 type jobSubmit struct {
 	J      *Job
 	Result chan *Job
+	// Resp, if not nil, receives nil once J was accepted or why it was
+	// rejected.
+	Resp chan error
+}
+
+type jobCancel struct {
+	Id JobId
+	// Token authorized the request.  It is nil for requests made through
+	// the Server methods.
+	Token *Token
+	// By is the actor of the request (see Event.Actor).
+	By   string
+	Resp chan error
+}
+
+type logRequest struct {
+	Id     JobId
+	Offset int64
+	Resp   chan logResponse
+}
+
+// logResponse holds a job's output and a channel that is closed when more
+// output is available.
+type logResponse struct {
+	Chunk *LogChunk
+	Wait  chan struct{}
+	Err   error
+}
+
+type workerDrain struct {
+	Id   WorkerId
+	All  bool
+	Resp chan error
 }
 
+// workRequest is sent to the dispatcher by fetching workers.  The dispatcher
+// sends the job to run (or nil if there are none) on Ch - or closes Ch if
+// the worker should drain.
 type workRequest struct {
-	WorkerId WorkerId
-	Ch       chan *Job
+	Worker *WorkerInfo
+	Ch     chan *Job
 }
@@ -8,15 +8,55 @@ import (
 	"io/ioutil"
 	"log"
 	"net/http"
-	"os"
+	"strconv"
+	"strings"
+	"time"
 )
 
 func httperror(w http.ResponseWriter, msg string, code int) {
-	http.Error(w, msg, http.StatusBadRequest)
+	http.Error(w, msg, code)
 	log.Print(msg)
 }
 
+// methods wraps h to only accept requests with the given methods.
+func methods(h http.HandlerFunc, allowed ...string) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		for _, m := range allowed {
+			if r.Method == m {
+				h(w, r)
+				return
+			}
+		}
+		httperror(w, fmt.Sprintf("%v not allowed for %v", r.Method, r.URL.Path), http.StatusMethodNotAllowed)
+	}
+}
+
+// workerCert wraps h to require worker client certificates (see
+// Server.WorkerCAs) for all but GET and HEAD requests.
+func (s *Server) workerCert(h http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != "GET" && r.Method != "HEAD" {
+			if err := s.checkWorkerCert(r); err != nil {
+				httperror(w, err.Error(), http.StatusForbidden)
+				return
+			}
+		}
+		h(w, r)
+	}
+}
+
 func (s *Server) handleJob(w http.ResponseWriter, r *http.Request) {
+	if strings.HasSuffix(r.URL.Path, "/log") {
+		s.handleJobLog(w, r)
+		return
+	} else if strings.HasSuffix(r.URL.Path, "/wait") {
+		s.handleJobWait(w, r)
+		return
+	} else if strings.HasSuffix(r.URL.Path, "/events") {
+		s.handleJobEvents(w, r)
+		return
+	}
+
 	if r.Method == "GET" || r.Method == "" {
 		idstr := r.URL.Path[len("/api/v1/job/"):]
 		j, err := s.getjob(idstr)
@@ -53,11 +93,321 @@ func (s *Server) handleJob(w http.ResponseWriter, r *http.Request) {
 		}
 
 		s.createJob(r, w, j)
+	} else if r.Method == "DELETE" {
+		idstr := r.URL.Path[len("/api/v1/job/"):]
+		j, err := s.getjob(idstr)
+		if err != nil {
+			httperror(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+
+		if err := s.cancelBy(j.Id, reqtoken(r), reqactor(r)); err == errNotOwner {
+			httperror(w, err.Error(), http.StatusForbidden)
+			return
+		} else if err != nil {
+			httperror(w, err.Error(), http.StatusConflict)
+			return
+		}
+
+		j, err = s.Get(j.Id)
+		if err != nil {
+			httperror(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+
+		data, err := json.Marshal(NewJobStat(j))
+		if err != nil {
+			httperror(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		w.Write(data)
+	}
+}
+
+// handleJobWait responds to GETs of /api/v1/job/[id]/wait with the job once
+// it has finished.  If the job hasn't finished within the timeout query
+// parameter (a duration like "10s" or a number of seconds - at most 30
+// seconds), its current status is returned instead.
+func (s *Server) handleJobWait(w http.ResponseWriter, r *http.Request) {
+	idstr := strings.TrimPrefix(r.URL.Path, "/api/v1/job/")
+	idstr = strings.TrimSuffix(idstr, "/wait")
+	jid, err := parseJobId(idstr)
+	if err != nil {
+		httperror(w, fmt.Sprintf("malformed job id %v", idstr), http.StatusBadRequest)
+		return
+	}
+
+	wait := maxJobWait
+	if v := r.URL.Query().Get("timeout"); v != "" {
+		if secs, err := strconv.ParseFloat(v, 64); err == nil {
+			wait = time.Duration(secs * float64(time.Second))
+		} else if wait, err = time.ParseDuration(v); err != nil {
+			httperror(w, fmt.Sprintf("invalid timeout '%v'", v), http.StatusBadRequest)
+			return
+		}
+	}
+	if wait > maxJobWait {
+		wait = maxJobWait
+	}
+
+	j, err := s.Wait(jid, wait)
+	if err != nil {
+		httperror(w, err.Error(), http.StatusNotFound)
+		return
+	}
+
+	var data []byte
+	if j.Done() {
+		data, err = json.Marshal(j)
+	} else {
+		data, err = json.Marshal(NewJobStat(j))
+	}
+	if err != nil {
+		httperror(w, err.Error(), http.StatusInternalServerError)
+		return
 	}
+	w.Write(data)
+}
+
+// handleJobLog responds to GETs of /api/v1/job/[id]/log with the job's
+// combined stdout and stderr.  With follow=1, the response is streamed until
+// the job finishes.  Output before the offset query parameter is skipped.
+func (s *Server) handleJobLog(w http.ResponseWriter, r *http.Request) {
+	idstr := strings.TrimPrefix(r.URL.Path, "/api/v1/job/")
+	idstr = strings.TrimSuffix(idstr, "/log")
+	j, err := s.getjob(idstr)
+	if err != nil {
+		httperror(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	var offset int64
+	if v := r.URL.Query().Get("offset"); v != "" {
+		if offset, err = strconv.ParseInt(v, 10, 64); err != nil {
+			httperror(w, fmt.Sprintf("invalid offset '%v'", v), http.StatusBadRequest)
+			return
+		}
+	}
+	follow := r.URL.Query().Get("follow")
+
+	w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+	if err := s.writeLog(w, r, j.Id, offset, follow != "" && follow != "0"); err != nil {
+		log.Print(err)
+	}
+}
+
+// writeLog writes the output of job jid following offset to w - flushing
+// each chunk of output.  If follow is true, writeLog returns after the job
+// finishes or the client goes away.
+func (s *Server) writeLog(w http.ResponseWriter, r *http.Request, jid JobId, offset int64, follow bool) error {
+	flusher, _ := w.(http.Flusher)
+	for {
+		var wait time.Duration
+		if follow {
+			wait = maxLogWait
+		}
+		c, err := s.Log(jid, offset, wait)
+		if err != nil {
+			return err
+		}
+		if _, err := w.Write(c.Data); err != nil {
+			return err
+		}
+		if flusher != nil {
+			flusher.Flush()
+		}
+
+		offset = c.Next()
+		if !follow || c.Done {
+			return nil
+		}
+		select {
+		case <-r.Context().Done():
+			return nil
+		default:
+		}
+	}
+}
+
+// handleJobEvents responds to GETs of /api/v1/job/[id]/events with all of
+// the job's events.
+func (s *Server) handleJobEvents(w http.ResponseWriter, r *http.Request) {
+	idstr := strings.TrimPrefix(r.URL.Path, "/api/v1/job/")
+	idstr = strings.TrimSuffix(idstr, "/events")
+	jid, err := parseJobId(idstr)
+	if err != nil {
+		httperror(w, fmt.Sprintf("malformed job id %v", idstr), http.StatusBadRequest)
+		return
+	}
+
+	events, err := s.JobEvents(jid)
+	if err != nil {
+		httperror(w, err.Error(), http.StatusNotFound)
+		return
+	}
+	data, err := json.Marshal(events)
+	if err != nil {
+		httperror(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.Write(data)
+}
+
+// handleEvents responds with the events of all jobs following the event with
+// the sequence number in the since query parameter (0 if omitted) - oldest
+// first.  At most limit (default DefaultEventLimit) events are returned.
+func (s *Server) handleEvents(w http.ResponseWriter, r *http.Request) {
+	var since uint64
+	limit := DefaultEventLimit
+	var err error
+	if v := r.URL.Query().Get("since"); v != "" {
+		if since, err = strconv.ParseUint(v, 10, 64); err != nil {
+			httperror(w, fmt.Sprintf("invalid since '%v'", v), http.StatusBadRequest)
+			return
+		}
+	}
+	if v := r.URL.Query().Get("limit"); v != "" {
+		if limit, err = strconv.Atoi(v); err != nil || limit < 0 {
+			httperror(w, fmt.Sprintf("invalid limit '%v'", v), http.StatusBadRequest)
+			return
+		}
+	}
+
+	events, err := s.Events(since, limit)
+	if err != nil {
+		httperror(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	data, err := json.Marshal(events)
+	if err != nil {
+		httperror(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.Write(data)
 }
 
 func (s *Server) handleReset(w http.ResponseWriter, r *http.Request) {
-	s.ResetQueue()
+	s.resetQueueBy(reqactor(r))
+}
+
+// handleBlob stores the request body in the blob store for POSTs and
+// responds with its hash.  For GETs and HEADs of /api/v1/blob/[hash], it
+// responds with the blob contents or with a 404 if it doesn't exist.
+func (s *Server) handleBlob(w http.ResponseWriter, r *http.Request) {
+	if r.Method == "POST" || r.Method == "PUT" {
+		data, err := ioutil.ReadAll(r.Body)
+		if err != nil {
+			httperror(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		hash, err := s.alljobs.PutBlob(data)
+		if err != nil {
+			httperror(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		w.WriteHeader(http.StatusCreated)
+		fmt.Fprint(w, hash)
+		return
+	}
+
+	hash := strings.TrimPrefix(r.URL.Path, "/api/v1/blob/")
+	if ok, err := s.alljobs.HasBlob(hash); err != nil {
+		httperror(w, err.Error(), http.StatusInternalServerError)
+		return
+	} else if !ok {
+		http.NotFound(w, r)
+		return
+	} else if r.Method == "HEAD" {
+		return
+	}
+
+	data, err := s.alljobs.GetBlob(hash)
+	if err != nil {
+		httperror(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.Write(data)
+}
+
+// handleMissingBlobs responds with a JSON list of the hashes in the JSON list
+// in the request body that are not in the blob store.
+func (s *Server) handleMissingBlobs(w http.ResponseWriter, r *http.Request) {
+	var hashes []string
+	if err := json.NewDecoder(r.Body).Decode(&hashes); err != nil {
+		httperror(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	missing, err := s.MissingBlobs(hashes)
+	if err != nil {
+		httperror(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	data, err := json.Marshal(missing)
+	if err != nil {
+		httperror(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.Write(data)
+}
+
+// handleJobs responds with a page of jobs selected by the request's query
+// parameters (see ParseQuery).
+func (s *Server) handleJobs(w http.ResponseWriter, r *http.Request) {
+	q, err := ParseQuery(r.URL.Query())
+	if err != nil {
+		httperror(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	page, err := s.List(q)
+	if err != nil {
+		httperror(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	data, err := json.Marshal(page)
+	if err != nil {
+		httperror(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.Write(data)
+}
+
+func (s *Server) handleWorkers(w http.ResponseWriter, r *http.Request) {
+	data, err := json.Marshal(s.Workers())
+	if err != nil {
+		httperror(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.Write(data)
+}
+
+func (s *Server) handleDrain(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "POST" {
+		httperror(w, "worker drain requires POST", http.StatusMethodNotAllowed)
+		return
+	}
+
+	idstr := strings.TrimPrefix(r.URL.Path, "/api/v1/worker-drain")
+	idstr = strings.TrimPrefix(idstr, "/")
+	if idstr == "" {
+		s.DrainAll()
+		return
+	}
+
+	uid, err := hex.DecodeString(idstr)
+	if err != nil || len(uid) != len(WorkerId{}) {
+		httperror(w, fmt.Sprintf("malformed worker id %v", idstr), http.StatusBadRequest)
+		return
+	}
+	var wid WorkerId
+	copy(wid[:], uid)
+
+	if err := s.Drain(wid); err != nil {
+		httperror(w, err.Error(), http.StatusNotFound)
+	}
 }
 
 func (s *Server) handleJobStat(w http.ResponseWriter, r *http.Request) {
@@ -78,7 +428,11 @@ func (s *Server) handleJobStat(w http.ResponseWriter, r *http.Request) {
 }
 
 func (s *Server) createJob(r *http.Request, w http.ResponseWriter, j *Job) {
-	s.Start(j, nil)
+	reqtoken(r).claim(j)
+	if err := s.submit(j, nil); err != nil {
+		httperror(w, err.Error(), http.StatusConflict)
+		return
+	}
 
 	j, err := s.Get(j.Id)
 	if err != nil {
@@ -101,6 +455,115 @@ func (s *Server) createJob(r *http.Request, w http.ResponseWriter, j *Job) {
 	w.Write(data)
 }
 
+// handleArray handles job arrays: POSTs of JobArray JSON to /api/v1/array
+// submit a new array, GETs of /api/v1/array/[id] return the array's progress,
+// DELETEs cancel its unfinished jobs and POSTs to /api/v1/array/[id]/retry
+// requeue its failed and canceled jobs.
+func (s *Server) handleArray(w http.ResponseWriter, r *http.Request) {
+	idstr := strings.Trim(strings.TrimPrefix(r.URL.Path, "/api/v1/array"), "/")
+	retry := strings.HasSuffix(idstr, "/retry")
+	idstr = strings.TrimSuffix(idstr, "/retry")
+
+	var st *ArrayStat
+	var err error
+	if idstr == "" {
+		if r.Method != "POST" {
+			httperror(w, "job array submission requires POST", http.StatusMethodNotAllowed)
+			return
+		}
+		a := &JobArray{}
+		if err := json.NewDecoder(r.Body).Decode(a); err != nil {
+			httperror(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		if a.Template != nil {
+			reqtoken(r).claim(a.Template)
+		}
+		if st, err = s.StartArray(a); err != nil {
+			httperror(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		w.Header().Set("Location", r.Host+"/api/v1/array/"+st.Id.String())
+		w.WriteHeader(http.StatusCreated)
+	} else {
+		id, err := parseJobId(idstr)
+		if err != nil {
+			httperror(w, fmt.Sprintf("malformed job array id %v", idstr), http.StatusBadRequest)
+			return
+		}
+
+		switch {
+		case retry && r.Method == "POST":
+			st, err = s.retryArrayBy(id, reqtoken(r), reqactor(r))
+		case retry:
+			httperror(w, "job array retry requires POST", http.StatusMethodNotAllowed)
+			return
+		case r.Method == "DELETE":
+			st, err = s.cancelArrayBy(id, reqtoken(r), reqactor(r))
+		default:
+			st, err = s.Array(id)
+		}
+		if err == errNotOwner {
+			httperror(w, err.Error(), http.StatusForbidden)
+			return
+		} else if err != nil {
+			httperror(w, err.Error(), http.StatusNotFound)
+			return
+		}
+	}
+
+	data, err := json.Marshal(st)
+	if err != nil {
+		log.Print(err)
+		return
+	}
+	w.Write(data)
+}
+
+// handleTokens manages API tokens: GETs of /api/v1/tokens list all tokens,
+// POSTs of a JSON object with the new token's Owner and Role create a token
+// (responding with its secret) and DELETEs of /api/v1/tokens/[id] revoke a
+// token.
+func (s *Server) handleTokens(w http.ResponseWriter, r *http.Request) {
+	id := strings.Trim(strings.TrimPrefix(r.URL.Path, "/api/v1/tokens"), "/")
+
+	var v interface{}
+	var err error
+	switch {
+	case r.Method == "POST" && id == "":
+		t := &Token{}
+		if err := json.NewDecoder(r.Body).Decode(t); err != nil {
+			httperror(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		if v, err = s.CreateToken(t.Owner, t.Role); err != nil {
+			httperror(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		w.WriteHeader(http.StatusCreated)
+	case r.Method == "DELETE" && id != "":
+		if err := s.RevokeToken(id); err != nil {
+			httperror(w, err.Error(), http.StatusNotFound)
+		}
+		return
+	case r.Method == "GET" && id == "":
+		if v, err = s.Tokens(); err != nil {
+			httperror(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+	default:
+		httperror(w, fmt.Sprintf("unsupported token request %v %v", r.Method, r.URL.Path), http.StatusMethodNotAllowed)
+		return
+	}
+
+	data, err := json.Marshal(v)
+	if err != nil {
+		log.Print(err)
+		return
+	}
+	w.Write(data)
+}
+
 func (s *Server) handleSubmitInfile(w http.ResponseWriter, r *http.Request) {
 	data, err := ioutil.ReadAll(r.Body)
 	if err != nil {
@@ -122,17 +585,38 @@ func (s *Server) handleOutfiles(w http.ResponseWriter, r *http.Request) {
 	}
 
 	if r.Method == "POST" {
+		// only the worker currently running the job may upload its output
+		wstr := r.URL.Query().Get("worker")
+		uid, err := hex.DecodeString(wstr)
+		if err != nil || len(uid) != len(WorkerId{}) {
+			httperror(w, fmt.Sprintf("malformed worker id '%v'", wstr), http.StatusBadRequest)
+			return
+		}
+		var wid WorkerId
+		copy(wid[:], uid)
+		if j.Status != StatusRunning || lastWorker(j) != wid {
+			msg := fmt.Sprintf("job %v outfile submission rejected: job is %v and not running on worker %v", idstr, j.Status, wid)
+			httperror(w, msg, http.StatusForbidden)
+			log.Print(msg)
+			return
+		}
+
 		fname := outfileName(j)
-		f, err := os.Create(fname)
+		f, err := s.outdata.Create(fname)
 		if err != nil {
 			msg := fmt.Sprintf("job %v outfile subission failed: %v", idstr, err)
 			http.Error(w, msg, http.StatusBadRequest)
 			log.Print(msg)
 			return
 		}
-		defer f.Close()
 
 		_, err = io.Copy(f, r.Body)
+		if err != nil {
+			f.Close()
+			s.outdata.Remove(fname)
+		} else {
+			err = f.Close()
+		}
 		if err != nil {
 			msg := fmt.Sprintf("job %v outfile subission failed: %v", idstr, err)
 			http.Error(w, msg, http.StatusBadRequest)
@@ -149,7 +633,7 @@ func (s *Server) handleOutfiles(w http.ResponseWriter, r *http.Request) {
 
 		w.Header().Add("Content-Disposition", fmt.Sprintf("filename=\"results-%v.zip\"", j.Id))
 
-		f, err := os.Open(outfileName(j))
+		f, err := s.outdata.Open(outfileName(j))
 		if err != nil {
 			msg := fmt.Sprintf("job %v output files not found", idstr)
 			http.Error(w, msg, http.StatusBadRequest)
@@ -1,32 +1,140 @@
 package cloudlus
 
-import "time"
+import (
+	"io"
+	"log"
+	"net/http"
+	"net/rpc"
+	"time"
+)
 
-type RPC struct {
-	s *Server
+// rpcConn holds the server and the API token secret of an rpc connection.
+// Each connection gets its own rpc services authenticated with the token the
+// client connected with.
+type rpcConn struct {
+	s      *Server
+	secret string
+	// remote is the client's address.
+	remote string
+	// certerr is the reason the connection can't be used by workers if they
+	// must present client certificates (see Server.WorkerCAs).
+	certerr error
 }
 
-func (r *RPC) Heartbeat(b Beat, kill *bool) error {
-	b.Time = time.Now()
-	b.kill = make(chan bool)
-	r.s.beat <- b
-	*kill = <-b.kill
-	return nil
+// authorize checks that the connection's token grants any of roles.
+func (r *rpcConn) authorize(roles ...string) (*Token, error) {
+	return r.s.authorize(r.secret, roles...)
+}
+
+// authorizeActor checks that the connection's token grants any of roles and
+// returns the token along with the connection's client as an event actor.
+func (r *rpcConn) authorizeActor(roles ...string) (*Token, string, error) {
+	t, err := r.authorize(roles...)
+	return t, actor(t, r.remote), err
+}
+
+// SubmitRPC holds the rpc methods for submitting, retrieving and listing
+// jobs.  It is served as the "Submit" service.
+type SubmitRPC struct{ rpcConn }
+
+// WorkerRPC holds the rpc methods used by workers to fetch and run jobs.  It
+// is served as the "Worker" service.
+type WorkerRPC struct{ rpcConn }
+
+// authorizeWorker checks that the connection may be used by workers.
+func (r *WorkerRPC) authorizeWorker() error {
+	if r.certerr != nil {
+		return r.certerr
+	}
+	_, err := r.authorize(RoleWorker)
+	return err
+}
+
+// AdminRPC holds the rpc methods for managing tokens and workers.  It is
+// served as the "Admin" service.
+type AdminRPC struct{ rpcConn }
+
+// BlobRPC holds the rpc methods for retrieving input file blobs used by
+// both submitters and workers.  It is served as the "Blob" service.
+type BlobRPC struct{ rpcConn }
+
+// connected is the response to successful rpc CONNECT requests expected by
+// net/rpc clients.
+const connected = "200 Connected to Go RPC"
+
+// serveRPC serves the rpc services of the listener's services (see
+// Server.handler) over a hijacked HTTP CONNECT request (see rpc.DialHTTP)
+// after checking the request's API token.
+func (s *Server) serveRPC(w http.ResponseWriter, r *http.Request, services map[string]bool) {
+	if r.Method != "CONNECT" {
+		httperror(w, "rpc requires CONNECT", http.StatusMethodNotAllowed)
+		return
+	}
+
+	secret := requestSecret(r)
+	if _, err := s.authorize(secret); err != nil {
+		httperror(w, err.Error(), http.StatusUnauthorized)
+		return
+	}
+
+	hj, ok := w.(http.Hijacker)
+	if !ok {
+		httperror(w, "rpc connection cannot be hijacked", http.StatusInternalServerError)
+		return
+	}
+	conn, _, err := hj.Hijack()
+	if err != nil {
+		log.Print("rpc hijacking ", r.RemoteAddr, ": ", err)
+		return
+	}
+	io.WriteString(conn, "HTTP/1.0 "+connected+"\n\n")
+
+	c := rpcConn{s: s, secret: secret, remote: r.RemoteAddr, certerr: s.checkWorkerCert(r)}
+	srv := rpc.NewServer()
+	srv.RegisterName("Blob", &BlobRPC{c})
+	if services[ServiceSubmit] {
+		srv.RegisterName("Submit", &SubmitRPC{c})
+	}
+	if services[ServiceWorker] {
+		srv.RegisterName("Worker", &WorkerRPC{c})
+	}
+	if services[ServiceAdmin] {
+		srv.RegisterName("Admin", &AdminRPC{c})
+	}
+	srv.ServeConn(conn)
 }
 
-// Submit j via rpc and block until complete returning the result job.
-func (r *RPC) Submit(j *Job, result **Job) error {
-	*result = r.s.Run(j)
+// Submit j via rpc and block until complete returning the result job.  The
+// result is lost if the connection drops or the server restarts - clients
+// should use SubmitAsync followed by Wait instead.
+func (r *SubmitRPC) Submit(j *Job, result **Job) error {
+	t, err := r.authorize(RoleSubmitter)
+	if err != nil {
+		return err
+	}
+	t.claim(j)
+	ch := make(chan *Job, 1)
+	if err := r.s.submit(j, ch); err != nil {
+		return err
+	}
+	*result = <-ch
 	return nil
 }
 
 // Submit j via rpc asynchronously.
-func (r *RPC) SubmitAsync(j *Job, unused *int) error {
-	r.s.Start(j, nil)
-	return nil
+func (r *SubmitRPC) SubmitAsync(j *Job, unused *int) error {
+	t, err := r.authorize(RoleSubmitter)
+	if err != nil {
+		return err
+	}
+	t.claim(j)
+	return r.s.submit(j, nil)
 }
 
-func (r *RPC) Retrieve(j JobId, result **Job) error {
+func (r *SubmitRPC) Retrieve(j JobId, result **Job) error {
+	if _, err := r.authorize(RoleReadOnly); err != nil {
+		return err
+	}
 	var err error
 	*result, err = r.s.Get(j)
 	if err != nil {
@@ -35,18 +143,300 @@ func (r *RPC) Retrieve(j JobId, result **Job) error {
 	return nil
 }
 
-func (r *RPC) Fetch(wid WorkerId, j **Job) error {
-	req := workRequest{wid, make(chan *Job)}
+// WaitRequest asks for a job once it has finished.  If it hasn't finished
+// yet, the server waits up to Wait for it to.
+type WaitRequest struct {
+	JobId JobId
+	Wait  time.Duration
+}
+
+// Wait returns the requested job once it has finished - waiting up to 30
+// seconds for it to finish.
+func (r *SubmitRPC) Wait(req WaitRequest, result **Job) error {
+	if _, err := r.authorize(RoleReadOnly); err != nil {
+		return err
+	}
+	if req.Wait > maxJobWait {
+		req.Wait = maxJobWait
+	}
+	var err error
+	*result, err = r.s.Wait(req.JobId, req.Wait)
+	return err
+}
+
+// Cancel cancels the job with the given id.
+func (r *SubmitRPC) Cancel(j JobId, unused *int) error {
+	t, by, err := r.authorizeActor(RoleSubmitter)
+	if err != nil {
+		return err
+	}
+	return r.s.cancelBy(j, t, by)
+}
+
+// Retry requeues the failed or canceled job with the given id.
+func (r *SubmitRPC) Retry(j JobId, unused *int) error {
+	t, by, err := r.authorizeActor(RoleSubmitter)
+	if err != nil {
+		return err
+	}
+	return r.s.retryBy(j, t, by)
+}
+
+// SubmitArray expands and submits the job array a.
+func (r *SubmitRPC) SubmitArray(a *JobArray, st *ArrayStat) error {
+	t, err := r.authorize(RoleSubmitter)
+	if err != nil {
+		return err
+	}
+	if a.Template != nil {
+		t.claim(a.Template)
+	}
+	stat, err := r.s.StartArray(a)
+	if err != nil {
+		return err
+	}
+	*st = *stat
+	return nil
+}
+
+// Array returns the progress of the job array with the given id.
+func (r *SubmitRPC) Array(id JobId, st *ArrayStat) error {
+	if _, err := r.authorize(RoleReadOnly); err != nil {
+		return err
+	}
+	stat, err := r.s.Array(id)
+	if err != nil {
+		return err
+	}
+	*st = *stat
+	return nil
+}
+
+// CancelArray cancels all unfinished jobs of the job array with the given
+// id.
+func (r *SubmitRPC) CancelArray(id JobId, st *ArrayStat) error {
+	t, by, err := r.authorizeActor(RoleSubmitter)
+	if err != nil {
+		return err
+	}
+	stat, err := r.s.cancelArrayBy(id, t, by)
+	if err != nil {
+		return err
+	}
+	*st = *stat
+	return nil
+}
+
+// RetryArray requeues all failed and canceled jobs of the job array with
+// the given id.
+func (r *SubmitRPC) RetryArray(id JobId, st *ArrayStat) error {
+	t, by, err := r.authorizeActor(RoleSubmitter)
+	if err != nil {
+		return err
+	}
+	stat, err := r.s.retryArrayBy(id, t, by)
+	if err != nil {
+		return err
+	}
+	*st = *stat
+	return nil
+}
+
+// MissingBlobs returns the hashes that are not in the server's blob store.
+func (r *SubmitRPC) MissingBlobs(hashes []string, missing *[]string) error {
+	if _, err := r.authorize(RoleSubmitter); err != nil {
+		return err
+	}
+	var err error
+	*missing, err = r.s.MissingBlobs(hashes)
+	return err
+}
+
+// PutBlob stores data in the server's blob store.
+func (r *SubmitRPC) PutBlob(data []byte, hash *string) error {
+	if _, err := r.authorize(RoleSubmitter); err != nil {
+		return err
+	}
+	var err error
+	*hash, err = r.s.alljobs.PutBlob(data)
+	return err
+}
+
+// List returns a page of jobs matching q.
+func (r *SubmitRPC) List(q Query, page *JobPage) error {
+	if _, err := r.authorize(RoleReadOnly); err != nil {
+		return err
+	}
+	p, err := r.s.List(q)
+	if err != nil {
+		return err
+	}
+	*page = *p
+	return nil
+}
+
+// Log returns the output of a job following the requested offset - waiting
+// up to 30 seconds for output if none is available yet.
+func (r *SubmitRPC) Log(req LogRequest, c *LogChunk) error {
+	if _, err := r.authorize(RoleReadOnly); err != nil {
+		return err
+	}
+	if req.Wait > maxLogWait {
+		req.Wait = maxLogWait
+	}
+	chunk, err := r.s.Log(req.JobId, req.Offset, req.Wait)
+	if err != nil {
+		return err
+	}
+	*c = *chunk
+	return nil
+}
+
+// Events returns events of all jobs following the requested sequence number.
+// At most DefaultEventLimit events are returned if no limit is requested.
+func (r *SubmitRPC) Events(req EventRequest, events *[]*Event) error {
+	if _, err := r.authorize(RoleReadOnly); err != nil {
+		return err
+	}
+	if req.Limit == 0 {
+		req.Limit = DefaultEventLimit
+	}
+	var err error
+	*events, err = r.s.Events(req.Since, req.Limit)
+	return err
+}
+
+// JobEvents returns all events of the job with the given id.
+func (r *SubmitRPC) JobEvents(j JobId, events *[]*Event) error {
+	if _, err := r.authorize(RoleReadOnly); err != nil {
+		return err
+	}
+	var err error
+	*events, err = r.s.JobEvents(j)
+	return err
+}
+
+// Workers returns the status of all workers known to the server.
+func (r *SubmitRPC) Workers(unused int, ws *[]WorkerStat) error {
+	if _, err := r.authorize(RoleReadOnly); err != nil {
+		return err
+	}
+	*ws = r.s.Workers()
+	return nil
+}
+
+// GetBlob retrieves the blob with the given hash from the server's blob
+// store.
+func (r *BlobRPC) GetBlob(hash string, data *[]byte) error {
+	if _, err := r.authorize(RoleReadOnly, RoleWorker); err != nil {
+		return err
+	}
+	var err error
+	*data, err = r.s.alljobs.GetBlob(hash)
+	return err
+}
+
+func (r *WorkerRPC) Heartbeat(b Beat, kill *bool) error {
+	if err := r.authorizeWorker(); err != nil {
+		return err
+	}
+	b.Time = time.Now()
+	b.kill = make(chan bool)
+	r.s.beat <- b
+	*kill = <-b.kill
+	return nil
+}
+
+// AppendLog adds output streamed by the worker running a job to the job's
+// log.
+func (r *WorkerRPC) AppendLog(c LogChunk, unused *int) error {
+	if err := r.authorizeWorker(); err != nil {
+		return err
+	}
+	r.s.appendlogs <- c
+	return nil
+}
+
+// Release hands the job in b back to the server by its draining worker to be
+// requeued immediately.
+func (r *WorkerRPC) Release(b Beat, unused *int) error {
+	if err := r.authorizeWorker(); err != nil {
+		return err
+	}
+	r.s.releasejobs <- b
+	return nil
+}
+
+func (r *WorkerRPC) Fetch(w WorkerInfo, j **Job) error {
+	if err := r.authorizeWorker(); err != nil {
+		return err
+	}
+	req := workRequest{&w, make(chan *Job)}
 	r.s.fetchjobs <- req
-	*j = <-req.Ch
-	if *j == nil {
+	var ok bool
+	*j, ok = <-req.Ch
+	if !ok {
+		return drainerr
+	} else if *j == nil {
 		return nojoberr
 	}
 
 	return nil
 }
 
-func (r *RPC) Push(j *Job, unused *int) error {
+func (r *WorkerRPC) Push(j *Job, unused *int) error {
+	if err := r.authorizeWorker(); err != nil {
+		return err
+	}
 	r.s.pushjobs <- j
 	return nil
 }
+
+// Drain asks the worker with the given id to shut down after finishing its
+// running jobs.
+func (r *AdminRPC) Drain(wid WorkerId, unused *int) error {
+	if _, err := r.authorize(RoleAdmin); err != nil {
+		return err
+	}
+	return r.s.Drain(wid)
+}
+
+// DrainAll asks all workers to shut down after finishing their running jobs.
+func (r *AdminRPC) DrainAll(unused int, unused2 *int) error {
+	if _, err := r.authorize(RoleAdmin); err != nil {
+		return err
+	}
+	r.s.DrainAll()
+	return nil
+}
+
+// CreateToken creates a new API token granting t.Role to t.Owner.
+func (r *AdminRPC) CreateToken(t Token, it *IssuedToken) error {
+	if _, err := r.authorize(RoleAdmin); err != nil {
+		return err
+	}
+	issued, err := r.s.CreateToken(t.Owner, t.Role)
+	if err != nil {
+		return err
+	}
+	*it = *issued
+	return nil
+}
+
+// Tokens returns all API tokens.
+func (r *AdminRPC) Tokens(unused int, ts *[]*Token) error {
+	if _, err := r.authorize(RoleAdmin); err != nil {
+		return err
+	}
+	var err error
+	*ts, err = r.s.Tokens()
+	return err
+}
+
+// RevokeToken deletes the API token with the given id.
+func (r *AdminRPC) RevokeToken(id string, unused *int) error {
+	if _, err := r.authorize(RoleAdmin); err != nil {
+		return err
+	}
+	return r.s.RevokeToken(id)
+}
@@ -1,6 +1,13 @@
 package cloudlus
 
 import (
+	"bytes"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
 	"testing"
 	"time"
 )
@@ -28,7 +35,7 @@ func TestServerJobGC(t *testing.T) {
 		t.Fatal(err)
 	}
 
-	s := NewServer(testaddr, testaddr, db)
+	s := NewServer(testaddr, testaddr, db, nil, nil)
 	s.CollectFreq = 1 * time.Second
 	go s.ListenAndServe()
 	defer s.Close()
@@ -46,5 +53,1016 @@ func TestServerJobGC(t *testing.T) {
 }
 
 func TestJobRequeue(t *testing.T) {
-	t.Fatal("not implemented")
+	db, _ := NewDB("", dblimit)
+	s := NewServer(testaddr, testaddr, db, nil, nil)
+	nolog(s)
+	defer s.Close()
+
+	wid := WorkerId{1}
+	j := NewJobCmd("echo", "1")
+	for i := 0; i <= MinLostRetries; i++ {
+		// simulate a fetch by a worker that then stops responding
+		j.Status = StatusRunning
+		j.Attempts = append(j.Attempts, Attempt{WorkerId: wid, Started: time.Now()})
+		db.Put(j)
+		s.jobinfo[j.Id] = Beat{Time: time.Now().Add(-2 * beatLimit), WorkerId: wid, JobId: j.Id}
+
+		s.checkbeat()
+
+		j, _ = db.Get(j.Id)
+		if n := len(j.Attempts); j.Attempts[n-1].Status != attemptLost {
+			t.Errorf("attempt %v: wrong status: got '%v', expected '%v'", n, j.Attempts[n-1].Status, attemptLost)
+		}
+
+		if i < MinLostRetries {
+			if j.Status != StatusQueued {
+				t.Fatalf("attempt %v: wrong job status: got '%v', expected '%v'", i+1, j.Status, StatusQueued)
+			} else if !s.queue.Remove(j.Id) {
+				t.Fatalf("attempt %v: job was not requeued", i+1)
+			}
+		} else if j.Status != StatusFailed {
+			t.Errorf("job still %v after exceeding its retry budget", j.Status)
+		}
+	}
+}
+
+func TestJobRetry(t *testing.T) {
+	db, _ := NewDB("", dblimit)
+	s := NewServer(testaddr, testaddr, db, nil, nil)
+	nolog(s)
+	go s.dispatcher()
+	defer s.Close()
+
+	wid := WorkerId{1}
+	j := NewJobCmd("false")
+	j.MaxRetries = 1
+	j.RetryBackoff = 10 * time.Millisecond
+	result := s.Start(j, nil)
+
+	for i := 0; i < 2; i++ {
+		<-time.After(5 * j.RetryBackoff)
+		j := fetch(s, wid)
+		if j == nil {
+			t.Fatalf("attempt %v: failed job was not retried", i+1)
+		}
+		j.Status = StatusFailed
+		j.WorkerId = wid
+		s.pushjobs <- j
+	}
+
+	select {
+	case j := <-result:
+		if j.Status != StatusFailed {
+			t.Errorf("wrong job status: got '%v', expected '%v'", j.Status, StatusFailed)
+		} else if len(j.Attempts) != 2 {
+			t.Errorf("wrong number of attempts: got %v, expected 2", len(j.Attempts))
+		} else if j.Attempts[0].WorkerId != wid || j.Attempts[0].Status != StatusFailed {
+			t.Errorf("wrong attempt history: %+v", j.Attempts[0])
+		}
+	case <-time.After(1 * time.Second):
+		t.Fatalf("job with exhausted retries was not reported to submitter")
+	}
+}
+
+// fetch retrieves the next queued job from s's dispatcher as a worker would.
+func fetch(s *Server, wid WorkerId) *Job {
+	req := workRequest{Worker: &WorkerInfo{Id: wid}, Ch: make(chan *Job)}
+	s.fetchjobs <- req
+	return <-req.Ch
+}
+
+func TestJobDependencies(t *testing.T) {
+	db, _ := NewDB("", dblimit)
+	s := NewServer(testaddr, testaddr, db, nil, nil)
+	nolog(s)
+	go s.dispatcher()
+	defer s.Close()
+
+	parent := NewJobCmd("echo", "1")
+	child := NewJobCmd("echo", "2")
+	child.After(parent)
+	s.Start(parent, nil)
+	s.Start(child, nil)
+
+	if j, _ := s.Get(child.Id); j.Status != StatusWaiting {
+		t.Fatalf("wrong child status: got '%v', expected '%v'", j.Status, StatusWaiting)
+	}
+
+	j := fetch(s, WorkerId{})
+	if j == nil || j.Id != parent.Id {
+		t.Fatalf("fetched wrong job: got %v, expected parent %v", j, parent.Id)
+	}
+	if j := fetch(s, WorkerId{}); j != nil {
+		t.Fatalf("child job %v was dispatched before its parent completed", j.Id)
+	}
+
+	j.Status = StatusComplete
+	s.pushjobs <- j
+
+	if j, _ := s.Get(child.Id); j.Status != StatusQueued {
+		t.Fatalf("wrong child status: got '%v', expected '%v'", j.Status, StatusQueued)
+	}
+	if j := fetch(s, WorkerId{}); j == nil || j.Id != child.Id {
+		t.Errorf("fetched wrong job: got %v, expected child %v", j, child.Id)
+	}
+}
+
+func TestJobDependencyFailure(t *testing.T) {
+	db, _ := NewDB("", dblimit)
+	s := NewServer(testaddr, testaddr, db, nil, nil)
+	nolog(s)
+	go s.dispatcher()
+	defer s.Close()
+
+	a := NewJobCmd("echo", "1")
+	b := NewJobCmd("echo", "2")
+	c := NewJobCmd("echo", "3")
+	b.After(a)
+	c.After(b)
+	s.Start(a, nil)
+	s.Start(b, nil)
+	result := s.Start(c, nil)
+
+	j := fetch(s, WorkerId{})
+	j.Status = StatusFailed
+	s.pushjobs <- j
+
+	select {
+	case j := <-result:
+		if j.Status != StatusFailed {
+			t.Errorf("wrong grandchild status: got '%v', expected '%v'", j.Status, StatusFailed)
+		}
+		if j.FailReason != FailDependency {
+			t.Errorf("wrong grandchild fail reason: got '%v', expected '%v'", j.FailReason, FailDependency)
+		}
+	case <-time.After(1 * time.Second):
+		t.Fatalf("dependent job failure was not reported to submitter")
+	}
+
+	if j, _ := s.Get(b.Id); j.Status != StatusFailed {
+		t.Errorf("wrong child status: got '%v', expected '%v'", j.Status, StatusFailed)
+	}
+}
+
+func TestJobRerun(t *testing.T) {
+	db, _ := NewDB("", dblimit)
+	s := NewServer(testaddr, testaddr, db, nil, nil)
+	nolog(s)
+	go s.dispatcher()
+	defer s.Close()
+
+	a := NewJobCmd("false")
+	a.MaxRetries = 1
+	a.RetryBackoff = time.Millisecond
+	b := NewJobCmd("echo", "2")
+	c := NewJobCmd("echo", "3")
+	b.After(a)
+	c.After(b)
+	s.Start(a, nil)
+	s.Start(b, nil)
+	s.Start(c, nil)
+
+	push := func(status string) {
+		var j *Job
+		for timeout := time.After(time.Second); j == nil; {
+			select {
+			case <-timeout:
+				t.Fatalf("job was not requeued")
+			case <-time.After(5 * time.Millisecond):
+				j = fetch(s, WorkerId{1})
+			}
+		}
+		j.Status = status
+		j.WorkerId = WorkerId{1}
+		s.pushjobs <- j
+	}
+	push(StatusFailed)
+	push(StatusFailed)
+	if j, _ := s.Get(c.Id); j.Status != StatusFailed || j.FailReason != FailDependency {
+		t.Fatalf("grandchild not failed with its dependency: %v (%v)", j.Status, j.FailReason)
+	}
+
+	// the retried job gets its retries back and its failed dependents wait
+	// for it again
+	if err := s.Retry(a.Id); err != nil {
+		t.Fatal(err)
+	}
+	for _, id := range []JobId{b.Id, c.Id} {
+		if j, _ := s.Get(id); j.Status != StatusWaiting {
+			t.Errorf("dependent %v not requeued with its dependency: got status %v", id, j.Status)
+		}
+	}
+	push(StatusFailed)
+	if j, _ := s.Get(a.Id); j.Status != StatusQueued {
+		t.Errorf("retried job was not retried automatically: got status %v", j.Status)
+	}
+	push(StatusComplete)
+	if j, _ := s.Get(b.Id); j.Status != StatusQueued {
+		t.Errorf("dependent not queued after its dependency completed: got status %v", j.Status)
+	}
+}
+
+func TestJobCancel(t *testing.T) {
+	db, _ := NewDB("", dblimit)
+	s := NewServer(testaddr, testaddr, db, nil, nil)
+	nolog(s)
+	go s.dispatcher()
+	defer s.Close()
+
+	running := NewJobCmd("echo", "1")
+	queued := NewJobCmd("echo", "2")
+	result := s.Start(running, nil)
+	s.Start(queued, nil)
+
+	wid := WorkerId{1}
+	if j := fetch(s, wid); j == nil || j.Id != running.Id {
+		t.Fatalf("fetched wrong job: got %v, expected %v", j, running.Id)
+	}
+
+	if err := s.Cancel(queued.Id); err != nil {
+		t.Fatal(err)
+	} else if err := s.Cancel(running.Id); err != nil {
+		t.Fatal(err)
+	} else if err := s.Cancel(running.Id); err == nil {
+		t.Errorf("canceling a finished job should fail")
+	}
+
+	if j := <-result; j.Status != StatusCanceled || j.FailReason != FailCanceled {
+		t.Errorf("wrong status sent to submitter: got '%v' (%v), expected '%v'", j.Status, j.FailReason, StatusCanceled)
+	}
+	if j := fetch(s, wid); j != nil {
+		t.Errorf("canceled job %v was dispatched", j.Id)
+	}
+
+	b := NewBeat(wid, running.Id)
+	b.kill = make(chan bool)
+	s.beat <- b
+	if !<-b.kill {
+		t.Errorf("worker running canceled job was not killed")
+	}
+
+	// the killed job's push must not overwrite its canceled status
+	j, _ := s.Get(running.Id)
+	j.Status = StatusFailed
+	s.pushjobs <- j
+	if j, _ := s.Get(running.Id); j.Status != StatusCanceled {
+		t.Errorf("wrong status after push: got '%v', expected '%v'", j.Status, StatusCanceled)
+	}
+}
+
+func TestWorkerRegistry(t *testing.T) {
+	db, _ := NewDB("", dblimit)
+	s := NewServer(testaddr, testaddr, db, nil, nil)
+	nolog(s)
+	go s.dispatcher()
+	defer s.Close()
+
+	busy, idle := WorkerId{1}, WorkerId{2}
+	s.Start(NewJobCmd("echo", "1"), nil)
+	j := fetch(s, busy)
+	if j == nil {
+		t.Fatal("no job fetched")
+	}
+	fetch(s, idle)
+
+	ws := s.Workers()
+	if len(ws) != 2 {
+		t.Fatalf("wrong number of registered workers: got %v, want 2", len(ws))
+	}
+	for _, w := range ws {
+		if w.Id == busy && (len(w.Jobs) != 1 || w.Jobs[0] != j.Id) {
+			t.Errorf("busy worker has wrong current jobs %v, want [%v]", w.Jobs, j.Id)
+		} else if w.Id == idle && len(w.Jobs) != 0 {
+			t.Errorf("idle worker has current jobs %v", w.Jobs)
+		}
+	}
+
+	j.Status = StatusComplete
+	j.WorkerId = busy
+	s.pushjobs <- j
+	for _, w := range s.Workers() {
+		if w.Id == busy && (w.NCompleted != 1 || len(w.Jobs) != 0) {
+			t.Errorf("busy worker stats not updated after push: %+v", w)
+		}
+	}
+}
+
+func TestWorkerExpiry(t *testing.T) {
+	db, _ := NewDB("", dblimit)
+	s := NewServer(testaddr, testaddr, db, nil, nil)
+	nolog(s)
+	defer s.Close()
+
+	busy, idle := WorkerId{1}, WorkerId{2}
+	s.workers.fetched(&WorkerInfo{Id: busy})
+	s.workers.fetched(&WorkerInfo{Id: idle})
+	for _, ws := range s.workers {
+		ws.LastSeen = time.Now().Add(-2 * WorkerExpiry)
+	}
+	s.jobinfo[JobId{1}] = NewBeat(busy, JobId{1})
+
+	s.checkbeat()
+	if _, ok := s.workers[idle]; ok {
+		t.Errorf("idle worker was not expired")
+	}
+	if _, ok := s.workers[busy]; !ok {
+		t.Errorf("worker with a running job was expired")
+	}
+}
+
+func TestJobLatePush(t *testing.T) {
+	db, _ := NewDB("", dblimit)
+	s := NewServer(testaddr, testaddr, db, nil, nil)
+	nolog(s)
+	go s.dispatcher()
+	defer s.Close()
+
+	w1, w2 := WorkerId{1}, WorkerId{2}
+	j := NewJobCmd("echo", "1")
+	j.Owner = "alice"
+	result := s.Start(j, nil)
+
+	// the job is taken away from w1 and runs on w2 when w1's result arrives
+	stale := fetch(s, w1)
+	s.releasejobs <- NewBeat(w1, j.Id)
+	if fetched := fetch(s, w2); fetched == nil || fetched.Id != j.Id {
+		t.Fatalf("released job was not requeued")
+	}
+	stale.Status = StatusComplete
+	stale.WorkerId = w1
+	stale.Stdout = "1\n"
+	stale.Owner = "mallory"
+	stale.Attempts = nil
+	s.pushjobs <- stale
+
+	got := <-result
+	if got.Status != StatusComplete || got.Stdout != "1\n" {
+		t.Errorf("late result not accepted: got status %v, stdout %q", got.Status, got.Stdout)
+	}
+	if got.Owner != "alice" {
+		t.Errorf("late push replaced the job's owner: got %v", got.Owner)
+	}
+	if n := len(got.Attempts); n != 2 || got.Attempts[0].Status != StatusComplete || got.Attempts[1].Status != attemptSuperseded {
+		t.Errorf("wrong attempt history after late push: %+v", got.Attempts)
+	}
+
+	// w2 is stopped and its result isn't counted again
+	b := NewBeat(w2, j.Id)
+	b.kill = make(chan bool)
+	s.beat <- b
+	if !<-b.kill {
+		t.Errorf("worker running a superseded attempt was not killed")
+	}
+	again := *stale
+	again.WorkerId = w2
+	s.pushjobs <- &again
+	if j, _ := s.Get(j.Id); len(j.Attempts) != 2 {
+		t.Errorf("push for a finished job changed it: %+v", j.Attempts)
+	}
+	if n := s.Stats().NCompleted; n != 1 {
+		t.Errorf("job completion counted %v times", n)
+	}
+}
+
+func TestJobForeignPush(t *testing.T) {
+	db, _ := NewDB("", dblimit)
+	s := NewServer(testaddr, testaddr, db, nil, nil)
+	nolog(s)
+	go s.dispatcher()
+	defer s.Close()
+
+	j := NewJobCmd("echo", "1")
+	forged := *j
+	s.Start(j, nil)
+
+	forged.Status = StatusComplete
+	forged.WorkerId = WorkerId{9}
+	forged.Stdout = "forged\n"
+	s.pushjobs <- &forged
+
+	if got, _ := s.Get(j.Id); got.Status != StatusQueued || got.Stdout != "" {
+		t.Errorf("push from a worker the job never ran on was accepted: status %v, stdout %q", got.Status, got.Stdout)
+	}
+	if fetched := fetch(s, WorkerId{1}); fetched == nil || fetched.Id != j.Id {
+		t.Errorf("job was removed from the queue by a foreign push")
+	}
+}
+
+func TestWorkerDrain(t *testing.T) {
+	db, _ := NewDB("", dblimit)
+	s := NewServer(testaddr, testaddr, db, nil, nil)
+	nolog(s)
+	go s.dispatcher()
+	defer s.Close()
+
+	wid := WorkerId{1}
+	j := NewJobCmd("echo", "1")
+	s.Start(j, nil)
+	if fetched := fetch(s, wid); fetched == nil || fetched.Id != j.Id {
+		t.Fatalf("fetched wrong job: got %v, expected %v", fetched, j.Id)
+	}
+
+	if err := s.Drain(WorkerId{2}); err == nil {
+		t.Errorf("draining an unknown worker should fail")
+	} else if err := s.Drain(wid); err != nil {
+		t.Fatal(err)
+	}
+
+	req := workRequest{Worker: &WorkerInfo{Id: wid}, Ch: make(chan *Job)}
+	s.fetchjobs <- req
+	if _, ok := <-req.Ch; ok {
+		t.Errorf("draining worker was not told to drain")
+	}
+
+	// the drained job should be requeued immediately for other workers
+	s.releasejobs <- NewBeat(wid, j.Id)
+	fetched := fetch(s, WorkerId{3})
+	if fetched == nil || fetched.Id != j.Id {
+		t.Fatalf("released job was not requeued: got %v, expected %v", fetched, j.Id)
+	}
+	if n := len(fetched.Attempts); n != 2 || fetched.Attempts[0].Status != attemptDrained {
+		t.Errorf("wrong attempt history for released job: %+v", fetched.Attempts)
+	}
+}
+
+func TestJobMemoize(t *testing.T) {
+	db, _ := NewDB("", dblimit)
+	s := NewServer(testaddr, testaddr, db, nil, nil)
+	s.Memoize = true
+	nolog(s)
+	go s.dispatcher()
+	defer s.Close()
+
+	newjob := func(input string) *Job {
+		j := NewJobCmd("cat", "in.txt")
+		j.AddInfile("in.txt", []byte(input))
+		j.AddOutfile("out.txt")
+		return j
+	}
+
+	orig := newjob("a")
+	result := s.Start(orig, nil)
+	j := fetch(s, WorkerId{1})
+	if err := ioutil.WriteFile(outfileName(j), []byte("zipdata"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	defer os.Remove(outfileName(j))
+	j.Status = StatusComplete
+	j.Stdout = "a"
+	j.WorkerId = WorkerId{1}
+	s.pushjobs <- j
+	<-result
+
+	same := newjob("a")
+	defer os.Remove(outfileName(same))
+	select {
+	case j := <-s.Start(same, nil):
+		if j.Status != StatusComplete || j.Stdout != "a" {
+			t.Errorf("memoized job has wrong results: status '%v', stdout '%v'", j.Status, j.Stdout)
+		}
+	case <-time.After(1 * time.Second):
+		t.Fatalf("identical job was not completed from memoized results")
+	}
+	if _, err := os.Stat(outfileName(same)); err != nil {
+		t.Errorf("memoized job has no output data: %v", err)
+	}
+
+	nocache := newjob("a")
+	nocache.NoCache = true
+	s.Start(nocache, nil)
+	s.Start(newjob("b"), nil)
+	if j, _ := s.Get(nocache.Id); j.Status != StatusQueued {
+		t.Errorf("NoCache job was not queued: status '%v'", j.Status)
+	}
+
+	// results of jobs requiring other worker labels aren't shared
+	labeled := newjob("a")
+	labeled.Requires = []string{"cyclus=1.3", "cycamore"}
+	s.Start(labeled, nil)
+	if j, _ := s.Get(labeled.Id); j.Status != StatusQueued {
+		t.Errorf("job with different requirements was memoized: status '%v'", j.Status)
+	}
+	reordered := newjob("a")
+	reordered.Requires = []string{"cycamore", "cyclus=1.3"}
+	if !bytes.Equal(labeled.memoHash(), reordered.memoHash()) {
+		t.Errorf("memo hash depends on the order of required labels")
+	}
+
+	if st := s.Stats(); st.NCacheHits != 1 || st.NCacheMisses != 3 {
+		t.Errorf("wrong cache stats: got %v hits, %v misses, want 1 and 3", st.NCacheHits, st.NCacheMisses)
+	}
+}
+
+func TestJobInfileBlobs(t *testing.T) {
+	db, _ := NewDB("", dblimit)
+	s := NewServer(testaddr, testaddr, db, nil, nil)
+	nolog(s)
+	go s.dispatcher()
+	defer s.Close()
+
+	inline := NewJobCmd("cat", "in.txt")
+	inline.AddInfile("in.txt", []byte("hello"))
+	s.Start(inline, nil)
+
+	j, _ := s.Get(inline.Id)
+	f := j.Infiles[0]
+	if f.Data != nil || f.Hash != blobHash([]byte("hello")) || f.Size != 5 {
+		t.Errorf("input file not moved to blob store: %+v", f)
+	} else if missing, _ := s.MissingBlobs([]string{f.Hash, "abc"}); len(missing) != 1 || missing[0] != "abc" {
+		t.Errorf("wrong missing blobs: got %v, want [abc]", missing)
+	}
+
+	ref := NewJobCmd("cat", "in.txt")
+	ref.Infiles = []File{f}
+	s.Start(ref, nil)
+	if j, _ := s.Get(ref.Id); j.Status != StatusQueued {
+		t.Errorf("job referring to stored blob not queued: status '%v'", j.Status)
+	}
+
+	bad := NewJobCmd("cat", "in.txt")
+	bad.Infiles = []File{{Name: "in.txt", Hash: "abc"}}
+	s.Start(bad, nil)
+	if j, _ := s.Get(bad.Id); j.Status != StatusFailed {
+		t.Errorf("job referring to unknown blob not failed: status '%v'", j.Status)
+	}
+}
+
+func TestJobLog(t *testing.T) {
+	db, _ := NewDB("", dblimit)
+	s := NewServer(testaddr, testaddr, db, nil, nil)
+	nolog(s)
+	go s.dispatcher()
+	defer s.Close()
+
+	wid := WorkerId{1}
+	j := NewJobCmd("echo", "1")
+	s.Start(j, nil)
+
+	// followers wait for output of jobs that haven't started yet
+	got := make(chan *LogChunk)
+	go func() {
+		c, _ := s.Log(j.Id, 0, 5*time.Second)
+		got <- c
+	}()
+
+	if fetched := fetch(s, wid); fetched == nil {
+		t.Fatal("no job fetched")
+	}
+	s.appendlogs <- LogChunk{JobId: j.Id, WorkerId: WorkerId{2}, Data: []byte("stale\n")}
+	s.appendlogs <- LogChunk{JobId: j.Id, WorkerId: wid, Data: []byte("hello\n")}
+	if c := <-got; c == nil || string(c.Data) != "hello\n" || c.Done {
+		t.Fatalf("follower got wrong output %+v, want 'hello'", c)
+	}
+
+	s.appendlogs <- LogChunk{JobId: j.Id, WorkerId: wid, Data: []byte("world\n")}
+	if c, err := s.Log(j.Id, 6, 0); err != nil || string(c.Data) != "world\n" || c.Next() != 12 {
+		t.Errorf("wrong output after offset: got %+v (err=%v), want 'world'", c, err)
+	}
+
+	go func() {
+		c, _ := s.Log(j.Id, 12, 5*time.Second)
+		got <- c
+	}()
+	j.Status = StatusComplete
+	j.WorkerId = wid
+	j.Stdout = "final output\n"
+	s.pushjobs <- j
+	if c := <-got; c == nil || !c.Done || len(c.Data) != 0 {
+		t.Errorf("follower not told job finished: got %+v", c)
+	}
+
+	// output of finished jobs that weren't streamed comes from the db
+	canceled := NewJobCmd("echo", "2")
+	s.Start(canceled, nil)
+	s.Cancel(canceled.Id)
+	canceled, _ = s.Get(canceled.Id)
+	if c, err := s.Log(canceled.Id, 0, 0); err != nil || string(c.Data) != canceled.Stderr || !c.Done {
+		t.Errorf("wrong output for finished job: got %+v (err=%v), want '%v'", c, err, canceled.Stderr)
+	}
+}
+
+func TestJobLogRetry(t *testing.T) {
+	db, _ := NewDB("", dblimit)
+	s := NewServer(testaddr, testaddr, db, nil, nil)
+	nolog(s)
+	go s.dispatcher()
+	defer s.Close()
+
+	wid := WorkerId{1}
+	j := NewJobCmd("false")
+	j.MaxRetries = 1
+	j.RetryBackoff = 10 * time.Millisecond
+	s.Start(j, nil)
+
+	if fetched := fetch(s, wid); fetched == nil {
+		t.Fatal("no job fetched")
+	}
+	s.appendlogs <- LogChunk{JobId: j.Id, WorkerId: wid, Data: []byte("first")}
+	j.Status = StatusFailed
+	j.WorkerId = wid
+	s.pushjobs <- j
+
+	<-time.After(5 * j.RetryBackoff)
+	if fetched := fetch(s, wid); fetched == nil {
+		t.Fatal("failed job was not retried")
+	}
+	s.appendlogs <- LogChunk{JobId: j.Id, WorkerId: wid, Data: []byte("second\n")}
+	want := "first\n--- attempt 2 (worker " + wid.String() + ") ---\nsecond\n"
+	if c, err := s.Log(j.Id, 0, 0); err != nil || string(c.Data) != want || c.Done {
+		t.Fatalf("wrong output of retried job: got %+v (err=%v), want '%v'", c, err, want)
+	}
+
+	j.Status = StatusComplete
+	s.pushjobs <- j
+	if c, err := s.Log(j.Id, int64(len(want)), 0); err != nil || !c.Done {
+		t.Errorf("follower not told retried job finished: got %+v (err=%v)", c, err)
+	}
+}
+
+func TestJobLogTail(t *testing.T) {
+	defer func(n int) { LogTailSize = n }(LogTailSize)
+	LogTailSize = 4
+
+	logs := jobLogs{}
+	jid := JobId{1}
+	logs.append(jid, []byte("abc"))
+	logs.append(jid, []byte("defg"))
+	if c, _, _ := logs.read(jid, 0); string(c.Data) != "defg" || c.Offset != 3 {
+		t.Errorf("wrong tail: got '%s' at %v, want 'defg' at 3", c.Data, c.Offset)
+	}
+}
+
+func TestJobArray(t *testing.T) {
+	db, _ := NewDB("", dblimit)
+	s := NewServer(testaddr, testaddr, db, nil, nil)
+	nolog(s)
+	go s.dispatcher()
+	defer s.Close()
+
+	tmpl := NewJobCmd("echo", "{{.n}}")
+	params := []map[string]string{{"n": "1"}, {"n": "2"}, {"n": "3"}}
+	st, err := s.StartArray(NewJobArray(tmpl, params))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if st.Size != 3 || st.Counts[StatusQueued] != 3 || st.Done {
+		t.Fatalf("wrong array status after submit: %+v", st)
+	}
+
+	wid := WorkerId{1}
+	for i := 0; i < 3; i++ {
+		j := fetch(s, wid)
+		if j == nil {
+			t.Fatalf("array job %v not dispatched", i)
+		}
+		j.WorkerId = wid
+		j.Status = StatusComplete
+		if i == 0 {
+			j.Status = StatusFailed
+		}
+		s.pushjobs <- j
+		s.Get(j.Id) // wait for the push to be handled
+	}
+
+	st, err = s.Array(st.Id)
+	if err != nil {
+		t.Fatal(err)
+	} else if st.Counts[StatusFailed] != 1 || st.Counts[StatusComplete] != 2 || len(st.Failed) != 1 || !st.Done {
+		t.Fatalf("wrong array status after running: %+v", st)
+	}
+	failed := st.Failed[0]
+
+	st, err = s.RetryArray(st.Id)
+	if err != nil {
+		t.Fatal(err)
+	} else if st.Counts[StatusQueued] != 1 || st.Done {
+		t.Errorf("wrong array status after retry: %+v", st)
+	}
+	if j := fetch(s, wid); j == nil || j.Id != failed {
+		t.Errorf("retried job not dispatched: got %v, want %v", j, failed)
+	}
+
+	st, err = s.CancelArray(st.Id)
+	if err != nil {
+		t.Fatal(err)
+	} else if st.Counts[StatusCanceled] != 1 || st.Counts[StatusComplete] != 2 || !st.Done {
+		t.Errorf("wrong array status after cancel: %+v", st)
+	}
+
+	if _, err := s.Array(JobId{1}); err == nil {
+		t.Errorf("unknown arrays should be reported")
+	}
+	if _, err := s.StartArray(NewJobArray(NewJobCmd("echo", "{{.n"), params)); err == nil {
+		t.Errorf("invalid templates should be reported")
+	}
+}
+
+func TestJobWait(t *testing.T) {
+	db, _ := NewDB("", dblimit)
+	s := NewServer(testaddr, testaddr, db, nil, nil)
+	nolog(s)
+	go s.dispatcher()
+	defer s.Close()
+
+	j := NewJobCmd("echo", "1")
+	s.Start(j, nil)
+	if got, err := s.Wait(j.Id, 10*time.Millisecond); err != nil {
+		t.Fatal(err)
+	} else if got.Status != StatusQueued {
+		t.Errorf("wait timed out with wrong status: got %v, want %v", got.Status, StatusQueued)
+	}
+
+	done := make(chan *Job)
+	jid := j.Id
+	go func() {
+		got, err := s.Wait(jid, 10*time.Second)
+		if err != nil {
+			t.Error(err)
+		}
+		done <- got
+	}()
+
+	wid := WorkerId{1}
+	j = fetch(s, wid)
+	j.WorkerId = wid
+	j.Status = StatusComplete
+	s.pushjobs <- j
+	select {
+	case got := <-done:
+		if got == nil || got.Status != StatusComplete {
+			t.Errorf("waiter got wrong job: %+v", got)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("waiter not woken when job finished")
+	}
+
+	// jobs finished before waiting (e.g. before a server restart) return
+	// immediately
+	if got, err := s.Wait(j.Id, 10*time.Second); err != nil || got.Status != StatusComplete {
+		t.Errorf("wait for finished job: got %+v (err=%v)", got, err)
+	}
+	if _, err := s.Wait(JobId{1}, 0); err == nil {
+		t.Errorf("unknown jobs should be reported")
+	}
+}
+
+func TestListeners(t *testing.T) {
+	db, _ := NewDB("", dblimit)
+	s := NewServer(testaddr, testaddr, db, nil, nil)
+	nolog(s)
+	go s.dispatcher()
+	defer s.Close()
+
+	// a second server in the same process must not clash with the first
+	db2, _ := NewDB("", dblimit)
+	s2 := NewServer(testaddr, testaddr, db2, nil, nil)
+	nolog(s2)
+	go s2.dispatcher()
+	defer s2.Close()
+
+	sub := httptest.NewServer(s.handler(ServiceSubmit, ServiceDashboard))
+	defer sub.Close()
+	work := httptest.NewServer(s.handler(ServiceWorker))
+	defer work.Close()
+	other := httptest.NewServer(s2.handler(ServiceSubmit, ServiceWorker))
+	defer other.Close()
+
+	tests := []struct {
+		url  string
+		want int
+	}{
+		{sub.URL + "/api/v1/jobs", http.StatusOK},
+		{work.URL + "/api/v1/jobs", http.StatusNotFound},
+		{sub.URL + "/api/v1/tokens", http.StatusNotFound},
+		{sub.URL + "/dashboard", http.StatusOK},
+		{work.URL + "/dashboard", http.StatusNotFound},
+		{work.URL + "/api/v1/job-outfiles/" + JobId{1}.String(), http.StatusMethodNotAllowed},
+	}
+	for _, test := range tests {
+		resp, err := http.Get(test.url)
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+		if resp.StatusCode != test.want {
+			t.Errorf("GET %v: got status %v, want %v", test.url, resp.StatusCode, test.want)
+		}
+	}
+
+	// the dashboard pages' forms work on a dashboard-only listener
+	dash := httptest.NewServer(s.handler(ServiceDashboard))
+	defer dash.Close()
+	posts := []struct {
+		url  string
+		want int
+	}{
+		{dash.URL + "/api/v1/job-infile", http.StatusCreated},
+		{dash.URL + "/api/v1/reset-queue", http.StatusOK},
+		{work.URL + "/api/v1/job-infile", http.StatusNotFound},
+	}
+	for _, test := range posts {
+		resp, err := http.Post(test.url, "text/plain", strings.NewReader("<simulation/>"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+		if resp.StatusCode != test.want {
+			t.Errorf("POST %v: got status %v, want %v", test.url, resp.StatusCode, test.want)
+		}
+	}
+
+	wc, err := Dial(strings.TrimPrefix(work.URL, "http://"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer wc.Close()
+	if err := wc.Submit(NewJobCmd("echo", "1")); err == nil {
+		t.Errorf("worker listener accepted a job submission")
+	}
+
+	sc, err := Dial(strings.TrimPrefix(sub.URL, "http://"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer sc.Close()
+	j := NewJobCmd("echo", "1")
+	if err := sc.Submit(j); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := sc.Fetch(&Worker{Id: WorkerId{1}}); err == nil {
+		t.Errorf("submit listener handed out work")
+	}
+
+	if got, err := wc.Fetch(&Worker{Id: WorkerId{1}}); err != nil {
+		t.Fatal(err)
+	} else if got.Id != j.Id {
+		t.Errorf("worker fetched job %v, want %v", got.Id, j.Id)
+	}
+
+	oc, err := Dial(strings.TrimPrefix(other.URL, "http://"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer oc.Close()
+	if _, err := oc.Retrieve(j.Id); err == nil {
+		t.Errorf("job submitted to one server found on another")
+	}
+}
+
+func TestOutfileUpload(t *testing.T) {
+	db, _ := NewDB("", dblimit)
+	s := NewServer(testaddr, testaddr, db, nil, nil)
+	nolog(s)
+	go s.dispatcher()
+	defer s.Close()
+
+	ts := httptest.NewServer(s.handler(ServiceSubmit, ServiceWorker))
+	defer ts.Close()
+	c, err := Dial(strings.TrimPrefix(ts.URL, "http://"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+
+	w1, w2 := WorkerId{1}, WorkerId{2}
+	j := NewJobCmd("echo", "1")
+	if err := c.Submit(j); err != nil {
+		t.Fatal(err)
+	}
+	defer os.Remove(outfileName(j))
+	if err := c.PushOutfile(w1, j.Id, strings.NewReader("early")); err == nil {
+		t.Errorf("output of a queued job accepted")
+	}
+
+	if fetched := fetch(s, w1); fetched == nil {
+		t.Fatal("no job fetched")
+	}
+	if err := c.PushOutfile(w2, j.Id, strings.NewReader("foreign")); err == nil {
+		t.Errorf("output accepted from a worker not running the job")
+	}
+	if err := c.PushOutfile(w1, j.Id, strings.NewReader("real")); err != nil {
+		t.Errorf("output of the job's worker rejected: %v", err)
+	}
+
+	j.Status = StatusComplete
+	j.WorkerId = w1
+	s.pushjobs <- j
+	if err := c.PushOutfile(w1, j.Id, strings.NewReader("late")); err == nil {
+		t.Errorf("output of a completed job was overwritten")
+	}
+
+	r, err := c.RetrieveOutfile(j.Id)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer r.Close()
+	if data, _ := ioutil.ReadAll(r); string(data) != "real" {
+		t.Errorf("wrong job output: got %q, want 'real'", data)
+	}
+}
+
+func TestEvents(t *testing.T) {
+	db, _ := NewDB("", dblimit)
+	s := NewServer(testaddr, testaddr, db, nil, nil)
+	nolog(s)
+	go s.dispatcher()
+	defer s.Close()
+
+	ts := httptest.NewServer(s.handler(ServiceSubmit))
+	defer ts.Close()
+
+	parent := NewJobCmd("echo", "1")
+	parent.MaxRetries = 1
+	child := NewJobCmd("echo", "2")
+	child.After(parent)
+	s.Start(parent, nil)
+	s.Start(child, nil)
+
+	wid := WorkerId{1}
+	for _, status := range []string{StatusFailed, StatusComplete} {
+		j := fetch(s, wid)
+		j.WorkerId = wid
+		j.Status = status
+		if status == StatusFailed {
+			j.FailReason = FailNonzeroExit
+		}
+		s.pushjobs <- j
+		s.Get(j.Id)
+	}
+
+	req, _ := http.NewRequest("DELETE", ts.URL+"/api/v1/job/"+child.Id.String(), nil)
+	if resp, err := http.DefaultClient.Do(req); err != nil {
+		t.Fatal(err)
+	} else {
+		resp.Body.Close()
+	}
+
+	getEvents := func(path string) []*Event {
+		resp, err := http.Get(ts.URL + path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer resp.Body.Close()
+		var events []*Event
+		if err := json.NewDecoder(resp.Body).Decode(&events); err != nil {
+			t.Fatalf("GET %v: %v", path, err)
+		}
+		return events
+	}
+
+	type event struct{ typ, old, new, actor string }
+	tests := []struct {
+		id   JobId
+		want []event
+	}{
+		{parent.Id, []event{
+			{EventSubmit, "", StatusQueued, ""},
+			{EventFetch, StatusQueued, StatusRunning, ActorWorker},
+			{EventPush, StatusRunning, StatusQueued, ActorWorker},
+			{EventFetch, StatusQueued, StatusRunning, ActorWorker},
+			{EventPush, StatusRunning, StatusComplete, ActorWorker},
+		}},
+		{child.Id, []event{
+			{EventSubmit, "", StatusWaiting, ""},
+			{EventDependency, StatusWaiting, StatusQueued, ActorServer},
+			{EventCancel, StatusQueued, StatusCanceled, "127.0.0.1"},
+		}},
+	}
+	for _, test := range tests {
+		got := getEvents("/api/v1/job/" + test.id.String() + "/events")
+		if len(got) != len(test.want) {
+			t.Errorf("job %v: got %v events, want %v", test.id, len(got), len(test.want))
+			continue
+		}
+		for i, want := range test.want {
+			e := got[i]
+			if e.Type != want.typ || e.OldStatus != want.old || e.NewStatus != want.new || e.Actor != want.actor {
+				t.Errorf("job %v event %v: got %+v, want %+v", test.id, i, e, want)
+			}
+		}
+	}
+
+	retried := getEvents("/api/v1/job/" + parent.Id.String() + "/events")[2]
+	if retried.WorkerId != wid || !strings.Contains(retried.Msg, "attempt 1 failed: "+FailNonzeroExit) {
+		t.Errorf("retry event missing worker or reason: %+v", retried)
+	}
+
+	// global feed ordered by sequence number
+	all := getEvents("/api/v1/events")
+	if len(all) != 8 {
+		t.Fatalf("got %v events in global feed, want 8", len(all))
+	}
+	for i, e := range all {
+		if e.Seq != uint64(i+1) {
+			t.Errorf("global event %v has Seq %v", i, e.Seq)
+		}
+	}
+	if got := getEvents("/api/v1/events?since=6&limit=1"); len(got) != 1 || got[0].Seq != 7 {
+		t.Errorf("wrong events since 6 with limit 1: %+v", got)
+	}
+	if resp, err := http.Get(ts.URL + "/api/v1/events?since=yesterday"); err != nil {
+		t.Fatal(err)
+	} else if resp.Body.Close(); resp.StatusCode != http.StatusBadRequest {
+		t.Errorf("invalid since: got status %v, want %v", resp.StatusCode, http.StatusBadRequest)
+	}
 }
@@ -0,0 +1,585 @@
+package cloudlus
+
+import (
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+)
+
+// hasDriver returns true if a database/sql driver with the given name is
+// registered.
+func hasDriver(name string) bool {
+	for _, d := range sql.Drivers() {
+		if d == name {
+			return true
+		}
+	}
+	return false
+}
+
+const sqliteSchema = `
+CREATE TABLE IF NOT EXISTS jobs (
+	id TEXT PRIMARY KEY,
+	status TEXT,
+	owner TEXT,
+	submitted INTEGER,
+	finished INTEGER,
+	done INTEGER,
+	note TEXT,
+	cmd TEXT,
+	data BLOB
+);
+CREATE INDEX IF NOT EXISTS jobs_done ON jobs (done, finished);
+CREATE INDEX IF NOT EXISTS jobs_submitted ON jobs (submitted);
+CREATE INDEX IF NOT EXISTS jobs_status ON jobs (status, submitted);
+CREATE INDEX IF NOT EXISTS jobs_owner ON jobs (owner, submitted);
+CREATE TABLE IF NOT EXISTS workers (worker TEXT, id TEXT, PRIMARY KEY (worker, id));
+CREATE TABLE IF NOT EXISTS arrays (array_id TEXT, id TEXT, PRIMARY KEY (array_id, id));
+CREATE TABLE IF NOT EXISTS deps (parent TEXT, child TEXT, PRIMARY KEY (parent, child));
+CREATE TABLE IF NOT EXISTS infiles (id TEXT, hash TEXT);
+CREATE INDEX IF NOT EXISTS infiles_id ON infiles (id);
+CREATE TABLE IF NOT EXISTS memo (hash BLOB PRIMARY KEY, id TEXT);
+CREATE TABLE IF NOT EXISTS blobs (hash TEXT PRIMARY KEY, stored INTEGER, data BLOB);
+CREATE TABLE IF NOT EXISTS tokens (id TEXT PRIMARY KEY, data BLOB);
+CREATE TABLE IF NOT EXISTS events (seq INTEGER PRIMARY KEY AUTOINCREMENT, job TEXT, data BLOB);
+CREATE INDEX IF NOT EXISTS events_job ON events (job, seq);
+`
+
+// SQLiteDB is a JobStore keeping jobs and blobs in an SQLite database.  The
+// sqlite3 database/sql driver must be registered by importing
+// github.com/rwcarlsen/go-sqlite/sqlite3 before creating one.
+type SQLiteDB struct {
+	db *sql.DB
+	// Limit is the cumulative maximum number of bytes that all jobs and blobs
+	// in the database can occupy without garbage collection (GC) purging jobs
+	// from the database.
+	Limit int64
+	// PurgeAge is the minimum age at which finished jobs become elegible for
+	// removal from the database during GC.
+	PurgeAge time.Duration
+}
+
+// NewSQLiteDB opens (creating if necessary) the SQLite job database at path.
+// If path is empty, an in-memory database is used.  A database/sql driver
+// named "sqlite3" must be registered - e.g. by importing the vendored
+// go-sqlite driver as cloudlus does when built with the sqlite tag.
+func NewSQLiteDB(path string, dblimit int) (*SQLiteDB, error) {
+	if !hasDriver("sqlite3") {
+		return nil, errors.New("no sqlite3 database driver registered - build cloudlus with -tags sqlite")
+	}
+	if path == "" {
+		path = ":memory:"
+	}
+	db, err := sql.Open("sqlite3", path)
+	if err != nil {
+		return nil, err
+	}
+	// sqlite doesn't handle concurrent writers and each connection to an
+	// in-memory database is a separate database.
+	db.SetMaxOpenConns(1)
+
+	for _, stmt := range strings.Split(sqliteSchema, ";") {
+		if strings.TrimSpace(stmt) == "" {
+			continue
+		}
+		if _, err := db.Exec(stmt); err != nil {
+			db.Close()
+			return nil, err
+		}
+	}
+	return &SQLiteDB{db: db, Limit: int64(dblimit), PurgeAge: 30 * time.Minute}, nil
+}
+
+func (d *SQLiteDB) Put(j *Job) error {
+	data, err := json.Marshal(j)
+	if err != nil {
+		return err
+	}
+
+	var finished int64
+	if j.Done() {
+		finished = j.Finished.UnixNano()
+	}
+
+	tx, err := d.db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	id := j.Id.String()
+	_, err = tx.Exec("INSERT OR REPLACE INTO jobs VALUES (?,?,?,?,?,?,?,?,?);",
+		id, j.Status, j.Owner, j.Submitted.UnixNano(), finished, j.Done(),
+		j.Note, strings.Join(j.Cmd, " "), data)
+	if err != nil {
+		return err
+	}
+
+	for _, a := range append(j.Attempts, Attempt{WorkerId: j.WorkerId}) {
+		if a.WorkerId == (WorkerId{}) {
+			continue
+		}
+		_, err = tx.Exec("INSERT OR IGNORE INTO workers VALUES (?,?);", a.WorkerId.String(), id)
+		if err != nil {
+			return err
+		}
+	}
+
+	if j.ArrayId != (JobId{}) {
+		_, err = tx.Exec("INSERT OR IGNORE INTO arrays VALUES (?,?);", j.ArrayId.String(), id)
+		if err != nil {
+			return err
+		}
+	}
+
+	for _, dep := range j.DependsOn {
+		_, err = tx.Exec("INSERT OR IGNORE INTO deps VALUES (?,?);", dep.String(), id)
+		if err != nil {
+			return err
+		}
+	}
+
+	if _, err = tx.Exec("DELETE FROM infiles WHERE id = ?;", id); err != nil {
+		return err
+	}
+	for _, f := range j.Infiles {
+		if f.Hash == "" {
+			continue
+		}
+		if _, err = tx.Exec("INSERT INTO infiles VALUES (?,?);", id, f.Hash); err != nil {
+			return err
+		}
+	}
+
+	if j.Status == StatusComplete && !j.NoCache {
+		_, err = tx.Exec("INSERT OR REPLACE INTO memo VALUES (?,?);", j.memoHash(), id)
+		if err != nil {
+			return err
+		}
+	}
+
+	return tx.Commit()
+}
+
+func (d *SQLiteDB) Get(id JobId) (*Job, error) {
+	var data []byte
+	err := d.db.QueryRow("SELECT data FROM jobs WHERE id = ?;", id.String()).Scan(&data)
+	if err == sql.ErrNoRows {
+		return nil, fmt.Errorf("unknown job id %v", id)
+	} else if err != nil {
+		return nil, err
+	}
+
+	j := &Job{}
+	if err := json.Unmarshal(data, &j); err != nil {
+		return nil, err
+	}
+	return j, nil
+}
+
+// jobs returns the jobs whose json data is selected by the given query.
+func (d *SQLiteDB) jobs(query string, args ...interface{}) ([]*Job, error) {
+	rows, err := d.db.Query(query, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	jobs := []*Job{}
+	for rows.Next() {
+		var data []byte
+		if err := rows.Scan(&data); err != nil {
+			return nil, err
+		}
+		j := &Job{}
+		if err := json.Unmarshal(data, &j); err != nil {
+			return nil, err
+		}
+		jobs = append(jobs, j)
+	}
+	return jobs, rows.Err()
+}
+
+// ids returns the job ids selected by the given query.
+func (d *SQLiteDB) ids(query string, args ...interface{}) ([]JobId, error) {
+	rows, err := d.db.Query(query, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	ids := []JobId{}
+	for rows.Next() {
+		var s string
+		if err := rows.Scan(&s); err != nil {
+			return nil, err
+		}
+		id, err := parseJobId(s)
+		if err != nil {
+			return nil, err
+		}
+		ids = append(ids, id)
+	}
+	return ids, rows.Err()
+}
+
+// Current returns the all jobs from the database that aren't completed - e.g.
+// queued or running.
+func (d *SQLiteDB) Current() ([]*Job, error) {
+	return d.jobs("SELECT data FROM jobs WHERE done = 0;")
+}
+
+// Recent returns up to n of the most recently completed jobs (including
+// failed ones).
+func (d *SQLiteDB) Recent(n int) ([]*Job, error) {
+	jobs, err := d.jobs("SELECT data FROM jobs WHERE done = 1 ORDER BY finished DESC LIMIT ?;", n)
+	if err != nil {
+		return nil, err
+	}
+	// oldest first - like DB.Recent
+	for i, k := 0, len(jobs)-1; i < k; i, k = i+1, k-1 {
+		jobs[i], jobs[k] = jobs[k], jobs[i]
+	}
+	return jobs, nil
+}
+
+// Query returns a page of jobs in the database matching q and the cursor
+// for the next page.  All filters except the failure reason are evaluated by
+// sqlite, which also orders the jobs and limits them to the page following
+// the cursor.
+func (d *SQLiteDB) Query(q Query) ([]*Job, string, error) {
+	if err := q.Validate(); err != nil {
+		return nil, "", err
+	}
+
+	where := []string{"1"}
+	args := []interface{}{}
+	filter := func(cond string, arg interface{}) {
+		where = append(where, cond)
+		args = append(args, arg)
+	}
+
+	if q.Status != "" {
+		filter("status = ?", q.Status)
+	}
+	if q.Owner != "" {
+		filter("owner = ?", q.Owner)
+	}
+	if q.Worker != (WorkerId{}) {
+		filter("id IN (SELECT id FROM workers WHERE worker = ?)", q.Worker.String())
+	}
+	if q.Array != (JobId{}) {
+		filter("id IN (SELECT id FROM arrays WHERE array_id = ?)", q.Array.String())
+	}
+	if !q.SubmittedAfter.IsZero() {
+		filter("submitted > ?", q.SubmittedAfter.UnixNano())
+	}
+	if !q.SubmittedBefore.IsZero() {
+		filter("submitted < ?", q.SubmittedBefore.UnixNano())
+	}
+	if q.SortBy == SortFinished {
+		where = append(where, "done = 1")
+	}
+	if !q.FinishedAfter.IsZero() {
+		filter("done = 1 AND finished > ?", q.FinishedAfter.UnixNano())
+	}
+	if !q.FinishedBefore.IsZero() {
+		filter("done = 1 AND finished < ?", q.FinishedBefore.UnixNano())
+	}
+	if q.Note != "" {
+		filter("instr(note, ?) > 0", q.Note)
+	}
+	if q.Cmd != "" {
+		filter("instr(cmd, ?) > 0", q.Cmd)
+	}
+
+	col, order, cmp := "submitted", "DESC", "<"
+	if q.SortBy == SortFinished {
+		col = "finished"
+	}
+	if q.Ascending {
+		order, cmp = "ASC", ">"
+	}
+	if q.Cursor != "" {
+		after, afterid, _ := parseCursor(q.Cursor)
+		where = append(where, fmt.Sprintf("(%[1]v %[2]v ? OR (%[1]v = ? AND id %[2]v ?))", col, cmp))
+		args = append(args, after.UnixNano(), after.UnixNano(), afterid.String())
+	}
+
+	query := fmt.Sprintf("SELECT data FROM jobs WHERE %v ORDER BY %v %v, id %v", strings.Join(where, " AND "), col, order, order)
+	if q.Limit > 0 && q.FailReason == "" {
+		// one more job than fits on the page tells whether there are more
+		query += " LIMIT ?"
+		args = append(args, q.Limit+1)
+	}
+
+	rows, err := d.db.Query(query+";", args...)
+	if err != nil {
+		return nil, "", err
+	}
+	defer rows.Close()
+
+	// jobs are filtered by failure reason here - stop once the page is full
+	jobs := []*Job{}
+	for (q.Limit == 0 || len(jobs) <= q.Limit) && rows.Next() {
+		var data []byte
+		if err := rows.Scan(&data); err != nil {
+			return nil, "", err
+		}
+		j := &Job{}
+		if err := json.Unmarshal(data, &j); err != nil {
+			return nil, "", err
+		} else if q.Match(j) {
+			jobs = append(jobs, j)
+		}
+	}
+	if err := rows.Err(); err != nil {
+		return nil, "", err
+	}
+	page, next := q.apply(jobs)
+	return page, next, nil
+}
+
+// Dependents returns the ids of all jobs in the database that depend on the
+// job with the given id.
+func (d *SQLiteDB) Dependents(id JobId) ([]JobId, error) {
+	return d.ids("SELECT child FROM deps WHERE parent = ?;", id.String())
+}
+
+// Memoized returns the id of the most recently completed job with the same
+// memo hash as j.
+func (d *SQLiteDB) Memoized(j *Job) (JobId, error) {
+	var s string
+	err := d.db.QueryRow("SELECT id FROM memo WHERE hash = ?;", j.memoHash()).Scan(&s)
+	if err != nil {
+		return JobId{}, err
+	}
+	return parseJobId(s)
+}
+
+// PutBlob stores data in the database's content-addressed blob store and
+// returns its hash.
+func (d *SQLiteDB) PutBlob(data []byte) (hash string, err error) {
+	hash = blobHash(data)
+	_, err = d.db.Exec("INSERT OR REPLACE INTO blobs VALUES (?,?,?);", hash, time.Now().Unix(), data)
+	return hash, err
+}
+
+// GetBlob returns the contents of the blob with the given hash.
+func (d *SQLiteDB) GetBlob(hash string) ([]byte, error) {
+	var data []byte
+	err := d.db.QueryRow("SELECT data FROM blobs WHERE hash = ?;", hash).Scan(&data)
+	if err == sql.ErrNoRows {
+		return nil, fmt.Errorf("unknown blob %v", hash)
+	} else if err != nil {
+		return nil, err
+	}
+	if data == nil {
+		data = []byte{}
+	}
+	return data, nil
+}
+
+// HasBlob returns true if the blob with the given hash is stored in the
+// database.  Blobs are kept for at least PurgeAge after being stored or
+// checked for - giving clients time to submit jobs referring to them.
+func (d *SQLiteDB) HasBlob(hash string) (bool, error) {
+	var stored int64
+	err := d.db.QueryRow("SELECT stored FROM blobs WHERE hash = ?;", hash).Scan(&stored)
+	if err == sql.ErrNoRows {
+		return false, nil
+	} else if err != nil {
+		return false, err
+	}
+
+	now := time.Now()
+	if now.Sub(time.Unix(stored, 0)) > d.PurgeAge/2 {
+		_, err = d.db.Exec("UPDATE blobs SET stored = ? WHERE hash = ?;", now.Unix(), hash)
+	}
+	return true, err
+}
+
+// PutToken stores (or replaces) the API token t.
+func (d *SQLiteDB) PutToken(t *Token) error {
+	data, err := json.Marshal(t)
+	if err != nil {
+		return err
+	}
+	_, err = d.db.Exec("INSERT OR REPLACE INTO tokens VALUES (?,?);", t.Id, data)
+	return err
+}
+
+// GetToken returns the API token with the given id.
+func (d *SQLiteDB) GetToken(id string) (*Token, error) {
+	var data []byte
+	err := d.db.QueryRow("SELECT data FROM tokens WHERE id = ?;", id).Scan(&data)
+	if err == sql.ErrNoRows {
+		return nil, fmt.Errorf("unknown token %v", id)
+	} else if err != nil {
+		return nil, err
+	}
+	t := &Token{}
+	return t, json.Unmarshal(data, t)
+}
+
+// DeleteToken removes the API token with the given id.
+func (d *SQLiteDB) DeleteToken(id string) error {
+	_, err := d.db.Exec("DELETE FROM tokens WHERE id = ?;", id)
+	return err
+}
+
+// Tokens returns all stored API tokens ordered by id.
+func (d *SQLiteDB) Tokens() ([]*Token, error) {
+	rows, err := d.db.Query("SELECT data FROM tokens ORDER BY id;")
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	tokens := []*Token{}
+	for rows.Next() {
+		var data []byte
+		if err := rows.Scan(&data); err != nil {
+			return nil, err
+		}
+		t := &Token{}
+		if err := json.Unmarshal(data, t); err != nil {
+			return nil, err
+		}
+		tokens = append(tokens, t)
+	}
+	return tokens, rows.Err()
+}
+
+// AppendEvent adds e to the end of the event log and sets its Seq.
+func (d *SQLiteDB) AppendEvent(e *Event) error {
+	// the seq column assigned by sqlite overrides the json Seq when read
+	data, err := json.Marshal(e)
+	if err != nil {
+		return err
+	}
+	res, err := d.db.Exec("INSERT INTO events (job, data) VALUES (?,?);", e.JobId.String(), data)
+	if err != nil {
+		return err
+	}
+	seq, err := res.LastInsertId()
+	e.Seq = uint64(seq)
+	return err
+}
+
+// Events returns up to limit events with a Seq greater than since - oldest
+// first.  If limit is zero, all of them are returned.
+func (d *SQLiteDB) Events(since uint64, limit int) ([]*Event, error) {
+	if limit == 0 {
+		limit = -1
+	}
+	return d.events("SELECT seq, data FROM events WHERE seq > ? ORDER BY seq LIMIT ?;", int64(since), limit)
+}
+
+// JobEvents returns all events of the job with the given id - oldest first.
+func (d *SQLiteDB) JobEvents(id JobId) ([]*Event, error) {
+	return d.events("SELECT seq, data FROM events WHERE job = ? ORDER BY seq;", id.String())
+}
+
+// events returns the events whose seq and json data are selected by the
+// given query.
+func (d *SQLiteDB) events(query string, args ...interface{}) ([]*Event, error) {
+	rows, err := d.db.Query(query, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	events := []*Event{}
+	for rows.Next() {
+		var seq int64
+		var data []byte
+		if err := rows.Scan(&seq, &data); err != nil {
+			return nil, err
+		}
+		e := &Event{}
+		if err := json.Unmarshal(data, e); err != nil {
+			return nil, err
+		}
+		e.Seq = uint64(seq)
+		events = append(events, e)
+	}
+	return events, rows.Err()
+}
+
+// GC runs garbage collection if the database is larger than the specified
+// Limit.  Finished jobs older than PurgeAge are removed along with their
+// events and blobs no longer referenced by any job.  The ids of removed jobs
+// and the number of jobs still in the database is returned.  nremain is -1 if
+// GC didn't occur.
+func (d *SQLiteDB) GC() (purged []JobId, nremain int, err error) {
+	size, err := d.Size()
+	if err != nil {
+		return nil, -1, err
+	} else if size < d.Limit {
+		return nil, -1, nil
+	}
+
+	now := time.Now()
+	purged, err = d.ids("SELECT id FROM jobs WHERE done = 1 AND finished < ?;", now.Add(-d.PurgeAge).UnixNano())
+	if err != nil {
+		return nil, -1, err
+	}
+
+	tx, err := d.db.Begin()
+	if err != nil {
+		return nil, -1, err
+	}
+	defer tx.Rollback()
+
+	for _, id := range purged {
+		for _, stmt := range []string{
+			"DELETE FROM jobs WHERE id = ?;",
+			"DELETE FROM deps WHERE child = ?;",
+			"DELETE FROM infiles WHERE id = ?;",
+			"DELETE FROM workers WHERE id = ?;",
+			"DELETE FROM arrays WHERE id = ?;",
+			"DELETE FROM memo WHERE id = ?;",
+			"DELETE FROM events WHERE job = ?;",
+		} {
+			if _, err := tx.Exec(stmt, id.String()); err != nil {
+				return nil, -1, err
+			}
+		}
+	}
+
+	_, err = tx.Exec("DELETE FROM blobs WHERE stored < ? AND hash NOT IN (SELECT hash FROM infiles);",
+		now.Add(-d.PurgeAge).Unix())
+	if err != nil {
+		return nil, -1, err
+	}
+	if err := tx.Commit(); err != nil {
+		return nil, -1, err
+	}
+
+	nremain, err = d.Count()
+	return purged, nremain, err
+}
+
+// Size returns the cumulative size of all jobs and events (in json form)
+// and blobs in the database.
+func (d *SQLiteDB) Size() (int64, error) {
+	var size int64
+	err := d.db.QueryRow(`SELECT
+		(SELECT COALESCE(SUM(LENGTH(data)), 0) FROM jobs) +
+		(SELECT COALESCE(SUM(LENGTH(data)), 0) FROM events) +
+		(SELECT COALESCE(SUM(LENGTH(data)), 0) FROM blobs);`).Scan(&size)
+	return size, err
+}
+
+// Count returns the number of jobs in the database.
+func (d *SQLiteDB) Count() (int, error) {
+	var n int
+	err := d.db.QueryRow("SELECT COUNT(*) FROM jobs;").Scan(&n)
+	return n, err
+}
+
+func (d *SQLiteDB) Close() error { return d.db.Close() }
@@ -0,0 +1,104 @@
+//go:build sqlite
+// +build sqlite
+
+package cloudlus
+
+import (
+	"testing"
+	"time"
+
+	_ "github.com/rwcarlsen/cloudlus/Godeps/_workspace/src/github.com/rwcarlsen/go-sqlite/sqlite3"
+)
+
+func TestSQLiteDB(t *testing.T) {
+	db, err := NewSQLiteDB("", 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	db.PurgeAge = -1 * time.Second
+
+	used, _ := db.PutBlob([]byte("used"))
+	unused, _ := db.PutBlob([]byte("unused"))
+
+	parent := NewJobCmd("echo", "1")
+	parent.Owner = "bob"
+	parent.Status = StatusComplete
+	parent.Finished = time.Now()
+	child := NewJobCmd("cat", "in.txt")
+	child.Infiles = []File{{Name: "in.txt", Size: 4, Hash: used}}
+	child.DependsOn = []JobId{parent.Id}
+	child.Status = StatusQueued
+	for _, j := range []*Job{parent, child} {
+		if err := db.Put(j); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if j, err := db.Get(child.Id); err != nil || j.Infiles[0].Hash != used {
+		t.Errorf("job not retrieved correctly (err=%v)", err)
+	}
+	if jobs, _ := db.Current(); len(jobs) != 1 || jobs[0].Id != child.Id {
+		t.Errorf("wrong current jobs: got %v, want [%v]", jobs, child.Id)
+	}
+	if jobs, _ := db.Recent(5); len(jobs) != 1 || jobs[0].Id != parent.Id {
+		t.Errorf("wrong recent jobs: got %v, want [%v]", jobs, parent.Id)
+	}
+	if jobs, _, _ := db.Query(Query{Owner: "bob"}); len(jobs) != 1 || jobs[0].Id != parent.Id {
+		t.Errorf("wrong query results: got %v, want [%v]", jobs, parent.Id)
+	}
+	if ids, _ := db.Dependents(parent.Id); len(ids) != 1 || ids[0] != child.Id {
+		t.Errorf("wrong dependents: got %v, want [%v]", ids, child.Id)
+	}
+	if id, err := db.Memoized(NewJobCmd("echo", "1")); err != nil || id != parent.Id {
+		t.Errorf("wrong memoized job: got %v (err=%v), want %v", id, err, parent.Id)
+	}
+	if data, err := db.GetBlob(used); err != nil || string(data) != "used" {
+		t.Errorf("wrong blob data: got '%s' (err=%v), want 'used'", data, err)
+	}
+
+	purged, nremain, err := db.GC()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(purged) != 1 || purged[0] != parent.Id || nremain != 1 {
+		t.Errorf("GC purged %v with %v remaining, want [%v] with 1 remaining", purged, nremain, parent.Id)
+	}
+	if _, err := db.Memoized(parent); err == nil {
+		t.Errorf("memo index entry for purged job not removed")
+	}
+	if ok, _ := db.HasBlob(used); !ok {
+		t.Errorf("GC removed blob referenced by a queued job")
+	}
+	if ok, _ := db.HasBlob(unused); ok {
+		t.Errorf("GC didn't remove unreferenced blob")
+	}
+}
+
+func TestSQLiteDB_Query(t *testing.T) {
+	db, err := NewSQLiteDB("", 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	testQuery(t, db)
+}
+
+func TestSQLiteDB_Tokens(t *testing.T) {
+	db, err := NewSQLiteDB("", 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	testTokens(t, db)
+}
+
+func TestSQLiteDB_Events(t *testing.T) {
+	db, err := NewSQLiteDB("", 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	db.PurgeAge = -1 * time.Second
+	testEvents(t, db)
+}
@@ -0,0 +1,468 @@
+package cloudlus
+
+import (
+	"archive/zip"
+	"bytes"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/url"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// JobStore persists a server's jobs along with the content-addressed blobs
+// holding their input files.  Implementations must be safe for concurrent
+// use.
+type JobStore interface {
+	Put(j *Job) error
+	Get(id JobId) (*Job, error)
+	// Current returns all jobs that haven't finished - e.g. waiting, queued
+	// or running.
+	Current() ([]*Job, error)
+	// Recent returns up to n of the most recently finished jobs (including
+	// failed and canceled ones).
+	Recent(n int) ([]*Job, error)
+	// Query returns a page of jobs matching q and the cursor for the next
+	// page.
+	Query(q Query) (jobs []*Job, next string, err error)
+	// Dependents returns the ids of all jobs that depend on the job with the
+	// given id.
+	Dependents(id JobId) ([]JobId, error)
+	// Memoized returns the id of the most recently completed job with the
+	// same memo hash as j.
+	Memoized(j *Job) (JobId, error)
+
+	PutBlob(data []byte) (hash string, err error)
+	GetBlob(hash string) ([]byte, error)
+	HasBlob(hash string) (bool, error)
+
+	// PutToken stores (or replaces) the API token t.  GetToken returns the
+	// token with the given id and DeleteToken removes it.  Tokens are never
+	// purged by GC.
+	PutToken(t *Token) error
+	GetToken(id string) (*Token, error)
+	DeleteToken(id string) error
+	// Tokens returns all stored API tokens.
+	Tokens() ([]*Token, error)
+
+	// AppendEvent adds e to the end of the event log and sets its Seq.
+	AppendEvent(e *Event) error
+	// Events returns up to limit events with a Seq greater than since -
+	// oldest first.  If limit is zero, all of them are returned.
+	Events(since uint64, limit int) ([]*Event, error)
+	// JobEvents returns all events of the job with the given id - oldest
+	// first.
+	JobEvents(id JobId) ([]*Event, error)
+
+	// GC purges old finished jobs (along with their events) and
+	// unreferenced blobs if the store is over its size limit.  The ids of the
+	// purged jobs and the number of jobs remaining are returned.  nremain is
+	// -1 if GC didn't occur.
+	GC() (purged []JobId, nremain int, err error)
+	// Size returns the cumulative size in bytes of all jobs and blobs in the
+	// store.
+	Size() (int64, error)
+	// Count returns the number of jobs in the store.
+	Count() (int, error)
+	Close() error
+}
+
+// Query selects jobs from a JobStore.  Zero valued fields match all jobs.
+type Query struct {
+	Status string
+	Owner  string
+	// FailReason selects jobs that failed for the given reason.
+	FailReason string
+	// Worker selects jobs that were dispatched to the worker with the given
+	// id in any of their attempts.
+	Worker WorkerId
+	// Array selects the child jobs of the job array with the given id.
+	Array JobId
+	// Note and Cmd select jobs whose note or space-separated command contain
+	// the given substring.
+	Note string
+	Cmd  string
+	// SubmittedAfter and SubmittedBefore select jobs submitted within the
+	// given time range.
+	SubmittedAfter  time.Time
+	SubmittedBefore time.Time
+	// FinishedAfter and FinishedBefore select finished jobs that finished
+	// within the given time range.
+	FinishedAfter  time.Time
+	FinishedBefore time.Time
+	// SortBy is the job time matching jobs are ordered by - either
+	// SortSubmitted (the default) or SortFinished.  Sorting by finish time
+	// only selects finished jobs.
+	SortBy string
+	// Ascending orders jobs from oldest to newest instead of newest first.
+	Ascending bool
+	// Limit is the maximum number of jobs returned - zero means no limit.
+	Limit int
+	// Cursor continues a previous query with identical filters from the end
+	// of the page it returned.
+	Cursor string
+}
+
+const (
+	SortSubmitted = "submitted"
+	SortFinished  = "finished"
+)
+
+// Match returns true if j satisfies all of q's filters.
+func (q Query) Match(j *Job) bool {
+	switch {
+	case q.Status != "" && j.Status != q.Status:
+		return false
+	case q.Owner != "" && j.Owner != q.Owner:
+		return false
+	case q.FailReason != "" && j.FailReason != q.FailReason:
+		return false
+	case q.Worker != (WorkerId{}) && !ranOn(j, q.Worker):
+		return false
+	case q.Array != (JobId{}) && j.ArrayId != q.Array:
+		return false
+	case q.Note != "" && !strings.Contains(j.Note, q.Note):
+		return false
+	case q.Cmd != "" && !strings.Contains(strings.Join(j.Cmd, " "), q.Cmd):
+		return false
+	case !q.SubmittedAfter.IsZero() && !j.Submitted.After(q.SubmittedAfter):
+		return false
+	case !q.SubmittedBefore.IsZero() && !j.Submitted.Before(q.SubmittedBefore):
+		return false
+	case (q.SortBy == SortFinished || !q.FinishedAfter.IsZero() || !q.FinishedBefore.IsZero()) && !j.Done():
+		return false
+	case !q.FinishedAfter.IsZero() && !j.Finished.After(q.FinishedAfter):
+		return false
+	case !q.FinishedBefore.IsZero() && !j.Finished.Before(q.FinishedBefore):
+		return false
+	}
+	return true
+}
+
+// ranOn returns true if j was ever dispatched to worker wid.
+func ranOn(j *Job, wid WorkerId) bool {
+	if j.WorkerId == wid {
+		return true
+	}
+	for _, a := range j.Attempts {
+		if a.WorkerId == wid {
+			return true
+		}
+	}
+	return false
+}
+
+// Validate returns an error if q has an unknown sort order or a malformed
+// cursor.
+func (q Query) Validate() error {
+	if q.SortBy != "" && q.SortBy != SortSubmitted && q.SortBy != SortFinished {
+		return fmt.Errorf("invalid job sort order '%v'", q.SortBy)
+	}
+	if q.Cursor != "" {
+		if _, _, err := parseCursor(q.Cursor); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// sortKey returns the time jobs are ordered by for q.
+func (q Query) sortKey(j *Job) time.Time {
+	if q.SortBy == SortFinished {
+		return j.Finished
+	}
+	return j.Submitted
+}
+
+// less orders jobs by q's sort key with ties broken by job id.
+func (q Query) less(ta time.Time, a JobId, tb time.Time, b JobId) bool {
+	if !ta.Equal(tb) {
+		return ta.Before(tb) == q.Ascending
+	} else if q.Ascending {
+		return bytes.Compare(a[:], b[:]) < 0
+	}
+	return bytes.Compare(a[:], b[:]) > 0
+}
+
+// apply returns the page of jobs matching q along with the cursor for the
+// next page.  The cursor is empty if there are no more matching jobs.
+func (q Query) apply(jobs []*Job) (page []*Job, next string) {
+	after, afterid, _ := parseCursor(q.Cursor)
+
+	matches := []*Job{}
+	for _, j := range jobs {
+		if !q.Match(j) {
+			continue
+		} else if q.Cursor != "" && !q.less(after, afterid, q.sortKey(j), j.Id) {
+			continue
+		}
+		matches = append(matches, j)
+	}
+	sort.Sort(queryOrder{q, matches})
+
+	if q.Limit > 0 && len(matches) > q.Limit {
+		matches = matches[:q.Limit]
+		next = q.cursor(matches[len(matches)-1])
+	}
+	return matches, next
+}
+
+// cursorLen is the length of decoded cursors: the sort key's unix seconds
+// and nanoseconds followed by the job id.
+const cursorLen = 8 + 4 + len(JobId{})
+
+// cursor returns the cursor continuing q after j.  Cursors are URL-safe
+// base64 so that any sort key - including negative and zero times - survives
+// the round trip.
+func (q Query) cursor(j *Job) string {
+	t := q.sortKey(j)
+	buf := make([]byte, cursorLen)
+	binary.BigEndian.PutUint64(buf, uint64(t.Unix()))
+	binary.BigEndian.PutUint32(buf[8:], uint32(t.Nanosecond()))
+	copy(buf[12:], j.Id[:])
+	return base64.RawURLEncoding.EncodeToString(buf)
+}
+
+// parseCursor returns the sort key and job id encoded in cursor (see
+// Query.cursor).
+func parseCursor(cursor string) (time.Time, JobId, error) {
+	if cursor == "" {
+		return time.Time{}, JobId{}, nil
+	}
+
+	buf, err := base64.RawURLEncoding.DecodeString(cursor)
+	if err != nil || len(buf) != cursorLen {
+		return time.Time{}, JobId{}, fmt.Errorf("malformed cursor '%v'", cursor)
+	}
+	sec := int64(binary.BigEndian.Uint64(buf))
+	nsec := int64(binary.BigEndian.Uint32(buf[8:]))
+	var id JobId
+	copy(id[:], buf[12:])
+	return time.Unix(sec, nsec), id, nil
+}
+
+type queryOrder struct {
+	q    Query
+	jobs []*Job
+}
+
+func (o queryOrder) Len() int      { return len(o.jobs) }
+func (o queryOrder) Swap(i, j int) { o.jobs[i], o.jobs[j] = o.jobs[j], o.jobs[i] }
+func (o queryOrder) Less(i, j int) bool {
+	a, b := o.jobs[i], o.jobs[j]
+	return o.q.less(o.q.sortKey(a), a.Id, o.q.sortKey(b), b.Id)
+}
+
+// ParseQuery builds a query from url query parameters (as used by the
+// /api/v1/jobs endpoint).  Times are either RFC3339 or a duration (e.g.
+// "2h") meaning that long ago.
+func ParseQuery(v url.Values) (Query, error) {
+	q := Query{
+		Status:     v.Get("status"),
+		Owner:      v.Get("owner"),
+		FailReason: v.Get("reason"),
+		Note:       v.Get("note"),
+		Cmd:        v.Get("cmd"),
+		SortBy:     v.Get("sort"),
+		Ascending:  v.Get("order") == "asc",
+		Cursor:     v.Get("cursor"),
+	}
+
+	if order := v.Get("order"); order != "" && order != "asc" && order != "desc" {
+		return q, fmt.Errorf("invalid sort order '%v'", order)
+	}
+
+	if s := v.Get("worker"); s != "" {
+		bs, err := hex.DecodeString(s)
+		if err != nil || len(bs) != len(q.Worker) {
+			return q, fmt.Errorf("malformed worker id '%v'", s)
+		}
+		copy(q.Worker[:], bs)
+	}
+
+	if s := v.Get("array"); s != "" {
+		id, err := parseJobId(s)
+		if err != nil {
+			return q, fmt.Errorf("malformed array id '%v'", s)
+		}
+		q.Array = id
+	}
+
+	if s := v.Get("limit"); s != "" {
+		n, err := strconv.Atoi(s)
+		if err != nil || n < 0 {
+			return q, fmt.Errorf("invalid limit '%v'", s)
+		}
+		q.Limit = n
+	}
+
+	times := map[string]*time.Time{
+		"submitted-after":  &q.SubmittedAfter,
+		"submitted-before": &q.SubmittedBefore,
+		"finished-after":   &q.FinishedAfter,
+		"finished-before":  &q.FinishedBefore,
+	}
+	for name, t := range times {
+		s := v.Get(name)
+		if s == "" {
+			continue
+		} else if d, err := time.ParseDuration(s); err == nil {
+			*t = time.Now().Add(-d)
+		} else if *t, err = time.Parse(time.RFC3339, s); err != nil {
+			return q, fmt.Errorf("invalid %v time '%v'", name, s)
+		}
+	}
+
+	return q, q.Validate()
+}
+
+// JobPage holds one page of jobs returned by a query.
+type JobPage struct {
+	Jobs []*JobStat
+	// Next is the cursor for retrieving the next page of jobs.  It is empty
+	// if there are no more jobs.
+	Next string
+}
+
+// BlobStore stores the output data zip archives of jobs by name.
+// Implementations must be safe for concurrent use.
+type BlobStore interface {
+	Create(name string) (io.WriteCloser, error)
+	Open(name string) (io.ReadCloser, error)
+	Remove(name string) error
+}
+
+// FSBlobStore is a BlobStore keeping each blob in a file in the Root
+// directory.
+type FSBlobStore struct {
+	Root string
+}
+
+// NewFSBlobStore returns a blob store rooted at dir - creating it if
+// necessary.
+func NewFSBlobStore(dir string) (*FSBlobStore, error) {
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return nil, err
+	}
+	return &FSBlobStore{Root: dir}, nil
+}
+
+func (s *FSBlobStore) path(name string) (string, error) {
+	if name != filepath.Base(name) || name == "." || name == ".." {
+		return "", fmt.Errorf("invalid blob name '%v'", name)
+	}
+	return filepath.Join(s.Root, name), nil
+}
+
+// Create writes blobs via a temporary file renamed into place on Close so
+// readers never see partially written blobs.
+func (s *FSBlobStore) Create(name string) (io.WriteCloser, error) {
+	path, err := s.path(name)
+	if err != nil {
+		return nil, err
+	}
+	f, err := ioutil.TempFile(s.Root, name+".tmp")
+	if err != nil {
+		return nil, err
+	}
+	return &renameOnClose{File: f, dst: path}, nil
+}
+
+func (s *FSBlobStore) Open(name string) (io.ReadCloser, error) {
+	path, err := s.path(name)
+	if err != nil {
+		return nil, err
+	}
+	return os.Open(path)
+}
+
+func (s *FSBlobStore) Remove(name string) error {
+	path, err := s.path(name)
+	if err != nil {
+		return err
+	}
+	return os.Remove(path)
+}
+
+type renameOnClose struct {
+	*os.File
+	dst string
+}
+
+func (f *renameOnClose) Close() error {
+	err := f.File.Close()
+	if err == nil {
+		err = os.Rename(f.Name(), f.dst)
+	}
+	if err != nil {
+		os.Remove(f.Name())
+	}
+	return err
+}
+
+func outfileName(j *Job) string {
+	return fmt.Sprintf("%s-outdata.zip", j.Id)
+}
+
+// copyOutfiles makes the output data zip archive of job src available as
+// the output data of job dst.
+func copyOutfiles(bs BlobStore, dst, src *Job) error {
+	r, err := bs.Open(outfileName(src))
+	if err != nil {
+		return err
+	}
+	defer r.Close()
+
+	w, err := bs.Create(outfileName(dst))
+	if err != nil {
+		return err
+	}
+	if _, err := io.Copy(w, r); err != nil {
+		w.Close()
+		bs.Remove(outfileName(dst))
+		return err
+	}
+	return w.Close()
+}
+
+// readOutfiles returns all the files stored in the output data zip archive
+// for job j.
+func readOutfiles(bs BlobStore, j *Job) ([]File, error) {
+	rc, err := bs.Open(outfileName(j))
+	if err != nil {
+		return nil, err
+	}
+	data, err := ioutil.ReadAll(rc)
+	rc.Close()
+	if err != nil {
+		return nil, err
+	}
+
+	r, err := zip.NewReader(bytes.NewReader(data), int64(len(data)))
+	if err != nil {
+		return nil, err
+	}
+
+	files := []File{}
+	for _, f := range r.File {
+		rc, err := f.Open()
+		if err != nil {
+			return nil, err
+		}
+		data, err := ioutil.ReadAll(rc)
+		rc.Close()
+		if err != nil {
+			return nil, err
+		}
+		files = append(files, File{Name: f.Name, Data: data, Size: len(data)})
+	}
+	return files, nil
+}
@@ -0,0 +1,363 @@
+package cloudlus
+
+import (
+	"fmt"
+	"io/ioutil"
+	"net/url"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestFSBlobStore(t *testing.T) {
+	dir, err := ioutil.TempDir("", "cloudlus-outdata")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	bs, err := NewFSBlobStore(filepath.Join(dir, "sub"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	w, err := bs.Create("a.zip")
+	if err != nil {
+		t.Fatal(err)
+	}
+	w.Write([]byte("hello"))
+	if _, err := bs.Open("a.zip"); err == nil {
+		t.Errorf("partially written blob is visible before Close")
+	}
+	if err := w.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	r, err := bs.Open("a.zip")
+	if err != nil {
+		t.Fatal(err)
+	}
+	data, _ := ioutil.ReadAll(r)
+	r.Close()
+	if string(data) != "hello" {
+		t.Errorf("wrong blob data: got '%s', want 'hello'", data)
+	}
+
+	if _, err := bs.Create("../escape.zip"); err == nil {
+		t.Errorf("blob names escaping the root dir should be rejected")
+	}
+	if err := bs.Remove("a.zip"); err != nil {
+		t.Error(err)
+	}
+	if _, err := os.Stat(filepath.Join(dir, "sub", "a.zip")); !os.IsNotExist(err) {
+		t.Errorf("removed blob still exists")
+	}
+}
+
+// testQuery checks filtering, sorting and pagination of queries against db.
+func testQuery(t *testing.T, db JobStore) {
+	start := time.Now().Add(-time.Hour)
+	wid := WorkerId{1}
+	aid := JobId{1}
+	ids := []JobId{}
+	for i := 0; i < 10; i++ {
+		j := NewJobCmd("echo", fmt.Sprint(i))
+		j.Submitted = start.Add(time.Duration(i) * time.Minute)
+		j.Owner = "alice"
+		j.Status = StatusQueued
+		if i%3 == 0 {
+			j.ArrayId, j.ArrayIndex = aid, i/3
+		}
+		if i%2 == 1 {
+			j.Owner = "bob"
+			j.Note = "odd job"
+			j.Status = StatusComplete
+			j.Finished = j.Submitted.Add(time.Duration(i) * time.Minute)
+			j.Attempts = []Attempt{{WorkerId: wid, Status: StatusComplete}}
+		}
+		if err := db.Put(j); err != nil {
+			t.Fatal(err)
+		}
+		// jobs change status after their first Put
+		if i == 9 {
+			j.Status = StatusFailed
+			db.Put(j)
+		}
+		ids = append(ids, j.Id)
+	}
+
+	tests := []struct {
+		q    Query
+		want []int
+	}{
+		{Query{}, []int{9, 8, 7, 6, 5, 4, 3, 2, 1, 0}},
+		{Query{Ascending: true, Limit: 3}, []int{0, 1, 2}},
+		{Query{Status: StatusQueued, Limit: 2}, []int{8, 6}},
+		{Query{Status: StatusComplete}, []int{7, 5, 3, 1}},
+		{Query{Owner: "bob", Worker: wid}, []int{9, 7, 5, 3, 1}},
+		{Query{Worker: WorkerId{2}}, []int{}},
+		{Query{Array: aid}, []int{9, 6, 3, 0}},
+		{Query{Array: aid, Status: StatusQueued}, []int{6, 0}},
+		{Query{Note: "odd", Cmd: "echo 3"}, []int{3}},
+		{Query{SubmittedAfter: start.Add(2 * time.Minute), SubmittedBefore: start.Add(5 * time.Minute)}, []int{4, 3}},
+		{Query{SortBy: SortFinished, FinishedBefore: start.Add(15 * time.Minute)}, []int{7, 5, 3, 1}},
+		{Query{SortBy: SortFinished, Ascending: true, FinishedAfter: start.Add(15 * time.Minute)}, []int{9}},
+	}
+
+	for i, test := range tests {
+		jobs, _, err := db.Query(test.q)
+		if err != nil {
+			t.Errorf("query %v: %v", i, err)
+			continue
+		}
+		got := []int{}
+		for _, j := range jobs {
+			for k, id := range ids {
+				if j.Id == id {
+					got = append(got, k)
+				}
+			}
+		}
+		if fmt.Sprint(got) != fmt.Sprint(test.want) {
+			t.Errorf("query %v: got jobs %v, want %v", i, got, test.want)
+		}
+	}
+
+	// page through all jobs
+	q := Query{Limit: 4}
+	seen := map[JobId]bool{}
+	for npages := 1; ; npages++ {
+		jobs, next, err := db.Query(q)
+		if err != nil {
+			t.Fatal(err)
+		}
+		for _, j := range jobs {
+			if seen[j.Id] {
+				t.Errorf("job %v returned on multiple pages", j.Id)
+			}
+			seen[j.Id] = true
+		}
+		if next == "" {
+			if npages != 3 {
+				t.Errorf("got %v pages, want 3", npages)
+			}
+			break
+		}
+		q.Cursor = next
+	}
+	if len(seen) != len(ids) {
+		t.Errorf("paging returned %v jobs, want %v", len(seen), len(ids))
+	}
+
+	// page by finish time - unfinished jobs have none and are left out
+	q = Query{SortBy: SortFinished, Limit: 2}
+	got := []int{}
+	for {
+		jobs, next, err := db.Query(q)
+		if err != nil {
+			t.Fatal(err)
+		}
+		for _, j := range jobs {
+			for k, id := range ids {
+				if j.Id == id {
+					got = append(got, k)
+				}
+			}
+		}
+		if next == "" {
+			break
+		}
+		q.Cursor = next
+	}
+	if want := []int{9, 7, 5, 3, 1}; fmt.Sprint(got) != fmt.Sprint(want) {
+		t.Errorf("paging by finish time: got jobs %v, want %v", got, want)
+	}
+
+	// pages split jobs submitted within the same second (and at the same
+	// time) in order
+	sametime := []*Job{}
+	for i := 0; i < 7; i++ {
+		j := NewJobCmd("echo", "same")
+		j.Owner = "carol"
+		j.Submitted = start.Add(-time.Hour).Add(time.Duration(i/2) * time.Millisecond)
+		if err := db.Put(j); err != nil {
+			t.Fatal(err)
+		}
+		sametime = append(sametime, j)
+	}
+	for _, asc := range []bool{true, false} {
+		want, _, err := db.Query(Query{Owner: "carol", Ascending: asc})
+		if err != nil {
+			t.Fatal(err)
+		} else if len(want) != len(sametime) {
+			t.Fatalf("got %v jobs submitted at the same time, want %v", len(want), len(sametime))
+		}
+
+		q := Query{Owner: "carol", Ascending: asc, Limit: 2}
+		got := []*Job{}
+		for {
+			jobs, next, err := db.Query(q)
+			if err != nil {
+				t.Fatal(err)
+			}
+			got = append(got, jobs...)
+			if next == "" {
+				break
+			}
+			q.Cursor = next
+		}
+		if len(got) != len(want) {
+			t.Errorf("paging ascending=%v: got %v jobs, want %v", asc, len(got), len(want))
+			continue
+		}
+		for i := range want {
+			if got[i].Id != want[i].Id {
+				t.Errorf("paging ascending=%v: job %v is %v, want %v", asc, i, got[i].Id, want[i].Id)
+			}
+		}
+	}
+}
+
+func TestQueryCursor(t *testing.T) {
+	q := Query{SortBy: SortFinished}
+	for _, finished := range []time.Time{{}, time.Unix(-5, 7), time.Now()} {
+		j := NewJob()
+		j.Finished = finished
+		tm, id, err := parseCursor(q.cursor(j))
+		if err != nil {
+			t.Errorf("cursor for finish time %v: %v", finished, err)
+		} else if !tm.Equal(finished) || id != j.Id {
+			t.Errorf("cursor round trip: got %v and job %v, want %v and job %v", tm, id, finished, j.Id)
+		}
+	}
+}
+
+func TestParseQuery(t *testing.T) {
+	v := url.Values{}
+	v.Set("status", StatusFailed)
+	v.Set("worker", WorkerId{1}.String())
+	v.Set("array", JobId{2}.String())
+	v.Set("submitted-after", "2h")
+	v.Set("finished-before", "2015-06-01T12:00:00Z")
+	v.Set("order", "asc")
+	v.Set("limit", "20")
+
+	q, err := ParseQuery(v)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if q.Status != StatusFailed || q.Worker != (WorkerId{1}) || q.Array != (JobId{2}) || !q.Ascending || q.Limit != 20 {
+		t.Errorf("query parsed incorrectly: %+v", q)
+	}
+	if ago := time.Now().Sub(q.SubmittedAfter); ago < 2*time.Hour || ago > 2*time.Hour+time.Minute {
+		t.Errorf("relative time parsed incorrectly: got %v ago, want 2h", ago)
+	}
+	if want := time.Date(2015, 6, 1, 12, 0, 0, 0, time.UTC); !q.FinishedBefore.Equal(want) {
+		t.Errorf("absolute time parsed incorrectly: got %v, want %v", q.FinishedBefore, want)
+	}
+
+	for _, bad := range []string{"sort=size", "cursor=junk", "limit=-1", "worker=xyz", "finished-after=tuesday"} {
+		v, _ := url.ParseQuery(bad)
+		if _, err := ParseQuery(v); err == nil {
+			t.Errorf("invalid query '%v' parsed without error", bad)
+		}
+	}
+}
+
+// testTokens checks storing, listing and deleting API tokens in db.
+func testTokens(t *testing.T, db JobStore) {
+	a, _ := newToken("alice", RoleSubmitter)
+	b, _ := newToken("", RoleWorker)
+	for _, it := range []*IssuedToken{a, b} {
+		if err := db.PutToken(it.Token); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if got, err := db.GetToken(a.Id); err != nil || got.Owner != "alice" || got.Hash != a.Hash {
+		t.Errorf("token not retrieved correctly: got %+v (err=%v)", got, err)
+	}
+	if ts, err := db.Tokens(); err != nil || len(ts) != 2 {
+		t.Errorf("got %v tokens (err=%v), want 2", len(ts), err)
+	}
+	if n, _ := db.Count(); n != 0 {
+		t.Errorf("tokens counted as jobs: got %v jobs, want 0", n)
+	}
+
+	if err := db.DeleteToken(a.Id); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := db.GetToken(a.Id); err == nil {
+		t.Errorf("deleted token still exists")
+	}
+	if ts, _ := db.Tokens(); len(ts) != 1 || ts[0].Id != b.Id {
+		t.Errorf("wrong tokens after delete: got %v, want [%v]", ts, b.Id)
+	}
+}
+
+// testEvents checks appending, listing and purging events in db.  db must
+// purge all finished jobs on GC.
+func testEvents(t *testing.T, db JobStore) {
+	done := NewJobCmd("echo", "1")
+	done.Status = StatusComplete
+	done.Finished = time.Now()
+	queued := NewJobCmd("echo", "2")
+	queued.Status = StatusQueued
+	for _, j := range []*Job{done, queued} {
+		if err := db.Put(j); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	events := []*Event{
+		{JobId: done.Id, Type: EventSubmit, NewStatus: StatusQueued, Actor: "alice"},
+		{JobId: queued.Id, Type: EventSubmit, NewStatus: StatusQueued, Actor: "bob"},
+		{JobId: done.Id, Type: EventFetch, OldStatus: StatusQueued, NewStatus: StatusRunning, WorkerId: WorkerId{1}, Actor: ActorWorker},
+		{JobId: done.Id, Type: EventPush, OldStatus: StatusRunning, NewStatus: StatusComplete, WorkerId: WorkerId{1}, Actor: ActorWorker},
+	}
+	for i, e := range events {
+		if err := db.AppendEvent(e); err != nil {
+			t.Fatal(err)
+		} else if e.Seq != uint64(i+1) {
+			t.Errorf("event %v got Seq %v, want %v", i, e.Seq, i+1)
+		}
+	}
+
+	if got, err := db.Events(0, 0); err != nil || len(got) != len(events) {
+		t.Errorf("got %v events (err=%v), want %v", len(got), err, len(events))
+	}
+	if got, _ := db.Events(1, 2); len(got) != 2 || got[0].Seq != 2 || got[1].Seq != 3 {
+		t.Errorf("wrong events after 1 with limit 2: got %+v", got)
+	}
+	got, err := db.JobEvents(done.Id)
+	if err != nil {
+		t.Fatal(err)
+	} else if len(got) != 3 {
+		t.Fatalf("got %v events for job, want 3", len(got))
+	}
+	for i, typ := range []string{EventSubmit, EventFetch, EventPush} {
+		if got[i].Type != typ || got[i].JobId != done.Id {
+			t.Errorf("job event %v: got %+v, want type %v", i, got[i], typ)
+		}
+	}
+	if got[2].Seq != 4 || got[2].WorkerId != (WorkerId{1}) || got[2].NewStatus != StatusComplete {
+		t.Errorf("job event not retrieved correctly: got %+v", got[2])
+	}
+	if n, _ := db.Count(); n != 2 {
+		t.Errorf("events counted as jobs: got %v jobs, want 2", n)
+	}
+
+	if _, _, err := db.GC(); err != nil {
+		t.Fatal(err)
+	}
+	if got, _ := db.JobEvents(done.Id); len(got) != 0 {
+		t.Errorf("GC left %v events of purged job", len(got))
+	}
+	if got, _ := db.Events(0, 0); len(got) != 1 || got[0].JobId != queued.Id {
+		t.Errorf("wrong events after GC: got %+v", got)
+	}
+	if e := (&Event{JobId: queued.Id}); db.AppendEvent(e) != nil || e.Seq != 5 {
+		t.Errorf("event after GC got Seq %v, want 5", e.Seq)
+	}
+}
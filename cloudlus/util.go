@@ -6,8 +6,8 @@ import (
 	"encoding/hex"
 	"encoding/json"
 	"fmt"
-	"os"
 	"strings"
+	"sync"
 	"time"
 
 	"github.com/rwcarlsen/cloudlus/Godeps/_workspace/src/github.com/syndtr/goleveldb/leveldb"
@@ -66,6 +66,17 @@ func (i *JobId) UnmarshalJSON(data []byte) error {
 
 func (i JobId) String() string { return hex.EncodeToString(i[:]) }
 
+func parseJobId(s string) (JobId, error) {
+	var id JobId
+	bs, err := hex.DecodeString(s)
+	if err != nil {
+		return id, err
+	} else if n := copy(id[:], bs); n < len(id) {
+		return id, fmt.Errorf("job id '%v' has invalid length %v", s, n)
+	}
+	return id, nil
+}
+
 type DB struct {
 	db *leveldb.DB
 	// Limit is the cumulative maximum number of bytes that all jobs in the
@@ -75,6 +86,9 @@ type DB struct {
 	// PurgeAge is the minimum age at which completed (successful and failed) jobs
 	// become elegible for removal from the database during GC.
 	PurgeAge time.Duration
+	evmu     sync.Mutex // guards evseq
+	// evseq is the Seq of the last event in the event log.
+	evseq uint64
 }
 
 // NewDB returns a new database with a
@@ -94,27 +108,86 @@ func NewDB(path string, dblimit int) (*DB, error) {
 		}
 		d.db = db
 	}
-	return d, nil
+
+	it := d.db.NewIterator(util.BytesPrefix([]byte(eventPrefix)), nil)
+	if it.Last() {
+		d.evseq = binary.BigEndian.Uint64(it.Key()[len(eventPrefix):])
+	}
+	it.Release()
+	return d, d.reindex()
+}
+
+// indexVersion identifies the set of query indexes maintained by Put.  It
+// must be incremented whenever indexes are added so existing databases are
+// reindexed when opened.
+const indexVersion = "3"
+
+var versionKey = []byte(metaPrefix + "index-version")
+
+// reindex rebuilds all index entries for databases created before the
+// current set of indexes existed.
+func (d *DB) reindex() error {
+	if v, err := d.db.Get(versionKey, nil); err == nil && string(v) == indexVersion {
+		return nil
+	}
+
+	it := d.db.NewIterator(nil, nil)
+	jobs := []*Job{}
+	for it.Next() {
+		if notjob(it.Key()) {
+			continue
+		}
+		j := &Job{}
+		if err := json.Unmarshal(it.Value(), &j); err != nil {
+			it.Release()
+			return err
+		}
+		jobs = append(jobs, j)
+	}
+	it.Release()
+	if err := it.Error(); err != nil {
+		return err
+	}
+
+	// the layout of status and owner index keys changed in version 3
+	for _, pfx := range []string{statusPrefix, ownerPrefix} {
+		it := d.db.NewIterator(util.BytesPrefix([]byte(pfx)), nil)
+		for it.Next() {
+			d.db.Delete(it.Key(), nil)
+		}
+		it.Release()
+		if err := it.Error(); err != nil {
+			return err
+		}
+	}
+
+	for _, j := range jobs {
+		if err := d.Put(j); err != nil {
+			return err
+		}
+	}
+	return d.db.Put(versionKey, []byte(indexVersion), nil)
 }
 
 // GC runs garbage collection if the database is larger than the specified
 // DB.Limit.  Jobs older than DB.PurgeAge are removed if they have been
-// completed.  The number of removed jobs and the number of jobs still in the
+// completed.  The ids of removed jobs and the number of jobs still in the
 // database is returned along with any error that occured.  sometimes, -1 may
 // be returned for nremain - this means that the jobs count is unknown because
 // GC didn't occur.
-func (d *DB) GC() (npurged, nremain int, err error) {
+func (d *DB) GC() (purged []JobId, nremain int, err error) {
 	size, err := d.Size()
 	if err != nil {
-		return 0, -1, err
+		return nil, -1, err
 	} else if size < int64(d.Limit) {
-		return 0, -1, nil
+		return nil, -1, nil
 	}
 
 	it := d.db.NewIterator(nil, nil)
 	defer it.Release()
 
 	now := time.Now()
+	refs := map[string]bool{} // blobs referenced by remaining jobs
 	for it.Next() {
 		if notjob(it.Key()) {
 			// TODO: test that non-job key entries are properly skipped
@@ -125,24 +198,233 @@ func (d *DB) GC() (npurged, nremain int, err error) {
 		data := it.Value()
 		err := json.Unmarshal(data, &j)
 		if err != nil {
-			return npurged, -1, err
+			return purged, -1, err
 		}
 
 		if j.Done() && now.Sub(j.Finished) > d.PurgeAge {
-			os.Remove(outfileName(j))
 			d.db.Delete(it.Key(), nil)
-			d.db.Delete(finishKey(j), nil)
 			d.db.Delete(currentKey(j), nil)
-			npurged++
+			for _, key := range queryKeys(j) {
+				d.db.Delete(key, nil)
+			}
+			for _, dep := range j.DependsOn {
+				d.db.Delete(depKey(dep, j.Id), nil)
+			}
+			if id, err := d.db.Get(memoKey(j), nil); err == nil && bytes.Equal(id, j.Id[:]) {
+				d.db.Delete(memoKey(j), nil)
+			}
+			if err := d.deleteEvents(j.Id); err != nil {
+				return purged, -1, err
+			}
+			purged = append(purged, j.Id)
 		} else {
+			for _, f := range j.Infiles {
+				refs[f.Hash] = true
+			}
 			nremain++
 		}
 	}
 	if err := it.Error(); err != nil {
-		return npurged, nremain, err
+		return purged, nremain, err
 	}
 
-	return npurged, nremain, nil
+	return purged, nremain, d.gcBlobs(refs)
+}
+
+// gcBlobs removes all blobs not in refs that were stored (or last checked
+// for with HasBlob) longer than PurgeAge ago.
+func (d *DB) gcBlobs(refs map[string]bool) error {
+	it := d.db.NewIterator(util.BytesPrefix([]byte(blobPrefix)), nil)
+	defer it.Release()
+
+	now := time.Now()
+	for it.Next() {
+		hash := string(it.Key()[len(blobPrefix):])
+		if !refs[hash] && now.Sub(blobTime(it.Value())) > d.PurgeAge {
+			d.db.Delete(it.Key(), nil)
+		}
+	}
+	return it.Error()
+}
+
+// PutBlob stores data in the database's content-addressed blob store and
+// returns its hash.
+func (d *DB) PutBlob(data []byte) (hash string, err error) {
+	hash = blobHash(data)
+	val := make([]byte, 8+len(data))
+	binary.BigEndian.PutUint64(val, uint64(time.Now().Unix()))
+	copy(val[8:], data)
+	return hash, d.db.Put(blobKey(hash), val, nil)
+}
+
+// GetBlob returns the contents of the blob with the given hash.
+func (d *DB) GetBlob(hash string) ([]byte, error) {
+	val, err := d.db.Get(blobKey(hash), nil)
+	if err == leveldb.ErrNotFound {
+		return nil, fmt.Errorf("unknown blob %v", hash)
+	} else if err != nil {
+		return nil, err
+	}
+	return val[8:], nil
+}
+
+// HasBlob returns true if the blob with the given hash is stored in the
+// database.  Blobs are kept for at least PurgeAge after being stored or
+// checked for - giving clients time to submit jobs referring to them.
+func (d *DB) HasBlob(hash string) (bool, error) {
+	val, err := d.db.Get(blobKey(hash), nil)
+	if err == leveldb.ErrNotFound {
+		return false, nil
+	} else if err != nil {
+		return false, err
+	}
+
+	if time.Now().Sub(blobTime(val)) > d.PurgeAge/2 {
+		_, err = d.PutBlob(val[8:])
+	}
+	return true, err
+}
+
+func blobKey(hash string) []byte { return []byte(blobPrefix + hash) }
+
+// PutToken stores (or replaces) the API token t.
+func (d *DB) PutToken(t *Token) error {
+	data, err := json.Marshal(t)
+	if err != nil {
+		return err
+	}
+	return d.db.Put(tokenKey(t.Id), data, nil)
+}
+
+// GetToken returns the API token with the given id.
+func (d *DB) GetToken(id string) (*Token, error) {
+	data, err := d.db.Get(tokenKey(id), nil)
+	if err == leveldb.ErrNotFound {
+		return nil, fmt.Errorf("unknown token %v", id)
+	} else if err != nil {
+		return nil, err
+	}
+	t := &Token{}
+	return t, json.Unmarshal(data, t)
+}
+
+// DeleteToken removes the API token with the given id.
+func (d *DB) DeleteToken(id string) error { return d.db.Delete(tokenKey(id), nil) }
+
+// Tokens returns all stored API tokens ordered by id.
+func (d *DB) Tokens() ([]*Token, error) {
+	it := d.db.NewIterator(util.BytesPrefix([]byte(tokenPrefix)), nil)
+	defer it.Release()
+
+	tokens := []*Token{}
+	for it.Next() {
+		t := &Token{}
+		if err := json.Unmarshal(it.Value(), t); err != nil {
+			return nil, err
+		}
+		tokens = append(tokens, t)
+	}
+	return tokens, it.Error()
+}
+
+func tokenKey(id string) []byte { return []byte(tokenPrefix + id) }
+
+// AppendEvent adds e to the end of the event log and sets its Seq.
+func (d *DB) AppendEvent(e *Event) error {
+	d.evmu.Lock()
+	defer d.evmu.Unlock()
+
+	e.Seq = d.evseq + 1
+	data, err := json.Marshal(e)
+	if err != nil {
+		return err
+	}
+	b := &leveldb.Batch{}
+	b.Put(eventKey(e.Seq), data)
+	b.Put(jobEventKey(e.JobId, e.Seq), eventKey(e.Seq))
+	if err := d.db.Write(b, nil); err != nil {
+		return err
+	}
+	d.evseq = e.Seq
+	return nil
+}
+
+// Events returns up to limit events with a Seq greater than since - oldest
+// first.  If limit is zero, all of them are returned.
+func (d *DB) Events(since uint64, limit int) ([]*Event, error) {
+	r := util.BytesPrefix([]byte(eventPrefix))
+	r.Start = eventKey(since + 1)
+	it := d.db.NewIterator(r, nil)
+	defer it.Release()
+
+	events := []*Event{}
+	for it.Next() && (limit == 0 || len(events) < limit) {
+		e := &Event{}
+		if err := json.Unmarshal(it.Value(), e); err != nil {
+			return nil, err
+		}
+		events = append(events, e)
+	}
+	return events, it.Error()
+}
+
+// JobEvents returns all events of the job with the given id - oldest first.
+func (d *DB) JobEvents(id JobId) ([]*Event, error) {
+	it := d.db.NewIterator(util.BytesPrefix(jobEventsPrefix(id)), nil)
+	defer it.Release()
+
+	events := []*Event{}
+	for it.Next() {
+		data, err := d.db.Get(it.Value(), nil)
+		if err != nil {
+			return nil, err
+		}
+		e := &Event{}
+		if err := json.Unmarshal(data, e); err != nil {
+			return nil, err
+		}
+		events = append(events, e)
+	}
+	return events, it.Error()
+}
+
+// deleteEvents removes all events of the job with the given id from the
+// event log.
+func (d *DB) deleteEvents(id JobId) error {
+	it := d.db.NewIterator(util.BytesPrefix(jobEventsPrefix(id)), nil)
+	defer it.Release()
+
+	for it.Next() {
+		d.db.Delete(it.Value(), nil)
+		d.db.Delete(it.Key(), nil)
+	}
+	return it.Error()
+}
+
+// eventKey returns the event log key of the event with the given Seq.  Keys
+// sort by Seq.
+func eventKey(seq uint64) []byte {
+	key := make([]byte, len(eventPrefix)+8)
+	copy(key, eventPrefix)
+	binary.BigEndian.PutUint64(key[len(eventPrefix):], seq)
+	return key
+}
+
+// jobEventsPrefix returns the prefix of the index keys of all events of job
+// id.
+func jobEventsPrefix(id JobId) []byte {
+	return append([]byte(jobEventPrefix), id[:]...)
+}
+
+// jobEventKey returns the index key of the event with the given Seq of job
+// id.
+func jobEventKey(id JobId, seq uint64) []byte {
+	return append(jobEventsPrefix(id), eventKey(seq)[len(eventPrefix):]...)
+}
+
+// blobTime returns the time a blob database entry was stored.
+func blobTime(val []byte) time.Time {
+	return time.Unix(int64(binary.BigEndian.Uint64(val)), 0)
 }
 
 // Size returns the cumulative size of all jobs in the database (uncompressed
@@ -182,16 +464,128 @@ func (d *DB) Count() (int, error) {
 func (d *DB) Close() error { return d.db.Close() }
 
 func notjob(key []byte) bool {
-	pfx1 := []byte(finishPrefix)
-	pfx2 := []byte(currPrefix)
-	if bytes.Equal(key[:len(pfx1)], pfx1) {
-		return true
-	} else if bytes.Equal(key[:len(pfx2)], pfx2) {
-		return true
+	for _, pfx := range indexPrefixes {
+		if bytes.HasPrefix(key, []byte(pfx)) {
+			return true
+		}
 	}
 	return false
 }
 
+// Query returns a page of jobs in the database matching q and the cursor
+// for the next page.  Candidate jobs are taken from the most selective index
+// applicable to q (see Query.index).  If that index is ordered by q's sort
+// key, it is walked from the cursor only until the page is full.
+func (d *DB) Query(q Query) ([]*Job, string, error) {
+	if err := q.Validate(); err != nil {
+		return nil, "", err
+	}
+
+	prefix, r, ordered := q.index()
+	if ordered && q.Limit > 0 {
+		return d.queryPage(q, prefix, r)
+	}
+
+	it := d.db.NewIterator(r, nil)
+	defer it.Release()
+
+	jobs := []*Job{}
+	for it.Next() {
+		var id JobId
+		copy(id[:], it.Value())
+		j, err := d.Get(id)
+		if err != nil {
+			return nil, "", err
+		}
+		jobs = append(jobs, j)
+	}
+	if err := it.Error(); err != nil {
+		return nil, "", err
+	}
+
+	page, next := q.apply(jobs)
+	return page, next, nil
+}
+
+// index returns the key prefix and range of the most selective index
+// applicable to q in order of preference: the array, worker, status, owner,
+// finish time and submit time indexes.  ordered is true if the index's keys
+// are the prefix followed by q's sort key in seconds, which is true for the
+// status, owner and submit time indexes when sorting by submit time and for
+// the finish time index when sorting by finish time.
+func (q Query) index() (prefix string, r *util.Range, ordered bool) {
+	bysub := q.SortBy != SortFinished
+	switch {
+	case q.Array != (JobId{}):
+		prefix = arrayPrefix + string(q.Array[:])
+		return prefix, util.BytesPrefix([]byte(prefix)), false
+	case q.Worker != (WorkerId{}):
+		prefix = workerPrefix + string(q.Worker[:])
+		return prefix, util.BytesPrefix([]byte(prefix)), false
+	case q.Status != "":
+		prefix = statusPrefix + q.Status + "\x00"
+		return prefix, timeRange(prefix, q.SubmittedAfter, q.SubmittedBefore), bysub
+	case q.Owner != "":
+		prefix = ownerPrefix + q.Owner + "\x00"
+		return prefix, timeRange(prefix, q.SubmittedAfter, q.SubmittedBefore), bysub
+	case !bysub || !q.FinishedAfter.IsZero() || !q.FinishedBefore.IsZero():
+		return finishPrefix, timeRange(finishPrefix, q.FinishedAfter, q.FinishedBefore), !bysub
+	default:
+		return submitPrefix, timeRange(submitPrefix, q.SubmittedAfter, q.SubmittedBefore), true
+	}
+}
+
+// queryPage returns the page of jobs matching q by walking the index range r
+// - ordered by q's sort key (see Query.index) - in q's order starting at the
+// cursor.  Index keys only have second resolution, so the walk stops at the
+// end of the second in which more than q.Limit jobs matched and the
+// candidates are sorted precisely by Query.apply.
+func (d *DB) queryPage(q Query, prefix string, r *util.Range) ([]*Job, string, error) {
+	after, afterid, _ := parseCursor(q.Cursor)
+	if q.Cursor != "" && q.Ascending {
+		if key := timeKey(prefix, after); bytes.Compare(key, r.Start) > 0 {
+			r.Start = key
+		}
+	} else if q.Cursor != "" && after.Unix() >= 0 {
+		if key := timeKey(prefix, after.Add(time.Second)); bytes.Compare(key, r.Limit) < 0 {
+			r.Limit = key
+		}
+	}
+
+	it := d.db.NewIterator(r, nil)
+	defer it.Release()
+	ok, step := it.First(), it.Next
+	if !q.Ascending {
+		ok, step = it.Last(), it.Prev
+	}
+
+	jobs := []*Job{}
+	sec := []byte{}
+	for ; ok; ok = step() {
+		key := it.Key()[len(prefix) : len(prefix)+8]
+		if len(jobs) > q.Limit && !bytes.Equal(key, sec) {
+			break
+		}
+		sec = append(sec[:0], key...)
+
+		var id JobId
+		copy(id[:], it.Value())
+		j, err := d.Get(id)
+		if err != nil {
+			return nil, "", err
+		} else if !q.Match(j) || (q.Cursor != "" && !q.less(after, afterid, q.sortKey(j), j.Id)) {
+			continue
+		}
+		jobs = append(jobs, j)
+	}
+	if err := it.Error(); err != nil {
+		return nil, "", err
+	}
+
+	page, next := q.apply(jobs)
+	return page, next, nil
+}
+
 // Failed returns the all jobs from the database that failed.
 func (d *DB) Failed() ([]*Job, error) {
 	it := d.db.NewIterator(nil, nil)
@@ -245,6 +639,37 @@ func (d *DB) Current() ([]*Job, error) {
 	return jobs, nil
 }
 
+// Dependents returns the ids of all jobs in the database that depend on the
+// job with the given id.
+func (d *DB) Dependents(id JobId) ([]JobId, error) {
+	pfx := append([]byte(depPrefix), id[:]...)
+	it := d.db.NewIterator(util.BytesPrefix(pfx), nil)
+	defer it.Release()
+
+	ids := []JobId{}
+	for it.Next() {
+		var id JobId
+		copy(id[:], it.Value())
+		ids = append(ids, id)
+	}
+	if err := it.Error(); err != nil {
+		return nil, err
+	}
+	return ids, nil
+}
+
+// Memoized returns the id of the most recently completed job with the same
+// memo hash as j.
+func (d *DB) Memoized(j *Job) (JobId, error) {
+	var id JobId
+	data, err := d.db.Get(memoKey(j), nil)
+	if err != nil {
+		return id, err
+	}
+	copy(id[:], data)
+	return id, nil
+}
+
 // Recent returns up to n of the most recently completed jobs (including
 // failed ones).
 func (d *DB) Recent(n int) ([]*Job, error) {
@@ -293,19 +718,118 @@ func (d *DB) Get(id JobId) (*Job, error) {
 
 const finishPrefix = "finish-"
 const currPrefix = "curr-"
+const depPrefix = "dep-"
+const memoPrefix = "memo-"
+const blobPrefix = "blob-"
+const submitPrefix = "sub-"
+const statusPrefix = "status-"
+const ownerPrefix = "owner-"
+const workerPrefix = "worker-"
+const arrayPrefix = "array-"
+const metaPrefix = "meta-"
+const tokenPrefix = "token-"
+const eventPrefix = "event-"
+const jobEventPrefix = "jobevent-"
+
+// indexPrefixes holds the key prefixes of all non-job (index, blob and
+// metadata) entries in the database.
+var indexPrefixes = []string{
+	finishPrefix, currPrefix, depPrefix, memoPrefix, blobPrefix,
+	submitPrefix, statusPrefix, ownerPrefix, workerPrefix, arrayPrefix,
+	metaPrefix, tokenPrefix, eventPrefix, jobEventPrefix,
+}
 
-func finishKey(j *Job) []byte {
+// timeKey returns prefix followed by t as big-endian unix seconds so keys
+// sort chronologically.  Times before 1970 are clamped to zero.
+func timeKey(prefix string, t time.Time) []byte {
 	data := make([]byte, 8)
-	binary.BigEndian.PutUint64(data, uint64(j.Finished.Unix()))
-	key := append([]byte(finishPrefix), data...)
+	if sec := t.Unix(); sec > 0 {
+		binary.BigEndian.PutUint64(data, uint64(sec))
+	}
+	return append([]byte(prefix), data...)
+}
+
+// timeRange returns the range of time index entries with the given prefix
+// between after and before.  Zero times leave the range open ended.
+func timeRange(prefix string, after, before time.Time) *util.Range {
+	r := util.BytesPrefix([]byte(prefix))
+	if !after.IsZero() {
+		r.Start = timeKey(prefix, after)
+	}
+	if !before.IsZero() {
+		r.Limit = timeKey(prefix, before.Add(time.Second))
+	}
+	return r
+}
+
+func finishKey(j *Job) []byte {
+	key := timeKey(finishPrefix, j.Finished)
 	key = append(key, '-')
 	return append(key, j.Id[:]...)
 }
 
+func submitKey(j *Job) []byte {
+	return append(timeKey(submitPrefix, j.Submitted), j.Id[:]...)
+}
+
+// statusKey returns j's status index key.  Keys of each status sort by
+// submit time.
+func statusKey(j *Job) []byte {
+	return append(timeKey(statusPrefix+j.Status+"\x00", j.Submitted), j.Id[:]...)
+}
+
+// ownerKey returns j's owner index key.  Keys of each owner sort by submit
+// time.
+func ownerKey(j *Job) []byte {
+	return append(timeKey(ownerPrefix+j.Owner+"\x00", j.Submitted), j.Id[:]...)
+}
+
+func workerKey(wid WorkerId, j *Job) []byte {
+	key := append([]byte(workerPrefix), wid[:]...)
+	return append(key, j.Id[:]...)
+}
+
+func arrayKey(j *Job) []byte {
+	key := append([]byte(arrayPrefix), j.ArrayId[:]...)
+	return append(key, j.Id[:]...)
+}
+
+// queryKeys returns the keys of all the time, status, owner, worker and
+// array index entries for j.
+func queryKeys(j *Job) [][]byte {
+	keys := [][]byte{submitKey(j), statusKey(j), ownerKey(j)}
+	if j.Done() {
+		keys = append(keys, finishKey(j))
+	}
+	if j.WorkerId != (WorkerId{}) {
+		keys = append(keys, workerKey(j.WorkerId, j))
+	}
+	for _, a := range j.Attempts {
+		keys = append(keys, workerKey(a.WorkerId, j))
+	}
+	if j.ArrayId != (JobId{}) {
+		keys = append(keys, arrayKey(j))
+	}
+	return keys
+}
+
 func currentKey(j *Job) []byte {
 	return append([]byte(currPrefix), j.Id[:]...)
 }
 
+// depKey returns the dependency index key recording that child depends on
+// parent.
+func depKey(parent, child JobId) []byte {
+	key := append([]byte(depPrefix), parent[:]...)
+	return append(key, child[:]...)
+}
+
+// memoKey returns the memoization index key for jobs producing the same
+// results as j.
+func memoKey(j *Job) []byte {
+	return append([]byte(memoPrefix), j.memoHash()...)
+}
+
 func (d *DB) Put(j *Job) error {
 	data, err := json.Marshal(j)
 	if err != nil {
@@ -322,19 +846,35 @@ func (d *DB) Put(j *Job) error {
 		}
 	}
 
-	// time finished index
-	if j.Done() && j.Finished.Unix() >= 0 {
-		// TODO: test that we don't add entries for unfinished jobs - they have a
-		// negative unix time and mess up the iteration order.
-		err = d.db.Put(finishKey(j), j.Id[:], nil)
+	// dependency index
+	for _, dep := range j.DependsOn {
+		err = d.db.Put(depKey(dep, j.Id), j.Id[:], nil)
 		if err != nil {
 			return err
 		}
 	}
 
-	return d.db.Put(j.Id[:], data, nil)
-}
+	// memoization index
+	if j.Status == StatusComplete && !j.NoCache {
+		err = d.db.Put(memoKey(j), j.Id[:], nil)
+		if err != nil {
+			return err
+		}
+	}
+
+	// time, status, owner and worker indexes - entries for the job's previous
+	// state are removed first since e.g. its status may have changed.
+	if old, err := d.Get(j.Id); err == nil {
+		for _, key := range queryKeys(old) {
+			d.db.Delete(key, nil)
+		}
+	}
+	for _, key := range queryKeys(j) {
+		err = d.db.Put(key, j.Id[:], nil)
+		if err != nil {
+			return err
+		}
+	}
 
-func outfileName(j *Job) string {
-	return fmt.Sprintf("%s-outdata.zip", j.Id)
+	return d.db.Put(j.Id[:], data, nil)
 }
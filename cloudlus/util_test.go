@@ -1,7 +1,9 @@
 package cloudlus
 
 import (
+	"io/ioutil"
 	"log"
+	"os"
 	"testing"
 	"time"
 )
@@ -91,10 +93,11 @@ func TestGC(t *testing.T) {
 			t.Fatal(err)
 		}
 
-		npurged, nremain, err := db.GC()
+		purged, nremain, err := db.GC()
 		if err != nil {
 			t.Fatal(err)
 		}
+		npurged := len(purged)
 
 		upper := int64(dblimit) + 2*int64(jsize)
 
@@ -119,3 +122,142 @@ func TestGC(t *testing.T) {
 		}
 	}
 }
+
+func TestDB_Blobs(t *testing.T) {
+	db, _ := NewDB("", 0)
+	db.PurgeAge = -1 * time.Second
+
+	used, err := db.PutBlob([]byte("used"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	unused, _ := db.PutBlob([]byte("unused"))
+
+	if data, err := db.GetBlob(used); err != nil || string(data) != "used" {
+		t.Errorf("wrong blob data: got '%s' (err=%v), want 'used'", data, err)
+	}
+	if ok, _ := db.HasBlob(blobHash([]byte("other"))); ok {
+		t.Errorf("db claims to have a blob that was never stored")
+	}
+
+	j := NewJobCmd("cat", "in.txt")
+	j.Infiles = []File{{Name: "in.txt", Size: 4, Hash: used}}
+	j.Status = StatusQueued
+	db.Put(j)
+	if n, _ := db.Count(); n != 1 {
+		t.Errorf("blobs counted as jobs: got %v jobs, want 1", n)
+	}
+
+	if _, _, err := db.GC(); err != nil {
+		t.Fatal(err)
+	}
+	if ok, _ := db.HasBlob(used); !ok {
+		t.Errorf("GC removed blob referenced by a queued job")
+	}
+	if ok, _ := db.HasBlob(unused); ok {
+		t.Errorf("GC didn't remove unreferenced blob")
+	}
+}
+
+func TestDB_Query(t *testing.T) {
+	db, _ := NewDB("", 0)
+	testQuery(t, db)
+}
+
+func TestDB_QueryIndex(t *testing.T) {
+	tests := []struct {
+		q       Query
+		prefix  string
+		ordered bool
+	}{
+		{Query{Status: StatusQueued, Limit: 10}, statusPrefix + StatusQueued + "\x00", true},
+		{Query{Owner: "alice", Limit: 10}, ownerPrefix + "alice\x00", true},
+		{Query{Status: StatusComplete, SortBy: SortFinished, Limit: 10}, statusPrefix + StatusComplete + "\x00", false},
+		{Query{SortBy: SortFinished, Limit: 10}, finishPrefix, true},
+		{Query{Limit: 10}, submitPrefix, true},
+	}
+	for _, test := range tests {
+		if prefix, _, ordered := test.q.index(); prefix != test.prefix || ordered != test.ordered {
+			t.Errorf("query %+v: got index %q (ordered=%v), want %q (ordered=%v)", test.q, prefix, ordered, test.prefix, test.ordered)
+		}
+	}
+
+	// pages of status queries don't depend on the submit time index
+	db, _ := NewDB("", 0)
+	for i := 0; i < 3; i++ {
+		j := NewJobCmd("echo", "1")
+		j.Status = StatusQueued
+		j.Submitted = time.Now()
+		db.Put(j)
+		db.db.Delete(submitKey(j), nil)
+	}
+	if jobs, next, _ := db.Query(Query{Status: StatusQueued, Limit: 2}); len(jobs) != 2 || next == "" {
+		t.Errorf("status query with limit: got %v jobs and cursor %q, want 2 jobs and a cursor", len(jobs), next)
+	}
+}
+
+func TestDB_Tokens(t *testing.T) {
+	db, _ := NewDB("", 0)
+	testTokens(t, db)
+}
+
+func TestDB_Events(t *testing.T) {
+	db, _ := NewDB("", 0)
+	db.PurgeAge = -1 * time.Second
+	testEvents(t, db)
+}
+
+func TestDB_EventSeq(t *testing.T) {
+	dir, err := ioutil.TempDir("", "cloudlus-db")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	db, err := NewDB(dir, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 2; i++ {
+		db.AppendEvent(&Event{JobId: JobId{1}})
+	}
+	db.Close()
+
+	// sequence numbers continue after reopening the database
+	db, err = NewDB(dir, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	e := &Event{JobId: JobId{1}}
+	if err := db.AppendEvent(e); err != nil {
+		t.Fatal(err)
+	} else if e.Seq != 3 {
+		t.Errorf("event got Seq %v after reopening, want 3", e.Seq)
+	}
+}
+
+func TestDB_Reindex(t *testing.T) {
+	db, _ := NewDB("", 0)
+	j := NewJobCmd("echo", "1")
+	j.Status = StatusComplete
+	db.Put(j)
+
+	// simulate a database from before the query indexes existed
+	for _, key := range append(queryKeys(j), versionKey) {
+		db.db.Delete(key, nil)
+	}
+	if jobs, _, _ := db.Query(Query{Status: StatusComplete}); len(jobs) != 0 {
+		t.Fatalf("index entries not removed")
+	}
+
+	if err := db.reindex(); err != nil {
+		t.Fatal(err)
+	}
+	if jobs, _, _ := db.Query(Query{Status: StatusComplete}); len(jobs) != 1 {
+		t.Errorf("reindex didn't restore index entries: got %v jobs, want 1", len(jobs))
+	}
+	if n, _ := db.Count(); n != 1 {
+		t.Errorf("index entries counted as jobs: got %v jobs, want 1", n)
+	}
+}
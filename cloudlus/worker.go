@@ -1,9 +1,17 @@
 package cloudlus
 
 import (
+	"bufio"
+	"crypto/tls"
+	"fmt"
 	"io"
+	"io/ioutil"
 	"log"
 	"os"
+	"os/exec"
+	"path/filepath"
+	"runtime"
+	"sync"
 	"time"
 
 	"github.com/rwcarlsen/cloudlus/Godeps/_workspace/src/code.google.com/p/go-uuid/uuid"
@@ -25,11 +33,58 @@ type Worker struct {
 	// specified on each job.
 	JobTimeout time.Duration
 	ServerAddr string
-	FileCache  map[string][]byte
-	Wait       time.Duration
-	Whitelist  []string
-	// lastjob is last time a job was completed.
+	// Token is the secret of the API token (with the worker role) presented
+	// to the server.
+	Token string
+	// TLS, if not nil, is used to connect to the server over TLS - e.g. to
+	// present the worker's client certificate (see ClientTLS).
+	TLS *tls.Config
+	// CacheDir is the directory where input file blobs retrieved from the
+	// server are cached by hash - defaults to "cloudlus-blobs" in the
+	// worker's working directory.
+	CacheDir  string
+	Wait      time.Duration
+	Whitelist []string
+	// EnvAllow and EnvDeny are path.Match patterns of environment variable
+	// keys jobs may and may not set.  If EnvAllow is empty, jobs may set any
+	// variable not denied.
+	EnvAllow []string
+	EnvDeny  []string
+	// Labels are advertised to the server when fetching jobs - only jobs
+	// whose Requires labels are all present are dispatched to the worker.
+	// Labels can carry versions (e.g. "cyclus=1.3").
+	Labels []string
+	// CPUs is the number of CPUs available for running jobs - defaults to
+	// the number of CPUs on the machine.
+	CPUs int
+	// Memory is the amount of memory in MiB available for running jobs -
+	// defaults to the total memory on the machine.  If that can't be
+	// detected, memory is unlimited (negative).
+	Memory int
+	// Slots is the number of jobs the worker runs concurrently - defaults to
+	// one.  Each slot fetches, runs and heartbeats its own job.
+	Slots int
+	// lastjob is last time a job was fetched or completed.
 	lastjob time.Time
+	// host and started are reported to the server with each fetch.
+	host    string
+	started time.Time
+	// nrunning is the number of slots currently running jobs.
+	nrunning int
+	// usedcpus and usedmem are the resources reserved by running jobs.
+	usedcpus int
+	usedmem  int
+	// commands holds the whitelisted commands installed on the worker.
+	commands []string
+	mu       sync.Mutex
+	// fetchmu serializes fetching so concurrent slots don't advertise the
+	// same free resources.
+	fetchmu sync.Mutex
+	// drain is closed when the worker should stop fetching jobs.  abort is
+	// closed when running jobs should also be killed and handed back to the
+	// server.
+	drain chan struct{}
+	abort chan struct{}
 	// MaxIdle is the length of time a worker will wait without receiving a
 	// job before it shuts itself down.  If MaxIdle is zero, the worker runs
 	// forever.
@@ -42,7 +97,9 @@ func (w *Worker) Run() error {
 	copy(w.Id[:], uid)
 
 	w.lastjob = time.Now()
-	w.FileCache = map[string][]byte{}
+	w.started = w.lastjob
+	w.host, _ = os.Hostname()
+	w.initdrain()
 
 	wd, err := os.Getwd()
 	if err != nil {
@@ -50,42 +107,166 @@ func (w *Worker) Run() error {
 	}
 	os.Setenv("PATH", os.Getenv("PATH")+":"+wd)
 
+	if w.CacheDir == "" {
+		w.CacheDir = filepath.Join(wd, "cloudlus-blobs")
+	}
+
 	if w.Wait == 0 {
 		w.Wait = 10 * time.Second
 	}
+	if w.Slots < 1 {
+		w.Slots = 1
+	}
+	if w.CPUs == 0 {
+		w.CPUs = runtime.NumCPU()
+	}
+	if w.Memory == 0 {
+		w.Memory = systemMemory()
+	}
+	if w.Memory == 0 {
+		log.Printf("cannot determine system memory - not limiting the memory of jobs")
+		w.Memory = -1
+	}
+	for _, cmd := range w.Whitelist {
+		if _, err := exec.LookPath(cmd); err == nil {
+			w.commands = append(w.commands, cmd)
+		}
+	}
+
+	var wg sync.WaitGroup
+	for i := 0; i < w.Slots; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			w.runslot()
+		}()
+	}
+	wg.Wait()
+	if w.draining() {
+		log.Printf("worker drained, shutting down")
+	} else {
+		log.Printf("no jobs received for %v, shutting down", w.MaxIdle)
+	}
+	return nil
+}
+
+// Drain stops the worker from fetching new jobs and causes Run to return
+// once all running jobs are finished.  If abort is true, running jobs are
+// killed instead and handed back to the server to be requeued immediately.
+func (w *Worker) Drain(abort bool) {
+	w.initdrain()
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	select {
+	case <-w.drain:
+	default:
+		close(w.drain)
+	}
+	if !abort {
+		return
+	}
+	select {
+	case <-w.abort:
+	default:
+		close(w.abort)
+	}
+}
+
+func (w *Worker) initdrain() {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if w.drain == nil {
+		w.drain = make(chan struct{})
+		w.abort = make(chan struct{})
+	}
+}
+
+func (w *Worker) draining() bool {
+	select {
+	case <-w.drain:
+		return true
+	default:
+		return false
+	}
+}
 
-	for {
+// runslot repeatedly fetches and runs jobs until the worker has been idle
+// for longer than MaxIdle or is drained.
+func (w *Worker) runslot() {
+	for !w.draining() {
 		wait, err := w.dojob()
 		if err != nil {
 			log.Print(err)
 		}
-		if w.MaxIdle > 0 && time.Now().Sub(w.lastjob) > w.MaxIdle {
-			log.Printf("no jobs received for %v, shutting down", w.MaxIdle)
-			return nil
+		if w.idle() {
+			return
 		}
 		if wait {
-			<-time.After(w.Wait)
+			select {
+			case <-time.After(w.Wait):
+			case <-w.drain:
+			}
 		}
 	}
 }
 
+// idle returns true if no slots are running jobs and none have been fetched
+// or completed for longer than MaxIdle.
+func (w *Worker) idle() bool {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	return w.MaxIdle > 0 && w.nrunning == 0 && time.Now().Sub(w.lastjob) > w.MaxIdle
+}
+
 func (w *Worker) dojob() (wait bool, err error) {
-	client, err := Dial(w.ServerAddr)
+	client, err := DialTLS(w.ServerAddr, w.Token, w.TLS)
 	if err != nil {
 		return true, err
 	}
 	defer client.Close()
 
+	w.fetchmu.Lock()
+	if w.draining() {
+		w.fetchmu.Unlock()
+		return false, nil
+	}
 	j, err := client.Fetch(w)
 	if err == nojoberr {
+		w.fetchmu.Unlock()
+		return false, nil
+	} else if err == drainerr {
+		log.Printf("server requested drain")
+		w.fetchmu.Unlock()
+		w.Drain(false)
 		return false, nil
 	} else if err != nil {
+		w.fetchmu.Unlock()
 		return true, err
 	}
 
+	w.mu.Lock()
+	w.nrunning++
+	w.usedcpus += j.MinCPUs
+	w.usedmem += j.MinMemory
+	w.lastjob = time.Now()
+	w.mu.Unlock()
+	w.fetchmu.Unlock()
+
+	j.WorkerId = w.Id
+	aborted := false
 	defer func() {
-		err2 := client.Push(w, j)
+		var err2 error
+		if aborted {
+			err2 = client.Release(w.Id, j.Id)
+		} else {
+			err2 = client.Push(w, j)
+		}
+		w.mu.Lock()
+		w.nrunning--
+		w.usedcpus -= j.MinCPUs
+		w.usedmem -= j.MinMemory
 		w.lastjob = time.Now()
+		w.mu.Unlock()
 		if err == nil && err2 != nil {
 			err = err2
 		}
@@ -96,28 +277,44 @@ func (w *Worker) dojob() (wait bool, err error) {
 	}
 
 	j.Whitelist(w.Whitelist...)
+	j.AllowEnv(w.EnvAllow, w.EnvDeny)
 
-	// add precached files
-	for name, data := range w.FileCache {
-		j.AddInfile(name, data)
-	}
-
-	// cache new files needing caching
-	for _, f := range j.Infiles {
-		if f.Cache {
-			w.FileCache[f.Name] = f.Data
-		}
+	if err := w.resolveInfiles(client, j); err != nil {
+		j.Status = StatusFailed
+		j.FailReason = FailSetup
+		j.Stderr += fmt.Sprintf("\nworker %v failed to retrieve input files: %v\n", w.Id, err)
+		j.Infiles = nil
+		return false, err
 	}
 
 	done := make(chan struct{})
 	defer close(done)
-	kill := client.Heartbeat(w.Id, j.Id, done)
+	beatkill := client.Heartbeat(w.Id, j.Id, done)
+	kill := make(chan bool, 1)
+	go func() {
+		select {
+		case <-beatkill:
+			kill <- true
+		case <-w.abort:
+			kill <- true
+		case <-done:
+		}
+	}()
 
 	// run job
 	if w.nolog {
 		j.log = devnull
 	}
 
+	// stream output while the job runs - the rest is sent before pushing
+	logdone := make(chan struct{})
+	var flushed chan struct{}
+	j.stream, flushed = client.StreamLog(w.Id, j.Id, logdone)
+	defer func() {
+		close(logdone)
+		<-flushed
+	}()
+
 	pr, pw := io.Pipe()
 
 	rundone := make(chan bool)
@@ -127,15 +324,165 @@ func (w *Worker) dojob() (wait bool, err error) {
 		close(rundone)
 	}()
 
-	err = client.PushOutfile(j.Id, pr)
+	err = client.PushOutfile(w.Id, j.Id, pr)
 	if err != nil {
 		return false, err
 	}
 	<-rundone
 	pr.Close()
 
-	j.WorkerId = w.Id
+	select {
+	case <-w.abort:
+		if j.Status != StatusComplete {
+			log.Printf("job %v aborted by drain, returning it to the server", j.Id)
+			aborted = true
+		}
+	default:
+	}
+
 	j.Infiles = nil // don't need to send back input files
 
 	return false, nil
 }
+
+// resolveInfiles fills in the data of all of j's input files that refer to
+// blobs on the server - using the worker's blob cache where possible.
+func (w *Worker) resolveInfiles(client *Client, j *Job) error {
+	for i, f := range j.Infiles {
+		if f.Data != nil || f.Hash == "" {
+			continue
+		}
+
+		path := filepath.Join(w.CacheDir, f.Hash)
+		data, err := ioutil.ReadFile(path)
+		if err == nil && blobHash(data) == f.Hash {
+			j.Infiles[i].Data = data
+			continue
+		}
+
+		data, err = client.GetBlob(f.Hash)
+		if err != nil {
+			return err
+		} else if blobHash(data) != f.Hash {
+			return fmt.Errorf("blob %v for input file %v is corrupt", f.Hash, f.Name)
+		}
+		j.Infiles[i].Data = data
+
+		// write via a temporary file so concurrent slots never see partial
+		// blobs.
+		if err := os.MkdirAll(w.CacheDir, 0755); err != nil {
+			log.Print(err)
+			continue
+		}
+		tmp, err := ioutil.TempFile(w.CacheDir, f.Hash+".tmp")
+		if err != nil {
+			log.Print(err)
+			continue
+		}
+		_, err = tmp.Write(data)
+		if err2 := tmp.Close(); err == nil {
+			err = err2
+		}
+		if err == nil {
+			err = os.Rename(tmp.Name(), path)
+		}
+		if err != nil {
+			os.Remove(tmp.Name())
+			log.Print(err)
+		}
+	}
+	return nil
+}
+
+// info returns the worker's currently free resources and capabilities.
+func (w *Worker) info() WorkerInfo {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	return WorkerInfo{
+		Id:        w.Id,
+		Host:      w.host,
+		Started:   w.started,
+		Labels:    w.Labels,
+		CPUs:      w.CPUs - w.usedcpus,
+		Memory:    w.freeMemory(),
+		Commands:  w.commands,
+		Whitelist: len(w.Whitelist) > 0,
+	}
+}
+
+// freeMemory returns the memory in MiB not used by running jobs - or -1 if
+// the worker's memory is unlimited.  w.mu must be held.
+func (w *Worker) freeMemory() int {
+	if w.Memory < 0 {
+		return -1
+	}
+	return w.Memory - w.usedmem
+}
+
+// WorkerInfo describes a worker's capabilities and free resources.  Workers
+// send it to the server when fetching jobs.
+type WorkerInfo struct {
+	Id      WorkerId
+	Host    string
+	Started time.Time
+	Labels  []string
+	// CPUs is the number of free CPUs.
+	CPUs int
+	// Memory is the amount of free memory in MiB - negative if the worker's
+	// memory is unlimited.
+	Memory int
+	// Commands holds the whitelisted commands installed on the worker.
+	Commands []string
+	// Whitelist is true if the worker only runs jobs whose command is in
+	// Commands.
+	Whitelist bool
+}
+
+// CanRun returns true if the worker satisfies all of j's requirements.  A
+// nil worker can run any job.
+func (w *WorkerInfo) CanRun(j *Job) bool {
+	if w == nil {
+		return true
+	} else if j.MinCPUs > w.CPUs || (w.Memory >= 0 && j.MinMemory > w.Memory) {
+		return false
+	}
+
+	for _, req := range j.Requires {
+		if !contains(w.Labels, req) {
+			return false
+		}
+	}
+
+	if w.Whitelist && len(j.Cmd) > 0 && !contains(w.Commands, j.Cmd[0]) {
+		return false
+	}
+	return true
+}
+
+func contains(list []string, s string) bool {
+	for _, v := range list {
+		if v == s {
+			return true
+		}
+	}
+	return false
+}
+
+// systemMemory returns the total memory of the machine in MiB or zero if it
+// can't be determined.
+func systemMemory() int {
+	f, err := os.Open("/proc/meminfo")
+	if err != nil {
+		return 0
+	}
+	defer f.Close()
+
+	scan := bufio.NewScanner(f)
+	for scan.Scan() {
+		var kb int
+		if n, _ := fmt.Sscanf(scan.Text(), "MemTotal: %d kB", &kb); n == 1 {
+			return kb / 1024
+		}
+	}
+	return 0
+}
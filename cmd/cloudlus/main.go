@@ -1,6 +1,10 @@
 package main
 
 import (
+	"archive/zip"
+	"bytes"
+	"crypto/tls"
+	"encoding/csv"
 	"encoding/hex"
 	"encoding/json"
 	"flag"
@@ -8,17 +12,24 @@ import (
 	"io"
 	"io/ioutil"
 	"log"
+	"net/url"
 	"os"
 	"os/signal"
 	"path/filepath"
+	"strconv"
 	"strings"
 	"syscall"
+	"text/tabwriter"
 	"time"
 
 	"github.com/rwcarlsen/cloudlus/cloudlus"
 )
 
 var addr = flag.String("addr", "127.0.0.1:9875", "network address of dispatch server")
+var token = flag.String("token", os.Getenv("CLOUDLUS_TOKEN"), "API token secret presented to the server (default $CLOUDLUS_TOKEN)")
+var cafile = flag.String("ca", "", "PEM file of the certificate authority that signed the server's certificate (connects over TLS)")
+var certfile = flag.String("cert", "", "PEM client certificate file presented to the server (e.g. by workers)")
+var keyfile = flag.String("key", "", "PEM private key file of the -cert client certificate")
 
 type CmdFunc func(cmd string, args []string)
 
@@ -27,7 +38,17 @@ var cmds = map[string]CmdFunc{
 	"work":          work,
 	"submit":        submit,
 	"submit-infile": submitInfile,
+	"submit-array":  submitArray,
+	"array":         array,
 	"retrieve":      retrieve,
+	"cancel":        cancel,
+	"list":          list,
+	"logs":          logs,
+	"events":        events,
+	"workers":       workers,
+	"drain":         drain,
+	"token":         tokens,
+	"certs":         certs,
 	"pack":          pack,
 	"unpack":        unpack,
 }
@@ -42,6 +63,8 @@ func newFlagSet(cmd, args, desc string) *flag.FlagSet {
 }
 
 func main() {
+	// workers re-execute themselves to start jobs with resource limits
+	cloudlus.RunShim()
 	log.SetFlags(0)
 	flag.Usage = func() {
 		log.Printf("Usage: cloudlus [OPTION] <subcommand> [OPTION] [args]\n")
@@ -70,21 +93,75 @@ func main() {
 func serve(cmd string, args []string) {
 	fs := newFlagSet(cmd, "", "run a work dispatch server listening for jobs and workers")
 	host := fs.String("host", "", "server host base url")
-	rpcaddr := fs.String("rpc", "", "server rpc address (ip:port) for workers")
-	dbpath := fs.String("db", "./jobdb", "path to persistent, leveldb job database")
+	rpcaddr := fs.String("rpc", "", "address (ip:port) workers connect to (default is -addr)")
+	adminaddr := fs.String("admin", "", "address (ip:port) for token management, draining workers and resetting the queue (default is -addr)")
+	dashaddr := fs.String("dashboard", "", "address (ip:port) for the dashboard (default is -addr)")
+	store := fs.String("store", "leveldb", "job database backend (leveldb or sqlite - the latter requires building with -tags sqlite)")
+	dbpath := fs.String("db", "./jobdb", "path to persistent job database")
+	outdata := fs.String("outdata", ".", "directory for storing job output data archives")
 	dblimit := fs.Int("dblimit", 8000, "max job db size in MB for disk persistence")
+	weights := fs.String("weights", "", "comma-separated owner=weight list of fair share weights for job owners (default weight is 1)")
+	memoize := fs.Bool("memoize", false, "complete jobs identical to previously completed jobs with the earlier results instead of running them")
+	auth := fs.Bool("auth", false, "require API tokens for all requests (an admin token is created if there is none)")
+	tlscert := fs.String("tls-cert", "", "PEM certificate file for serving over TLS")
+	tlskey := fs.String("tls-key", "", "PEM private key file of the -tls-cert certificate")
+	workerca := fs.String("worker-ca", "", "PEM file of certificate authorities that must have signed workers' client certificates")
 	fs.Parse(args)
 
 	if *rpcaddr == "" {
 		*rpcaddr = *addr
 	}
 
-	db, err := cloudlus.NewDB(*dbpath, *dblimit*cloudlus.MB)
+	var db cloudlus.JobStore
+	var err error
+	switch *store {
+	case "leveldb":
+		db, err = cloudlus.NewDB(*dbpath, *dblimit*cloudlus.MB)
+	case "sqlite":
+		db, err = cloudlus.NewSQLiteDB(*dbpath, *dblimit*cloudlus.MB)
+	default:
+		log.Fatalf("unknown job database backend '%v'", *store)
+	}
+	fatalif(err)
+
+	blobs, err := cloudlus.NewFSBlobStore(*outdata)
 	fatalif(err)
 
-	s := cloudlus.NewServer(*addr, *rpcaddr, db)
+	sched := cloudlus.NewFairScheduler()
+	for _, w := range strings.Split(*weights, ",") {
+		if strings.TrimSpace(w) == "" {
+			continue
+		}
+		fields := strings.SplitN(w, "=", 2)
+		if len(fields) != 2 {
+			log.Fatalf("invalid owner weight '%v'", w)
+		}
+		weight, err := strconv.ParseFloat(fields[1], 64)
+		fatalif(err)
+		sched.Weights[strings.TrimSpace(fields[0])] = weight
+	}
+
+	s := cloudlus.NewServer(*addr, *rpcaddr, db, blobs, sched)
+	s.Addrs.Admin = *adminaddr
+	s.Addrs.Dashboard = *dashaddr
+	s.Memoize = *memoize
+	s.RequireAuth = *auth
 	s.Host = fulladdr(*host)
-	fmt.Printf("Listening on %v\n", *addr)
+	if *tlscert != "" || *tlskey != "" {
+		pair, err := tls.LoadX509KeyPair(*tlscert, *tlskey)
+		fatalif(err)
+		s.TLS = &tls.Config{Certificates: []tls.Certificate{pair}}
+		if !strings.HasPrefix(s.Host, "https://") {
+			s.Host = "https://" + strings.TrimPrefix(s.Host, "http://")
+		}
+	}
+	if *workerca != "" {
+		s.WorkerCAs, err = cloudlus.LoadCertPool(*workerca)
+		fatalif(err)
+	}
+	if *auth {
+		bootstrapToken(s)
+	}
 
 	sigs := make(chan os.Signal, 1)
 	signal.Notify(sigs, syscall.SIGINT, syscall.SIGTERM)
@@ -100,6 +177,9 @@ func serve(cmd string, args []string) {
 
 	err = s.ListenAndServe()
 	fatalif(err)
+	// listeners are closed by the signal handler - wait for it to finish
+	// saving jobs and exit
+	select {}
 }
 
 func work(cmd string, args []string) {
@@ -108,30 +188,66 @@ func work(cmd string, args []string) {
 	maxidle := fs.Duration("maxidle", 0*time.Minute, "idle time at which the worker shuts down (default is infinite)")
 	timeout := fs.Duration("timeout", 0, "maximum run time for jobs before force killed - default is to use each job's custom timeout")
 	whitelist := fs.String("whitelist", "", "comma-separated list of allowed commands for jobs (default allows all commands)")
+	envallow := fs.String("env-allow", "", "comma-separated list of environment variable key patterns jobs may set (default allows all keys)")
+	envdeny := fs.String("env-deny", "", "comma-separated list of environment variable key patterns jobs may not set (e.g. 'LD_*,PATH')")
+	slots := fs.Int("slots", 1, "number of jobs to run concurrently")
+	abort := fs.Bool("abort", false, "on SIGTERM/SIGINT, kill running jobs and return them to the server instead of finishing them")
+	labels := fs.String("labels", "", "comma-separated list of labels advertised to the server (e.g. 'cycamore,cyclus=1.3')")
+	cpus := fs.Int("cpus", 0, "number of CPUs available for jobs (default is all CPUs)")
+	mem := fs.Int("mem", 0, "memory in MiB available for jobs (default is all memory - unlimited if it can't be detected)")
+	cachedir := fs.String("cachedir", "", "directory for caching input files retrieved from the server (default ./cloudlus-blobs)")
 	fs.Parse(args)
 
-	wl := strings.Split(*whitelist, ",")
-	cmds := []string{}
-	for _, s := range wl {
-		trimmed := strings.TrimSpace(s)
-		if len(trimmed) > 0 {
-			cmds = append(cmds, trimmed)
-		}
-	}
+	config, err := clientTLS()
+	fatalif(err)
 
 	w := &cloudlus.Worker{
 		ServerAddr: *addr,
+		Token:      *token,
+		TLS:        config,
+		CacheDir:   *cachedir,
 		Wait:       *wait,
-		Whitelist:  cmds,
+		Whitelist:  splitList(*whitelist),
+		EnvAllow:   splitList(*envallow),
+		EnvDeny:    splitList(*envdeny),
+		Labels:     splitList(*labels),
+		CPUs:       *cpus,
+		Memory:     *mem,
 		MaxIdle:    *maxidle,
 		JobTimeout: *timeout,
+		Slots:      *slots,
+	}
+
+	sigs := make(chan os.Signal, 1)
+	signal.Notify(sigs, syscall.SIGINT, syscall.SIGTERM)
+	go func() {
+		<-sigs
+		log.Printf("draining worker - send another signal to exit immediately")
+		w.Drain(*abort)
+		<-sigs
+		os.Exit(1)
+	}()
+
+	err = w.Run()
+	fatalif(err)
+}
+
+// splitList returns the non-empty elements of the comma-separated list s.
+func splitList(s string) []string {
+	list := []string{}
+	for _, v := range strings.Split(s, ",") {
+		trimmed := strings.TrimSpace(v)
+		if len(trimmed) > 0 {
+			list = append(list, trimmed)
+		}
 	}
-	w.Run()
+	return list
 }
 
 func submit(cmd string, args []string) {
 	fs := newFlagSet(cmd, "[FILE...]", "submit a job file (may be piped to stdin)")
 	async := fs.Bool("async", false, "true for asynchronous submission")
+	jf := newJobFlags(fs)
 	fs.Parse(args)
 
 	data := stdin(fs)
@@ -146,12 +262,17 @@ func submit(cmd string, args []string) {
 		}
 	}
 
+	for _, j := range jobs {
+		jf.apply(fs, j)
+	}
+
 	run(jobs, *async)
 }
 
 func submitInfile(cmd string, args []string) {
 	fs := newFlagSet(cmd, "[FILE...]", "submit a cyclus input file with default run params (may be piped to stdin)")
 	async := fs.Bool("async", false, "true for asynchronous submission")
+	jf := newJobFlags(fs)
 	fs.Parse(args)
 
 	data := stdin(fs)
@@ -166,11 +287,202 @@ func submitInfile(cmd string, args []string) {
 		}
 	}
 
+	for _, j := range jobs {
+		jf.apply(fs, j)
+	}
+
 	run(jobs, *async)
 }
 
+func submitArray(cmd string, args []string) {
+	fs := newFlagSet(cmd, "[TEMPLATE]", "submit a template job file (may be piped to stdin) to run once for each parameter set")
+	params := fs.String("params", "", "CSV file (with a header row naming the parameters) or JSON file (a list of objects) of parameter sets")
+	templates := fs.String("templates", "", "comma-separated list of the template's input files to expand with each parameter set")
+	jf := newJobFlags(fs)
+	fs.Parse(args)
+
+	data := stdin(fs)
+	if data == nil {
+		if len(fs.Args()) != 1 {
+			log.Fatal("exactly one template job file must be specified")
+		}
+		var err error
+		data, err = ioutil.ReadFile(fs.Arg(0))
+		fatalif(err)
+	}
+	tmpl := loadJob(data)
+	jf.apply(fs, tmpl)
+
+	if *params == "" {
+		log.Fatal("no parameter file specified")
+	}
+	sets, err := readParams(*params)
+	fatalif(err)
+
+	client, err := dial()
+	fatalif(err)
+	defer client.Close()
+
+	st, err := client.SubmitArray(cloudlus.NewJobArray(tmpl, sets, splitList(*templates)...))
+	fatalif(err)
+	fmt.Printf("%v\n", st.Id)
+}
+
+// readParams reads job array parameter sets from a CSV file with a header
+// row or a JSON file holding a list of objects.
+func readParams(fname string) ([]map[string]string, error) {
+	f, err := os.Open(fname)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	sets := []map[string]string{}
+	if strings.HasSuffix(strings.ToLower(fname), ".csv") {
+		rows, err := csv.NewReader(f).ReadAll()
+		if err != nil {
+			return nil, err
+		} else if len(rows) == 0 {
+			return nil, fmt.Errorf("%v has no header row", fname)
+		}
+		for _, row := range rows[1:] {
+			set := map[string]string{}
+			for i, key := range rows[0] {
+				set[key] = row[i]
+			}
+			sets = append(sets, set)
+		}
+		return sets, nil
+	}
+
+	dec := json.NewDecoder(f)
+	dec.UseNumber()
+	var objs []map[string]interface{}
+	if err := dec.Decode(&objs); err != nil {
+		return nil, fmt.Errorf("%v: %v", fname, err)
+	}
+	for _, obj := range objs {
+		set := map[string]string{}
+		for key, v := range obj {
+			set[key] = fmt.Sprint(v)
+		}
+		sets = append(sets, set)
+	}
+	return sets, nil
+}
+
+func array(cmd string, args []string) {
+	fs := newFlagSet(cmd, "ARRAYID...", "print the progress of job arrays as json")
+	cancel := fs.Bool("cancel", false, "cancel the arrays' unfinished jobs")
+	retry := fs.Bool("retry", false, "requeue the arrays' failed and canceled jobs")
+	fs.Parse(args)
+
+	client, err := dial()
+	fatalif(err)
+	defer client.Close()
+
+	for _, arg := range fs.Args() {
+		id, err := parseJobId(arg)
+		if err != nil {
+			log.Printf("invalid array id '%v'", arg)
+			continue
+		}
+
+		var st *cloudlus.ArrayStat
+		switch {
+		case *cancel:
+			st, err = client.CancelArray(id)
+		case *retry:
+			st, err = client.RetryArray(id)
+		default:
+			st, err = client.Array(id)
+		}
+		if err != nil {
+			log.Println(err)
+			continue
+		}
+
+		data, err := json.Marshal(st)
+		fatalif(err)
+		fmt.Printf("%s\n", data)
+	}
+}
+
+// jobFlags holds flags common to all job submission subcommands that
+// override the corresponding fields of submitted jobs.
+type jobFlags struct {
+	owner    *string
+	priority *int
+	retries  *int
+	backoff  *time.Duration
+	requires *string
+	minmem   *int
+	mincpus  *int
+	nocache  *bool
+	limits   cloudlus.Limits
+}
+
+func newJobFlags(fs *flag.FlagSet) *jobFlags {
+	jf := &jobFlags{
+		owner:    fs.String("owner", "", "owner of submitted jobs (default $USER)"),
+		priority: fs.Int("priority", 0, "scheduling priority of submitted jobs"),
+		retries:  fs.Int("retries", 0, "max number of times to retry failed jobs"),
+		backoff:  fs.Duration("backoff", 0, "delay before retrying failed jobs - doubled for each retry"),
+		requires: fs.String("requires", "", "comma-separated list of worker labels required by submitted jobs"),
+		minmem:   fs.Int("min-mem", 0, "free worker memory in MiB required by submitted jobs"),
+		mincpus:  fs.Int("min-cpus", 0, "free worker CPUs required by submitted jobs"),
+		nocache:  fs.Bool("nocache", false, "always run submitted jobs even if the server has memoized results"),
+	}
+	fs.IntVar(&jf.limits.MaxMemory, "max-mem", 0, "kill submitted jobs using more than this much memory in MiB (linux workers only)")
+	fs.DurationVar(&jf.limits.MaxCPUTime, "max-cpu-time", 0, "kill submitted job processes using more than this much CPU time (linux workers only)")
+	fs.IntVar(&jf.limits.MaxOpenFiles, "max-files", 0, "max number of open files per submitted job process (linux workers only)")
+	fs.IntVar(&jf.limits.MaxFileSize, "max-file-size", 0, "max size in MiB of files written by submitted jobs (linux workers only)")
+	fs.IntVar(&jf.limits.MaxDisk, "max-disk", 0, "kill submitted jobs using more than this much scratch disk space in MiB (linux workers only)")
+	fs.BoolVar(&jf.limits.Isolate, "isolate", false, "run submitted jobs in new user, mount and network namespaces without network access (linux workers only)")
+	return jf
+}
+
+// apply sets j's fields for all flags explicitly set in fs.
+func (jf *jobFlags) apply(fs *flag.FlagSet, j *cloudlus.Job) {
+	fs.Visit(func(f *flag.Flag) {
+		switch f.Name {
+		case "owner":
+			j.Owner = *jf.owner
+		case "priority":
+			j.Priority = *jf.priority
+		case "retries":
+			j.MaxRetries = *jf.retries
+		case "backoff":
+			j.RetryBackoff = *jf.backoff
+		case "requires":
+			j.Requires = splitList(*jf.requires)
+		case "min-mem":
+			j.MinMemory = *jf.minmem
+		case "min-cpus":
+			j.MinCPUs = *jf.mincpus
+		case "nocache":
+			j.NoCache = *jf.nocache
+		case "max-mem":
+			j.Limits.MaxMemory = jf.limits.MaxMemory
+		case "max-cpu-time":
+			j.Limits.MaxCPUTime = jf.limits.MaxCPUTime
+		case "max-files":
+			j.Limits.MaxOpenFiles = jf.limits.MaxOpenFiles
+		case "max-file-size":
+			j.Limits.MaxFileSize = jf.limits.MaxFileSize
+		case "max-disk":
+			j.Limits.MaxDisk = jf.limits.MaxDisk
+		case "isolate":
+			j.Limits.Isolate = jf.limits.Isolate
+		}
+	})
+	if j.Owner == "" {
+		j.Owner = os.Getenv("USER")
+	}
+}
+
 func run(jobs []*cloudlus.Job, async bool) {
-	client, err := cloudlus.Dial(*addr)
+	client, err := dial()
 	fatalif(err)
 	defer client.Close()
 
@@ -193,6 +505,10 @@ func run(jobs []*cloudlus.Job, async bool) {
 			continue
 		}
 
+		if j.Status != cloudlus.StatusComplete {
+			log.Printf("job %v %v (exit code %v)", j.Id, status(j.Status, j.FailReason), j.ExitCode)
+		}
+
 		fname := fmt.Sprintf("result-%v.json", j.Id)
 		err := ioutil.WriteFile(fname, saveJob(j), 0644)
 		if err != nil {
@@ -235,18 +551,16 @@ func retrieve(cmd string, args []string) {
 		log.Fatal("no job id specified")
 	}
 
-	client, err := cloudlus.Dial(*addr)
+	client, err := dial()
 	fatalif(err)
 	defer client.Close()
 
 	for _, arg := range fs.Args() {
-		uid, err := hex.DecodeString(arg)
+		jid, err := parseJobId(arg)
 		if err != nil {
 			log.Println(err)
 			continue
 		}
-		var jid cloudlus.JobId
-		copy(jid[:], uid)
 
 		j, err := client.Retrieve(jid)
 		if err != nil {
@@ -262,37 +576,394 @@ func retrieve(cmd string, args []string) {
 	}
 }
 
-func unpack(cmd string, args []string) {
-	fs := newFlagSet(cmd, "", "unpack all the named job files' output files into id-named directories")
+func cancel(cmd string, args []string) {
+	fs := newFlagSet(cmd, "[JOBID...]", "cancel queued or running jobs with the given ids")
 	fs.Parse(args)
 
-	for _, fname := range fs.Args() {
-		data, err := ioutil.ReadFile(fname)
+	if len(fs.Args()) == 0 {
+		log.Fatal("no job id specified")
+	}
+
+	client, err := dial()
+	fatalif(err)
+	defer client.Close()
+
+	for _, arg := range fs.Args() {
+		jid, err := parseJobId(arg)
+		if err != nil {
+			log.Println(err)
+			continue
+		}
+
+		if err := client.Cancel(jid); err != nil {
+			log.Println(err)
+			continue
+		}
+		fmt.Printf("%v\n", jid)
+	}
+}
+
+func logs(cmd string, args []string) {
+	fs := newFlagSet(cmd, "JOBID", "print the combined stdout and stderr of a job")
+	follow := fs.Bool("f", false, "keep printing output as it arrives until the job finishes")
+	fs.Parse(args)
+
+	if len(fs.Args()) != 1 {
+		log.Fatal("exactly one job id must be specified")
+	}
+	jid, err := parseJobId(fs.Arg(0))
+	fatalif(err)
+
+	client, err := dial()
+	fatalif(err)
+	defer client.Close()
+
+	fatalif(client.CopyLog(os.Stdout, jid, *follow))
+}
+
+func events(cmd string, args []string) {
+	fs := newFlagSet(cmd, "[JOBID]", "print the status transitions of a job or, without a job id, of all jobs")
+	since := fs.Uint64("since", 0, "only print events following the one with this sequence number")
+	limit := fs.Int("n", 0, "print at most n events (default 1000 without a job id)")
+	asjson := fs.Bool("json", false, "print events as json")
+	fs.Parse(args)
+
+	if len(fs.Args()) > 1 {
+		log.Fatal("at most one job id may be specified")
+	}
+
+	client, err := dial()
+	fatalif(err)
+	defer client.Close()
+
+	var evs []*cloudlus.Event
+	if len(fs.Args()) == 1 {
+		jid, err := parseJobId(fs.Arg(0))
+		fatalif(err)
+		evs, err = client.JobEvents(jid)
 		fatalif(err)
-		j := loadJob(data)
+		for len(evs) > 0 && evs[0].Seq <= *since {
+			evs = evs[1:]
+		}
+		if *limit > 0 && len(evs) > *limit {
+			evs = evs[:*limit]
+		}
+	} else {
+		evs, err = client.Events(*since, *limit)
+		fatalif(err)
+	}
+
+	if *asjson {
+		data, err := json.MarshalIndent(evs, "", "    ")
+		fatalif(err)
+		fmt.Printf("%s\n", data)
+		return
+	}
+
+	tw := tabwriter.NewWriter(os.Stdout, 0, 8, 2, ' ', 0)
+	fmt.Fprintf(tw, "SEQ\tTIME\tJOB\tEVENT\tSTATUS\tWORKER\tBY\tDETAILS\n")
+	for _, e := range evs {
+		worker := ""
+		if e.WorkerId != (cloudlus.WorkerId{}) {
+			worker = e.WorkerId.String()
+		}
+		old := e.OldStatus
+		if old == "" {
+			old = "-"
+		}
+		fmt.Fprintf(tw, "%v\t%v\t%v\t%v\t%v -> %v\t%v\t%v\t%v\n", e.Seq, e.Time.Format(time.StampMilli),
+			e.JobId, e.Type, old, e.NewStatus, worker, e.Actor, e.Msg)
+	}
+	tw.Flush()
+}
+
+func list(cmd string, args []string) {
+	fs := newFlagSet(cmd, "", "list jobs matching the given filters - newest first")
+	fs.String("status", "", "only list jobs with the given status")
+	fs.String("owner", "", "only list jobs submitted by the given owner")
+	fs.String("reason", "", "only list jobs that failed for the given reason (e.g. timeout)")
+	fs.String("worker", "", "only list jobs dispatched to the worker with the given id")
+	fs.String("array", "", "only list the jobs of the job array with the given id")
+	fs.String("note", "", "only list jobs with notes containing the given text")
+	fs.String("cmd", "", "only list jobs with commands containing the given text")
+	fs.String("submitted-after", "", "only list jobs submitted after the given time (RFC3339 or a duration ago, e.g. 2h)")
+	fs.String("submitted-before", "", "only list jobs submitted before the given time")
+	fs.String("finished-after", "", "only list jobs finished after the given time")
+	fs.String("finished-before", "", "only list jobs finished before the given time")
+	fs.String("sort", "submitted", "job time to sort by (submitted, or finished to list finished jobs only)")
+	fs.String("order", "desc", "sort order (asc or desc)")
+	fs.Int("limit", 0, "maximum number of jobs per page (default is the server's limit)")
+	fs.String("cursor", "", "continue listing from the given cursor")
+	all := fs.Bool("all", false, "list all matching jobs instead of a single page")
+	asjson := fs.Bool("json", false, "print jobs as json")
+	fs.Parse(args)
+
+	v := url.Values{}
+	fs.Visit(func(f *flag.Flag) {
+		if f.Name != "all" && f.Name != "json" {
+			v.Set(f.Name, f.Value.String())
+		}
+	})
+	q, err := cloudlus.ParseQuery(v)
+	fatalif(err)
+
+	client, err := dial()
+	fatalif(err)
+	defer client.Close()
+
+	tw := tabwriter.NewWriter(os.Stdout, 0, 8, 2, ' ', 0)
+	if !*asjson {
+		fmt.Fprintf(tw, "ID\tSTATUS\tOWNER\tSUBMITTED\tFINISHED\tCMD\tNOTE\n")
+	}
+	for {
+		page, err := client.List(q)
+		fatalif(err)
+
+		for _, j := range page.Jobs {
+			if *asjson {
+				data, err := json.Marshal(j)
+				fatalif(err)
+				fmt.Printf("%s\n", data)
+				continue
+			}
+			finished := ""
+			if !j.Finished.IsZero() {
+				finished = j.Finished.Format(time.Stamp)
+			}
+			fmt.Fprintf(tw, "%v\t%v\t%v\t%v\t%v\t%v\t%v\n", j.Id, status(j.Status, j.FailReason), j.Owner,
+				j.Submitted.Format(time.Stamp), finished, strings.Join(j.Cmd, " "), j.Note)
+		}
+		tw.Flush()
+
+		if page.Next == "" {
+			return
+		} else if !*all {
+			log.Printf("more jobs: continue with -cursor=%v", page.Next)
+			return
+		}
+		q.Cursor = page.Next
+	}
+}
+
+func workers(cmd string, args []string) {
+	fs := newFlagSet(cmd, "", "list the workers known to the server")
+	asjson := fs.Bool("json", false, "print worker status as json")
+	fs.Parse(args)
+
+	client, err := dial()
+	fatalif(err)
+	defer client.Close()
+
+	ws, err := client.Workers()
+	fatalif(err)
+
+	if *asjson {
+		data, err := json.MarshalIndent(ws, "", "    ")
+		fatalif(err)
+		fmt.Printf("%s\n", data)
+		return
+	}
+
+	tw := tabwriter.NewWriter(os.Stdout, 0, 8, 2, ' ', 0)
+	fmt.Fprintf(tw, "ID\tHOST\tLABELS\tJOBS\tCOMPLETED\tFAILED\tUPTIME\tLAST SEEN\n")
+	for _, w := range ws {
+		fmt.Fprintf(tw, "%v\t%v\t%v\t%v\t%v\t%v\t%v\t%v\n", w.Id, w.Host,
+			strings.Join(w.Labels, ","), len(w.Jobs), w.NCompleted, w.NFailed,
+			w.Uptime-w.Uptime%time.Second, w.LastSeen.Format(time.Stamp))
+	}
+	tw.Flush()
+}
+
+func drain(cmd string, args []string) {
+	fs := newFlagSet(cmd, "[WORKERID...]", "ask workers to shut down after finishing their running jobs")
+	all := fs.Bool("all", false, "drain all workers")
+	fs.Parse(args)
+
+	if !*all && len(fs.Args()) == 0 {
+		log.Fatal("no worker id specified")
+	}
+
+	client, err := dial()
+	fatalif(err)
+	defer client.Close()
+
+	if *all {
+		fatalif(client.DrainAll())
+		return
+	}
+
+	for _, arg := range fs.Args() {
+		var wid cloudlus.WorkerId
+		uid, err := hex.DecodeString(arg)
+		if err != nil || len(uid) != len(wid) {
+			log.Printf("invalid worker id '%v'", arg)
+			continue
+		}
+		copy(wid[:], uid)
+
+		if err := client.Drain(wid); err != nil {
+			log.Println(err)
+			continue
+		}
+		fmt.Printf("%v\n", wid)
+	}
+}
+
+func tokens(cmd string, args []string) {
+	fs := newFlagSet(cmd, "[-create ROLE [-owner NAME] | -revoke ID...]", "list, create or revoke API tokens (requires an admin token)")
+	create := fs.String("create", "", "create a token with the given role ("+strings.Join(cloudlus.Roles, ", ")+") and print its secret")
+	owner := fs.String("owner", "", "owner recorded for all jobs submitted with the created token")
+	revoke := fs.Bool("revoke", false, "revoke the tokens with the given ids")
+	fs.Parse(args)
+
+	client, err := dial()
+	fatalif(err)
+	defer client.Close()
+
+	if *create != "" {
+		it, err := client.CreateToken(*owner, *create)
+		fatalif(err)
+		log.Printf("created %v token %v", it.Role, it.Id)
+		fmt.Println(it.Secret)
+		return
+	} else if *revoke {
+		for _, id := range fs.Args() {
+			if err := client.RevokeToken(id); err != nil {
+				log.Println(err)
+				continue
+			}
+			fmt.Println(id)
+		}
+		return
+	}
+
+	ts, err := client.Tokens()
+	fatalif(err)
+	tw := tabwriter.NewWriter(os.Stdout, 0, 8, 2, ' ', 0)
+	fmt.Fprintf(tw, "ID\tROLE\tOWNER\tCREATED\n")
+	for _, t := range ts {
+		fmt.Fprintf(tw, "%v\t%v\t%v\t%v\n", t.Id, t.Role, t.Owner, t.Created.Format(time.Stamp))
+	}
+	tw.Flush()
+}
+
+// bootstrapToken creates an admin token for s if it doesn't have one yet so
+// the server can be administered once it requires API tokens.
+func bootstrapToken(s *cloudlus.Server) {
+	ts, err := s.Tokens()
+	fatalif(err)
+	for _, t := range ts {
+		if t.Role == cloudlus.RoleAdmin {
+			return
+		}
+	}
+
+	it, err := s.CreateToken("", cloudlus.RoleAdmin)
+	fatalif(err)
+	fmt.Printf("Created admin API token (shown only once): %v\n", it.Secret)
+}
 
-		dirname := fmt.Sprintf("files-%x", j.Id)
+func certs(cmd string, args []string) {
+	fs := newFlagSet(cmd, "", "create a certificate authority in -dir (unless it exists) and server and worker certificates signed by it")
+	dir := fs.String("dir", ".", "directory holding the certificate authority (ca.pem, ca-key.pem) and the created certificates")
+	server := fs.String("server", "", "comma-separated host names and IP addresses to create a server certificate (server.pem, server-key.pem) for")
+	worker := fs.String("worker", "", "name of a worker to create a client certificate ([name].pem, [name]-key.pem) for")
+	valid := fs.Duration("valid", 5*365*24*time.Hour, "validity period of created certificates")
+	fs.Parse(args)
+
+	cafile, cakey := filepath.Join(*dir, "ca.pem"), filepath.Join(*dir, "ca-key.pem")
+	ca, err := cloudlus.LoadCertKey(cafile, cakey)
+	if os.IsNotExist(err) {
+		ca, err = cloudlus.NewCA("cloudlus CA", *valid)
+		fatalif(err)
+		fatalif(ca.WriteFiles(cafile, cakey))
+		fmt.Printf("created certificate authority %v\n", cafile)
+	} else {
+		fatalif(err)
+	}
 
-		err = os.MkdirAll(dirname, 0755)
+	if *server != "" {
+		hosts := splitList(*server)
+		ck, err := ca.Issue(hosts[0], hosts, *valid)
 		fatalif(err)
+		certfile := filepath.Join(*dir, "server.pem")
+		fatalif(ck.WriteFiles(certfile, filepath.Join(*dir, "server-key.pem")))
+		fmt.Printf("created server certificate %v for %v\n", certfile, strings.Join(hosts, ", "))
+	}
+	if *worker != "" {
+		ck, err := ca.Issue(*worker, nil, *valid)
+		fatalif(err)
+		certfile := filepath.Join(*dir, *worker+".pem")
+		fatalif(ck.WriteFiles(certfile, filepath.Join(*dir, *worker+"-key.pem")))
+		fmt.Printf("created worker certificate %v\n", certfile)
+	}
+}
+
+func unpack(cmd string, args []string) {
+	fs := newFlagSet(cmd, "", "unpack all the named job files' (or output data zip files') files into id-named directories")
+	fs.Parse(args)
 
-		for _, f := range j.Outfiles {
-			p := filepath.Join(dirname, f.Name)
-			err := ioutil.WriteFile(p, f.Data, 0644)
+	for _, fname := range fs.Args() {
+		data, err := ioutil.ReadFile(fname)
+		fatalif(err)
+
+		var dirname string
+		var files []cloudlus.File
+		if strings.HasSuffix(fname, ".zip") {
+			dirname = strings.TrimSuffix(filepath.Base(fname), ".zip")
+			files, err = unzip(data)
 			fatalif(err)
+		} else {
+			j := loadJob(data)
+			dirname = fmt.Sprintf("files-%x", j.Id)
+			files = append(j.Outfiles, j.Infiles...)
 		}
-		for _, f := range j.Infiles {
-			p := filepath.Join(dirname, f.Name)
-			err := ioutil.WriteFile(p, f.Data, 0644)
+
+		for _, f := range files {
+			p := filepath.Join(dirname, filepath.FromSlash(f.Name))
+			if !strings.HasPrefix(p, dirname+string(filepath.Separator)) {
+				log.Fatalf("file '%v' is outside the unpack directory", f.Name)
+			}
+			err := os.MkdirAll(filepath.Dir(p), 0755)
+			fatalif(err)
+			err = ioutil.WriteFile(p, f.Data, 0644)
 			fatalif(err)
 		}
 		fmt.Println(dirname)
 	}
 }
 
+// unzip returns all the files in the zip archive data.
+func unzip(data []byte) ([]cloudlus.File, error) {
+	r, err := zip.NewReader(bytes.NewReader(data), int64(len(data)))
+	if err != nil {
+		return nil, err
+	}
+
+	files := []cloudlus.File{}
+	for _, f := range r.File {
+		if f.FileInfo().IsDir() {
+			continue
+		}
+		rc, err := f.Open()
+		if err != nil {
+			return nil, err
+		}
+		data, err := ioutil.ReadAll(rc)
+		rc.Close()
+		if err != nil {
+			return nil, err
+		}
+		files = append(files, cloudlus.File{Name: f.Name, Data: data, Size: len(data)})
+	}
+	return files, nil
+}
+
 func pack(cmd string, args []string) {
 	fs := newFlagSet(cmd, "", "pack all files in the working directory into a job submit file")
 	fname := fs.String("o", "", "send pack data to file instead of stdout")
+	stdinfile := fs.String("stdin", "", "name of a packed file to feed to the job's standard input")
+	dir := fs.String("dir", "", "working directory of the job's command relative to its scratch directory")
 	fs.Parse(args)
 
 	d, err := os.Open(".")
@@ -302,6 +973,8 @@ func pack(cmd string, args []string) {
 	files, err := d.Readdir(-1)
 	fatalif(err)
 	j := cloudlus.NewJob()
+	j.Stdin = *stdinfile
+	j.Dir = *dir
 	for _, info := range files {
 		if info.IsDir() {
 			continue
@@ -311,6 +984,9 @@ func pack(cmd string, args []string) {
 		if info.Name() == "cmd.txt" {
 			err := json.Unmarshal(data, &j.Cmd)
 			fatalif(err)
+		} else if info.Name() == "env.txt" {
+			err := json.Unmarshal(data, &j.Env)
+			fatalif(err)
 		} else if info.Name() == "want.txt" {
 			list := []string{}
 			err := json.Unmarshal(data, &list)
@@ -333,6 +1009,32 @@ func pack(cmd string, args []string) {
 	}
 }
 
+// status returns a job status annotated with its failure reason.
+func status(s, reason string) string {
+	if reason == "" || reason == s {
+		return s
+	}
+	return fmt.Sprintf("%v (%v)", s, reason)
+}
+
+// dial connects to the server presenting the -token API token.
+func dial() (*cloudlus.Client, error) {
+	config, err := clientTLS()
+	if err != nil {
+		return nil, err
+	}
+	return cloudlus.DialTLS(*addr, *token, config)
+}
+
+// clientTLS returns the TLS config given by the -ca, -cert and -key flags or
+// nil if none were given.
+func clientTLS() (*tls.Config, error) {
+	if *cafile == "" && *certfile == "" && *keyfile == "" {
+		return nil, nil
+	}
+	return cloudlus.ClientTLS(*cafile, *certfile, *keyfile)
+}
+
 func fatalif(err error) {
 	if err != nil {
 		log.Fatal(err)
@@ -340,12 +1042,24 @@ func fatalif(err error) {
 }
 
 func fulladdr(addr string) string {
-	if !strings.HasPrefix(addr, "http://") && addr != "" {
+	if !strings.HasPrefix(addr, "http://") && !strings.HasPrefix(addr, "https://") && addr != "" {
 		return "http://" + addr
 	}
 	return addr
 }
 
+func parseJobId(s string) (cloudlus.JobId, error) {
+	var jid cloudlus.JobId
+	uid, err := hex.DecodeString(s)
+	if err != nil {
+		return jid, err
+	} else if len(uid) != len(jid) {
+		return jid, fmt.Errorf("invalid job id '%v'", s)
+	}
+	copy(jid[:], uid)
+	return jid, nil
+}
+
 func stdin(fs *flag.FlagSet) []byte {
 	if len(fs.Args()) > 0 {
 		return nil
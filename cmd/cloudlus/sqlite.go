@@ -0,0 +1,8 @@
+//go:build sqlite
+// +build sqlite
+
+package main
+
+// The SQLite job database backend (serve -store=sqlite) needs cgo, so its
+// driver is only linked into builds with the sqlite tag.
+import _ "github.com/rwcarlsen/cloudlus/Godeps/_workspace/src/github.com/rwcarlsen/go-sqlite/sqlite3"
@@ -41,6 +41,8 @@ var (
 	runlog       = flag.String("runlog", "run.log", "file to log local cyclus run output")
 	dbname       = flag.String("db", "pswarm.sqlite", "name for database containing optimizer work")
 	restart      = flag.Int("restart", -1, "iteration to restart from (default is no restart)")
+	owner        = flag.String("owner", "", "owner name for fair share scheduling of submitted jobs (default $USER)")
+	priority     = flag.Int("priority", 0, "scheduling priority of submitted jobs relative to the owner's other jobs")
 )
 
 const outfile = "objective.out"
@@ -312,6 +314,10 @@ func buildjob(scen *scen.Scenario) *cloudlus.Job {
 
 	j := cloudlus.NewJobCmd("cycdriver", "-obj", "-out", outfile, "-scen", *scenfile)
 	j.Timeout = *timeout
+	j.Priority = *priority
+	if *owner != "" {
+		j.Owner = *owner
+	}
 	j.AddInfile(scen.CyclusTmpl, tmpldata)
 	j.AddInfile(*scenfile, scendata)
 	j.AddOutfile(outfile)